@@ -7,6 +7,8 @@ require (
 	github.com/magefile/mage v1.11.0 // indirect
 	go.deanishe.net/env v0.5.1 // indirect
 	go.deanishe.net/fuzzy v1.0.0 // indirect
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/net v0.0.0-20210825183410-e898025ed96a
-	golang.org/x/text v0.3.6 // indirect
+	golang.org/x/sys v0.7.0 // indirect
+	golang.org/x/text v0.3.6
 )
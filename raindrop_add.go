@@ -7,13 +7,11 @@
 package main
 
 import (
-	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"net/http"
+	"log"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 
@@ -22,10 +20,17 @@ import (
 
 func select_collection(query string, bookmark_url string, bookmark_title string, firefox_json string, full_collection_paths bool) {
 	if firefox_json != "" {
-		var firefox_interface map[string]interface{}
-		json.Unmarshal([]byte(firefox_json), &firefox_interface)
-		bookmark_url = firefox_interface["alfredworkflow"].(map[string]interface{})["variables"].(map[string]interface{})["FF_URL"].(string)
-		bookmark_title = firefox_interface["alfredworkflow"].(map[string]interface{})["variables"].(map[string]interface{})["FF_TITLE"].(string)
+		var firefox_info struct {
+			Alfredworkflow struct {
+				Variables struct {
+					URL   string `json:"FF_URL"`
+					Title string `json:"FF_TITLE"`
+				} `json:"variables"`
+			} `json:"alfredworkflow"`
+		}
+		decode_response([]byte(firefox_json), &firefox_info)
+		bookmark_url = firefox_info.Alfredworkflow.Variables.URL
+		bookmark_title = firefox_info.Alfredworkflow.Variables.Title
 	} else {
 		if bookmark_title_decoded, err := base64.StdEncoding.DecodeString(bookmark_title); err == nil {
 			bookmark_title = strings.TrimSuffix(string(bookmark_title_decoded), "\n")
@@ -92,14 +97,14 @@ func select_collection(query string, bookmark_url string, bookmark_title string,
 		Var("goto", "save now")
 
 	// Get collections
-	var raindrop_collections []interface{}
-	var raindrop_collections_sublevel []interface{}
+	var raindrop_collections []Collection
+	var raindrop_collections_sublevel []Collection
 	if query != "" {
-		raindrop_collections = reverse_interface_array(get_collections(token, false, "trust"))
-		raindrop_collections_sublevel = reverse_interface_array(get_collections(token, true, "trust"))
+		raindrop_collections = reverse_collection_array(get_collections(token, false, "trust"))
+		raindrop_collections_sublevel = reverse_collection_array(get_collections(token, true, "trust"))
 	} else {
-		raindrop_collections = reverse_interface_array(get_collections(token, false, "check"))
-		raindrop_collections_sublevel = reverse_interface_array(get_collections(token, true, "check"))
+		raindrop_collections = reverse_collection_array(get_collections(token, false, "check"))
+		raindrop_collections_sublevel = reverse_collection_array(get_collections(token, true, "check"))
 	}
 
 	var current_object []string
@@ -121,6 +126,14 @@ func set_title(title string) {
 	selection_map["title"] = title
 	selection_json, _ := json.Marshal(selection_map)
 
+	// When editing a bookmark, saving right away keeps the tags that it has
+	save_now_subtitle := "Save now, without adding tags"
+	save_now_tags := ""
+	if is_editing_bookmark(selection_map) {
+		save_now_subtitle = "Save now, without changing description and tags"
+		save_now_tags = wf.Config.Get("bookmark_tags", "")
+	}
+
 	alfred_item := wf.NewItem("Save as: "+title).
 		Subtitle("Original title: "+original_title).
 		Arg().
@@ -131,9 +144,9 @@ func set_title(title string) {
 		Var("bookmark_info", string(selection_json)).
 		Arg()
 	alfred_item.Cmd().
-		Subtitle("Save now, without adding tags").
+		Subtitle(save_now_subtitle).
 		Var("bookmark_info", string(selection_json)).
-		Arg().
+		Arg(save_now_tags).
 		Var("goto", "save now")
 }
 
@@ -141,9 +154,9 @@ func set_tags(tags string) {
 	// Load bookmark_info from file if we cant reach it from the workflow variable
 	bookmark_info := wf.Config.Get("bookmark_info", "")
 	if bookmark_info == "" {
-		bookmark_info_bytes, _ := os.ReadFile(wf.CacheDir() + "/bookmark_info.tmp")
+		bookmark_info_bytes, _, _ := cache_storage.Read("bookmark_info")
 		bookmark_info = string(bookmark_info_bytes)
-		os.Remove(wf.CacheDir() + "/bookmark_info.tmp")
+		cache_storage.Delete("bookmark_info")
 	}
 
 	tag_array := strings.Split(tags, ",")
@@ -160,10 +173,11 @@ func set_tags(tags string) {
 		// Get tag list from cache
 		raindrop_tags := get_tags(token, "trust")
 
-		for _, item_interface := range raindrop_tags {
-			item := item_interface.(map[string]interface{})
-			if strings.Contains(item["_id"].(string), tag_array[len(tag_array)-1]) {
-				filtered_tags = append(filtered_tags, item["_id"].(string))
+		// Suggest the tags that contain what has been typed, in the same way as the local search matches text
+		typed_tag := normalize_text(tag_array[len(tag_array)-1])
+		for _, item := range raindrop_tags {
+			if strings.Contains(normalize_text(item.ID), typed_tag) {
+				filtered_tags = append(filtered_tags, item.ID)
 			}
 		}
 	} else {
@@ -222,7 +236,7 @@ func set_tags(tags string) {
 	}
 
 	wf.Var("bookmark_info", bookmark_info)
-	os.WriteFile(wf.CacheDir()+"/bookmark_info.tmp", []byte(wf.Config.Get("bookmark_info", "")), 0666)
+	cache_storage.Write("bookmark_info", []byte(wf.Config.Get("bookmark_info", "")))
 }
 
 func save_bookmark(tags string) {
@@ -235,36 +249,47 @@ func save_bookmark(tags string) {
 		tag_array[i] = strings.Trim(tag_array[i], " #")
 	}
 
+	// An existing bookmark that has been edited is updated instead
+	if is_editing_bookmark(selection_map) {
+		update_bookmark(selection_map, tag_array)
+		return
+	}
+
 	// Read token and related data from file.
 	// We assume that this exists, as it would not be possible to get here from within Alfred otherwise.
 	token := read_token()
 
 	// Prepare POST variables
 	collection_id, _ := strconv.Atoi(selection_map["collection"])
-	post_variables := map[string]interface{}{
-		"collection": struct {
-			Ref string `json:"$ref"`
-			Id  int    `json:"$id"`
-		}{"collections", collection_id},
-		"link":    selection_map["url"],
-		"title":   selection_map["title"],
-		"tags":    tag_array,
-		"excerpt": get_meta_description(selection_map["url"]),
+	post_variables := Raindrop{
+		Collection: RaindropRef{Ref: "collections", ID: collection_id},
+		Link:       selection_map["url"],
+		Title:      selection_map["title"],
+		Tags:       tag_array,
+		Excerpt:    get_meta_description(selection_map["url"]),
 	}
-	post_json, _ := json.Marshal(post_variables)
 
-	request, _ := http.NewRequest("POST", "https://api.raindrop.io/rest/v1/raindrop", bytes.NewBuffer(post_json))
-	request.Header.Set("User-Agent", "Alfred (Macintosh; Mac OS X)")
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Authorization", "Bearer "+token.AccessToken)
-
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		panic(err)
+	if err := add_raindrop(post_variables, token); err != nil {
+		log.Printf("Failed to add bookmark %s: %v", post_variables.Link, err)
+		fmt.Print("Could not add the bookmark: " + err.Error())
+		return
 	}
 
-	defer response.Body.Close()
-
 	fmt.Print(selection_map["title"])
 }
+
+// Function for adding a bookmark to Raindrop.io
+func add_raindrop(bookmark Raindrop, token RaindropToken) error {
+	response_body, err := api_send("POST", "/raindrop", token, bookmark)
+	if err != nil {
+		return err
+	}
+	var result RaindropResponse
+	if err := decode_response(response_body, &result); err != nil {
+		return err
+	}
+	if !result.Result {
+		return fmt.Errorf("unexpected response from Raindrop.io: %s", response_body)
+	}
+	return nil
+}
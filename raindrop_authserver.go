@@ -11,7 +11,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"os"
@@ -57,23 +56,20 @@ func request_token(code string) (bool, string, string) {
 	post_variables.Add("redirect_uri", "http://127.0.0.1:11038")
 	post_variables.Add("grant_type", "authorization_code")
 
-	resp, err := http.PostForm("https://raindrop.io/oauth/access_token", post_variables)
-	if err != nil {
+	body, err := oauth_post("/access_token", post_variables)
+	if body == nil && err != nil {
 		return false, "Failed to make request to Raindrop.io", err.Error()
 	}
 
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return false, "Failed to read response from Raindrop.io", err.Error()
-	}
-
 	token := RaindropToken{}
 	json.Unmarshal([]byte(body), &token)
 
 	if token.Error != "" {
 		return false, "Failed to authenticate", token.Error
 	}
+	if err != nil {
+		return false, "Failed to authenticate", err.Error()
+	}
 
 	location, _ := time.LoadLocation("UTC")
 	token.CreationTime = time.Now().In(location).Format("2006-01-02 15:04:05")
@@ -81,7 +77,7 @@ func request_token(code string) (bool, string, string) {
 	token_json, _ := json.Marshal(token)
 
 	// Save to Keychain
-	if err := wf.Keychain.Set("raindrop_token", string(token_json)); err != nil {
+	if err := token_store.Set("raindrop_token", string(token_json)); err != nil {
 		return false, "Failed to save token to Keychain", err.Error()
 	}
 
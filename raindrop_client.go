@@ -0,0 +1,249 @@
+/*
+	HTTP client that all requests to Raindrop.io go through, which handles timeouts, retries and rate limiting
+
+	By Andreas Westerlind, 2021-2025
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RaindropClient struct {
+	http_client *http.Client
+	// Number of times a failed request is retried before giving up
+	max_retries int
+	// Delay before the first retry, which is then doubled for every retry
+	base_delay time.Duration
+	// Longest time to wait before a retry, or for the rate limit to reset, before giving up
+	max_delay time.Duration
+	// Longest time to wait for the response to an interactive request
+	interactive_timeout time.Duration
+	// Sleep function, which can be replaced when testing
+	sleep func(time.Duration)
+
+	mutex      sync.Mutex
+	random     *rand.Rand
+	remaining  int
+	reset_time time.Time
+}
+
+var raindrop_client = new_raindrop_client()
+
+func new_raindrop_client() *RaindropClient {
+	return &RaindropClient{
+		http_client:         &http.Client{Timeout: 20 * time.Second},
+		max_retries:         4,
+		base_delay:          500 * time.Millisecond,
+		max_delay:           60 * time.Second,
+		interactive_timeout: 3 * time.Second,
+		sleep:               time.Sleep,
+		random:              rand.New(rand.NewSource(time.Now().UnixNano())),
+		remaining:           -1,
+	}
+}
+
+// How a request is sent to Raindrop.io
+type RequestOptions struct {
+	// The user is waiting for the response, such as in a search, where the local cache can be searched instead if Raindrop.io doesn't answer quickly.
+	// The request times out sooner, and fails right away instead of being retried or waiting for the rate limit to reset.
+	Interactive bool
+}
+
+// Sends a GET request to a path in the Raindrop.io REST API, and returns the response body
+func api_get(path string, params url.Values, token RaindropToken) ([]byte, error) {
+	request_url := api_url(path)
+	if len(params) > 0 {
+		request_url += "?" + params.Encode()
+	}
+	return raindrop_client.send("GET", request_url, &token, "", nil)
+}
+
+// Sends a GET request to a path in the Raindrop.io REST API for something that the user is waiting for, and returns the response body
+func api_get_interactive(path string, params url.Values, token RaindropToken) ([]byte, error) {
+	request_url := api_url(path)
+	if len(params) > 0 {
+		request_url += "?" + params.Encode()
+	}
+	return raindrop_client.send_with_options("GET", request_url, &token, "", nil, RequestOptions{Interactive: true})
+}
+
+// Sends a request with a JSON body to a path in the Raindrop.io REST API, and returns the response body
+func api_send(method string, path string, token RaindropToken, payload interface{}) ([]byte, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	return raindrop_client.send(method, api_url(path), &token, "application/json", body)
+}
+
+// Sends a form to the Raindrop.io OAuth API, and returns the response body
+func oauth_post(path string, form url.Values) ([]byte, error) {
+	return raindrop_client.send("POST", oauth_url(path), nil, "application/x-www-form-urlencoded", []byte(form.Encode()))
+}
+
+// Sends a request to Raindrop.io, and retries it with exponential backoff if it fails in a way where trying again might help.
+// If the token isn't accepted, it is refreshed and the request is sent again with the new token.
+// The response body is returned also when the request fails, as it can contain details about the error.
+func (client *RaindropClient) send(method string, request_url string, token *RaindropToken, content_type string, body []byte) ([]byte, error) {
+	return client.send_with_options(method, request_url, token, content_type, body, RequestOptions{})
+}
+
+// Sends a request to Raindrop.io like send, but in the way that the options say
+func (client *RaindropClient) send_with_options(method string, request_url string, token *RaindropToken, content_type string, body []byte, options RequestOptions) ([]byte, error) {
+	// Requests that change something are only retried when we know that Raindrop.io didn't handle them
+	idempotent := method == "GET" || method == "HEAD"
+	token_refreshed := false
+
+	if token != nil {
+		current_token := token_manager.current(*token)
+		token = &current_token
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := client.wait_for_rate_limit(options.Interactive); err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.Background(), func() {}
+		if options.Interactive {
+			ctx, cancel = context.WithTimeout(ctx, client.interactive_timeout)
+		}
+		request, err := http.NewRequestWithContext(ctx, method, request_url, bytes.NewReader(body))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		request.Header.Set("User-Agent", "Alfred (Macintosh; Mac OS X)")
+		if content_type != "" {
+			request.Header.Set("Content-Type", content_type)
+		}
+		if token != nil {
+			request.Header.Set("Authorization", "Bearer "+token.AccessToken)
+		}
+
+		var response_body []byte
+		var retry_after time.Duration
+		response, err := client.http_client.Do(request)
+		if err == nil {
+			response_body, err = io.ReadAll(response.Body)
+			response.Body.Close()
+			retry_after = client.update_rate_limit(response)
+		}
+		cancel()
+		if err != nil {
+			err = fmt.Errorf("%w: %v", err_network, err)
+			if !idempotent || options.Interactive || attempt >= client.max_retries {
+				return nil, err
+			}
+			log.Printf("Request to %s failed, retrying: %v", request.URL.Path, err)
+			client.sleep(client.backoff(attempt))
+			continue
+		}
+
+		err = check_response_status(response, response_body)
+		if errors.Is(err, err_unauthorized) && token != nil && !token_refreshed {
+			new_token, refresh_err := token_manager.refresh(*token)
+			if errors.Is(refresh_err, err_network) {
+				// The token might still be fine once Raindrop.io can be reached, so the user shouldn't have to authenticate again
+				return nil, refresh_err
+			}
+			if refresh_err != nil {
+				log.Printf("Failed to refresh token: %v", refresh_err)
+				return response_body, err
+			}
+			token = &new_token
+			token_refreshed = true
+			attempt--
+			continue
+		}
+		retryable := response.StatusCode == http.StatusTooManyRequests || (idempotent && response.StatusCode >= 500)
+		if err == nil || !retryable || options.Interactive || attempt >= client.max_retries {
+			return response_body, err
+		}
+
+		delay := client.backoff(attempt)
+		if retry_after > 0 {
+			delay = retry_after
+		}
+		if delay > client.max_delay {
+			return response_body, err
+		}
+		log.Printf("Request to %s failed with %s, retrying in %v", request.URL.Path, response.Status, delay)
+		client.sleep(delay)
+	}
+}
+
+// Returns the time to wait before retry number attempt+1, with random jitter so that parallel requests don't retry all at once
+func (client *RaindropClient) backoff(attempt int) time.Duration {
+	delay := client.base_delay << uint(attempt)
+	if delay > client.max_delay {
+		delay = client.max_delay
+	}
+	client.mutex.Lock()
+	jitter := time.Duration(client.random.Int63n(int64(delay)/2 + 1))
+	client.mutex.Unlock()
+	return delay/2 + jitter
+}
+
+// Reads the rate limit headers of a response, and returns how long Raindrop.io has asked us to wait, if it has
+func (client *RaindropClient) update_rate_limit(response *http.Response) time.Duration {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if remaining, err := strconv.Atoi(response.Header.Get("X-RateLimit-Remaining")); err == nil {
+		client.remaining = remaining
+	}
+	if reset, err := strconv.ParseInt(response.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		client.reset_time = time.Unix(reset, 0)
+	}
+
+	if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if retry_time, err := http.ParseTime(response.Header.Get("Retry-After")); err == nil {
+		return time.Until(retry_time)
+	}
+	if response.StatusCode == http.StatusTooManyRequests && client.remaining == 0 {
+		return time.Until(client.reset_time)
+	}
+	return 0
+}
+
+// Waits until the rate limit resets if there are no requests left, or fails if that would take too long, or if the request is interactive
+func (client *RaindropClient) wait_for_rate_limit(interactive bool) error {
+	client.mutex.Lock()
+	wait := time.Duration(0)
+	if client.remaining == 0 {
+		wait = time.Until(client.reset_time)
+	}
+	client.mutex.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	if wait > client.max_delay || interactive {
+		return err_rate_limited
+	}
+	client.sleep(wait)
+	client.mutex.Lock()
+	client.remaining = -1
+	client.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Returns a client that records how long it would have slept instead of sleeping
+func new_test_client(sleeps *[]time.Duration) *RaindropClient {
+	client := new_raindrop_client()
+	client.sleep = func(duration time.Duration) {
+		*sleeps = append(*sleeps, duration)
+	}
+	return client
+}
+
+// Starts a server that responds with the given status codes in turn, and then with 200
+func status_server(t *testing.T, headers http.Header, statuses ...int) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		for key, values := range headers {
+			w.Header()[key] = values
+		}
+		if requests <= len(statuses) {
+			w.WriteHeader(statuses[requests-1])
+			return
+		}
+		fmt.Fprint(w, `{"result":true}`)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestClientRetriesServerErrors(t *testing.T) {
+	var sleeps []time.Duration
+	client := new_test_client(&sleeps)
+	server, requests := status_server(t, nil, 500, 502, 503)
+
+	body, err := client.send("GET", server.URL, &RaindropToken{}, "", nil)
+	if err != nil || string(body) != `{"result":true}` {
+		t.Fatalf("Unexpected result: %q, %v", body, err)
+	}
+	if *requests != 4 || len(sleeps) != 3 {
+		t.Errorf("Expected 4 requests and 3 sleeps, got %d and %d", *requests, len(sleeps))
+	}
+	// Every delay must be within the backoff window for its attempt
+	for attempt, sleep := range sleeps {
+		window := client.base_delay << uint(attempt)
+		if sleep < window/2 || sleep > window {
+			t.Errorf("Delay %v for attempt %d is outside of %v-%v", sleep, attempt, window/2, window)
+		}
+	}
+}
+
+func TestClientDoesNotRetryPostOnServerError(t *testing.T) {
+	var sleeps []time.Duration
+	client := new_test_client(&sleeps)
+	server, requests := status_server(t, nil, 500)
+
+	if _, err := client.send("POST", server.URL, &RaindropToken{}, "application/json", []byte("{}")); err == nil {
+		t.Error("Expected an error")
+	}
+	if *requests != 1 {
+		t.Errorf("Expected 1 request, got %d", *requests)
+	}
+}
+
+func TestClientRespectsRetryAfter(t *testing.T) {
+	var sleeps []time.Duration
+	client := new_test_client(&sleeps)
+	server, requests := status_server(t, http.Header{"Retry-After": []string{"7"}}, 429)
+
+	if _, err := client.send("POST", server.URL, &RaindropToken{}, "application/json", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if *requests != 2 || len(sleeps) != 1 || sleeps[0] != 7*time.Second {
+		t.Errorf("Expected a single retry after 7s, got %d requests and sleeps %v", *requests, sleeps)
+	}
+}
+
+func TestClientGivesUpWhenRateLimited(t *testing.T) {
+	var sleeps []time.Duration
+	client := new_test_client(&sleeps)
+	server, requests := status_server(t, nil, 429, 429, 429, 429, 429, 429)
+
+	if _, err := client.send("GET", server.URL, &RaindropToken{}, "", nil); !errors.Is(err, err_rate_limited) {
+		t.Errorf("Expected err_rate_limited, got %v", err)
+	}
+	if *requests != client.max_retries+1 {
+		t.Errorf("Expected %d requests, got %d", client.max_retries+1, *requests)
+	}
+}
+
+func TestClientWaitsForRateLimitReset(t *testing.T) {
+	var sleeps []time.Duration
+	client := new_test_client(&sleeps)
+	reset := time.Now().Add(30 * time.Second)
+	server, _ := status_server(t, http.Header{
+		"X-Ratelimit-Remaining": []string{"0"},
+		"X-Ratelimit-Reset":     []string{fmt.Sprint(reset.Unix())},
+	})
+
+	// The first request uses up the rate limit, so the second one has to wait for it to reset
+	for i := 0; i < 2; i++ {
+		if _, err := client.send("GET", server.URL, &RaindropToken{}, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sleeps) != 1 || sleeps[0] < 25*time.Second || sleeps[0] > 30*time.Second {
+		t.Errorf("Expected to wait about 30s for the rate limit to reset, got %v", sleeps)
+	}
+}
+
+func TestClientInteractiveFailsRightAway(t *testing.T) {
+	var sleeps []time.Duration
+	client := new_test_client(&sleeps)
+	interactive := RequestOptions{Interactive: true}
+
+	server, requests := status_server(t, nil, 503, 503)
+	if _, err := client.send_with_options("GET", server.URL, &RaindropToken{}, "", nil, interactive); !errors.Is(err, err_network) || *requests != 1 {
+		t.Errorf("Expected err_network after a single request, got %v after %d", err, *requests)
+	}
+	server, requests = status_server(t, http.Header{"Retry-After": []string{"7"}}, 429)
+	if _, err := client.send_with_options("GET", server.URL, &RaindropToken{}, "", nil, interactive); !errors.Is(err, err_rate_limited) || *requests != 1 {
+		t.Errorf("Expected err_rate_limited after a single request, got %v after %d", err, *requests)
+	}
+
+	// No request is sent while the rate limit is used up
+	client.remaining = 0
+	client.reset_time = time.Now().Add(30 * time.Second)
+	server, requests = status_server(t, nil)
+	if _, err := client.send_with_options("GET", server.URL, &RaindropToken{}, "", nil, interactive); !errors.Is(err, err_rate_limited) || *requests != 0 {
+		t.Errorf("Expected err_rate_limited without a request, got %v after %d", err, *requests)
+	}
+	if len(sleeps) != 0 {
+		t.Errorf("Expected no waiting, got %v", sleeps)
+	}
+}
+
+func TestClientInteractiveTimeout(t *testing.T) {
+	var sleeps []time.Duration
+	client := new_test_client(&sleeps)
+	client.interactive_timeout = 50 * time.Millisecond
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+			fmt.Fprint(w, `{"result":true}`)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	start := time.Now()
+	if _, err := client.send_with_options("GET", server.URL, &RaindropToken{}, "", nil, RequestOptions{Interactive: true}); !errors.Is(err, err_network) {
+		t.Errorf("Expected err_network, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond || atomic.LoadInt32(&requests) != 1 || len(sleeps) != 0 {
+		t.Errorf("Expected a single request that timed out right away, got %d requests in %v", atomic.LoadInt32(&requests), elapsed)
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
@@ -23,6 +25,23 @@ import (
 	"golang.org/x/net/html"
 )
 
+// Errors that can be returned when talking to Raindrop.io, so that the caller can tell them apart
+var (
+	err_no_results   = errors.New("no bookmarks matched the search")
+	err_unauthorized = errors.New("not authorized by Raindrop.io")
+	err_rate_limited = errors.New("too many requests to Raindrop.io")
+	err_network      = errors.New("could not reach Raindrop.io")
+)
+
+// Storage for the authentication token, which is the macOS Keychain when running in Alfred
+type TokenStore interface {
+	Get(account string) (string, error)
+	Set(account string, password string) error
+	Delete(account string) error
+}
+
+var token_store TokenStore
+
 type RaindropToken struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
@@ -39,14 +58,21 @@ func init_auth() {
 	cmd.Start()
 	// Output info and authentication link to Alfred
 	wf.NewItem("You are not authenticated with Raindrop.io").
-		Arg("https://raindrop.io/oauth/authorize?redirect_uri=" + url.QueryEscape("http://127.0.0.1:11038") + "&client_id=5e46fab9b2fbaee7314687d8").
+		Arg(oauth_url("/authorize") + "?redirect_uri=" + url.QueryEscape("http://127.0.0.1:11038") + "&client_id=5e46fab9b2fbaee7314687d8").
 		Subtitle("Press enter to authenticate now").
 		Valid(true)
 }
 
+// Function for letting the user authenticate again, when Raindrop.io doesn't accept the token and it couldn't be refreshed.
+// The old token is removed, so that the Workflow knows that an authentication is needed next time it's initiated.
+func reauthenticate() {
+	token_store.Delete("raindrop_token")
+	init_auth()
+}
+
 func read_token() RaindropToken {
 	token := RaindropToken{}
-	keychain_token, err := wf.Keychain.Get("raindrop_token")
+	keychain_token, err := token_store.Get("raindrop_token")
 	if err == nil {
 		json.Unmarshal([]byte(keychain_token), &token)
 	} else {
@@ -55,8 +81,9 @@ func read_token() RaindropToken {
 	return token
 }
 
-// Function for refreshing the authentication token
-func refresh_token(token RaindropToken) RaindropToken {
+// Function for refreshing the authentication token.
+// Use token_manager.refresh rather than calling this directly, so that the rest of the current run gets the new token too.
+func refresh_token(token RaindropToken) (RaindropToken, error) {
 	// Prepare POST variables
 	post_variables := url.Values{}
 	post_variables.Add("client_id", client_id)
@@ -64,24 +91,20 @@ func refresh_token(token RaindropToken) RaindropToken {
 	post_variables.Add("refresh_token", token.RefreshToken)
 	post_variables.Add("grant_type", "refresh_token")
 
-	resp, err := http.PostForm("https://raindrop.io/oauth/access_token", post_variables)
-	if err != nil {
-		token.Error = "Error making request"
-		return token
-	}
-
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		token.Error = "Error reading response"
-		return token
+	body, err := oauth_post("/access_token", post_variables)
+	if body == nil && err != nil {
+		return token, err
 	}
 
 	var new_token RaindropToken
 	json.Unmarshal([]byte(body), &new_token)
 
+	// Raindrop.io didn't accept the refresh token, so the user has to authenticate again
 	if new_token.Error != "" {
-		return new_token
+		return token, fmt.Errorf("%w: %s", err_unauthorized, new_token.Error)
+	}
+	if err != nil {
+		return token, err
 	}
 
 	location, _ := time.LoadLocation("UTC")
@@ -90,15 +113,39 @@ func refresh_token(token RaindropToken) RaindropToken {
 	token_json, _ := json.Marshal(new_token)
 
 	// Save to Keychain
-	if err := wf.Keychain.Set("raindrop_token", string(token_json)); err != nil {
-		new_token.Error = "Failed to save token to Keychain"
-		return new_token
+	if err := token_store.Set("raindrop_token", string(token_json)); err != nil {
+		return new_token, fmt.Errorf("failed to save token to Keychain: %w", err)
 	}
 
-	return new_token
+	return new_token, nil
 }
 
-func search_request(query string, token RaindropToken, collection int, tag string) ([]interface{}, error) {
+// Returns the base URL of the Raindrop.io server.
+// It can be changed with the api_base_url workflow variable, to be able to run the workflow against something else than the production servers.
+func api_base() string {
+	return strings.TrimSuffix(wf.Config.Get("api_base_url", "https://api.raindrop.io"), "/")
+}
+
+// Returns the full URL for a path in the Raindrop.io REST API
+func api_url(path string) string {
+	return api_base() + "/rest/v1" + path
+}
+
+// Returns the full URL for a path in the Raindrop.io OAuth API
+func oauth_url(path string) string {
+	// The production OAuth endpoints live on raindrop.io rather than on the API host
+	if wf.Config.Get("api_base_url", "") == "" {
+		return "https://raindrop.io/oauth" + path
+	}
+	return api_base() + "/oauth" + path
+}
+
+// Number of bookmarks to get per request, which is the maximum that the Raindrop.io API allows
+const search_page_size = 50
+
+// Searches Raindrop.io and returns one page of results, together with the total number of bookmarks that matched.
+// The user is waiting for the results, so the search fails right away if Raindrop.io can't be reached, rather than being retried.
+func search_request(query string, token RaindropToken, collection int, tag string, page int) ([]Raindrop, int, error) {
 	// Prepare for searching by tag, if a tag is provided
 	if tag != "" {
 		tag = "#" + tag + " "
@@ -111,69 +158,60 @@ func search_request(query string, token RaindropToken, collection int, tag strin
 	}
 
 	// Query Raindrop.io
-	var result map[string]interface{}
-	var err error
-	client := &http.Client{}
+	var result RaindropsResponse
 	params := url.Values{
-		"search": []string{tag + query},
-		"sort":   []string{sorting},
-	}
-	u := &url.URL{
-		Scheme:   "https",
-		Host:     "api.raindrop.io",
-		Path:     "/rest/v1/raindrops/" + fmt.Sprint(collection),
-		RawQuery: params.Encode(),
+		"search":  []string{tag + query},
+		"sort":    []string{sorting},
+		"page":    []string{fmt.Sprint(page)},
+		"perpage": []string{fmt.Sprint(search_page_size)},
 	}
-	request, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
-		var nothing []interface{}
-		return nothing, err
+	if collection > 0 && is_subcollections_included() {
+		// Also search the subcollections of the collection
+		params.Set("nested", "true")
 	}
-	request.Header.Set("User-Agent", "Alfred (Macintosh; Mac OS X)")
-	request.Header.Set("Authorization", "Bearer "+token.AccessToken)
-	response, err := client.Do(request)
+	response_body, err := api_get_interactive("/raindrops/"+fmt.Sprint(collection), params, token)
 	if err != nil {
-		var nothing []interface{}
-		return nothing, err
-	}
-	response_body, err := io.ReadAll(response.Body)
-	if err != nil {
-		var nothing []interface{}
-		return nothing, err
+		return nil, 0, err
 	}
 
-	json.Unmarshal(response_body, &result)
+	if err := decode_response(response_body, &result); err != nil || !result.Result {
+		log.Printf("Unexpected response from Raindrop.io: %s", response_body)
+		return nil, 0, errors.New("unexpected response from Raindrop.io")
+	}
 
-	var result_items []interface{}
-	if result["items"] != nil && len(result["items"].([]interface{})) > 0 {
-		result_items = result["items"].([]interface{})
-	} else {
-		fmt.Println("\n/**** Unexpected response from server ****\n" + string(response_body) + "\n***********************************/\n")
-		var nothing []interface{}
-		err = errors.New("could not get results")
-		return nothing, err
+	if len(result.Items) == 0 && page == 0 {
+		return nil, 0, err_no_results
 	}
 
-	return result_items, err
+	return result.Items, result.Count, nil
+}
+
+// Turns the HTTP status of a response from Raindrop.io into one of the errors above, or nil if the request went well
+func check_response_status(response *http.Response, response_body []byte) error {
+	switch {
+	case response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden:
+		return err_unauthorized
+	case response.StatusCode == http.StatusTooManyRequests:
+		return err_rate_limited
+	case response.StatusCode == http.StatusBadGateway || response.StatusCode == http.StatusServiceUnavailable || response.StatusCode == http.StatusGatewayTimeout:
+		// Raindrop.io itself can't be reached, which is handled like when the internet connection is down
+		return fmt.Errorf("%w: %s", err_network, response.Status)
+	case response.StatusCode >= 400:
+		log.Printf("Unexpected response from Raindrop.io (%s): %s", response.Status, response_body)
+		return fmt.Errorf("unexpected response from Raindrop.io: %s", response.Status)
+	}
+	return nil
 }
 
 // Function for rendering Raindrop.io query results
-func render_results(raindrop_results []interface{}, include_favourites string, collection_names map[int]string, descr_in_list bool) {
-	for _, item_interface := range raindrop_results {
-		item := item_interface.(map[string]interface{})
-
-		var is_fav bool = false
-		if _, ok := item["important"]; ok {
-			if item["important"].(bool) {
-				is_fav = true
-			}
-		}
+func render_results(raindrop_results []Raindrop, include_favourites string, collection_names map[int]string, descr_in_list bool) {
+	for _, item := range raindrop_results {
+		is_fav := item.Important
 
 		if include_favourites == "all" || (include_favourites == "none" && !is_fav) || (include_favourites == "only" && is_fav) {
 			tag_list := ""
-			tag_array := item["tags"].([]interface{})
-			for _, current_tag := range tag_array {
-				tag_list += "#" + current_tag.(string) + " "
+			for _, current_tag := range item.Tags {
+				tag_list += "#" + current_tag + " "
 			}
 			if tag_list != "" {
 				tag_list += " •  "
@@ -183,24 +221,22 @@ func render_results(raindrop_results []interface{}, include_favourites string, c
 			if is_fav {
 				fav_symbol = "♥︎ "
 			}
+			if item.FullText {
+				fav_symbol += "Full-text match •  "
+			}
 
-			excerpt := item["excerpt"].(string)
+			excerpt := item.Excerpt
 			if excerpt == "" {
-				excerpt = item["link"].(string)
+				excerpt = item.Link
 			}
 
 			// Prepare to display collection name
-			var collection_name string
-			if item["collection"] != nil {
-				item_collection := item["collection"].(map[string]interface{})
-				collection_name = collection_names[int(item_collection["$id"].(float64))]
-			}
+			collection_name := collection_names[item.Collection.ID]
 			if collection_name != "" {
 				collection_name += " •  "
 			}
 
-			// collection_names missing so far
-			subtitle_general := fav_symbol + collection_name + tag_list + get_hostname(item["link"].(string))
+			subtitle_general := fav_symbol + collection_name + tag_list + get_hostname(item.Link)
 			subtitle_description := fav_symbol + excerpt
 			var subtitle_main string
 			var subtitle_alt string
@@ -212,102 +248,142 @@ func render_results(raindrop_results []interface{}, include_favourites string, c
 				subtitle_alt = subtitle_description
 			}
 
-			alfred_item := wf.NewItem(item["title"].(string)).
-				Arg(string(item["link"].(string))).
+			// The ID of the bookmark is passed on to the open command, which logs that it was opened
+			bookmark_id := fmt.Sprint(item.ID)
+			alfred_item := wf.NewItem(item.Title).
+				Arg(item.Link).
 				Var("goto", "open").
-				Copytext(item["link"].(string)).
+				Var("bookmark_id", bookmark_id).
+				Copytext(item.Link).
 				Subtitle(subtitle_main).
-				Match(item["title"].(string) + " " + tag_list + " " + item["title"].(string) + " " + item["link"].(string)).
+				Match(item.Title + " " + tag_list + " " + item.Title + " " + item.Link).
 				Valid(true)
 			alfred_item.Cmd().
-				Arg(item["link"].(string)).
+				Arg(item.Link).
 				Var("goto", "open").
-				Subtitle(item["link"].(string))
+				Var("bookmark_id", bookmark_id).
+				Subtitle(item.Link)
 			alfred_item.Ctrl().
-				Arg(string(item["link"].(string))).
+				Arg(item.Link).
 				Var("goto", "open").
+				Var("bookmark_id", bookmark_id).
 				Subtitle(subtitle_alt)
 			alfred_item.Alt().
-				//Arg("copy:::" + string(item["link"].(string))).
-				Arg(string(item["link"].(string))).
+				Arg(item.Link).
 				Var("goto", "copy").
 				Subtitle("Press enter to copy this link to clipboard")
 			alfred_item.Shift().
-				Arg("https://api.raindrop.io/v1/raindrop/" + fmt.Sprint(int(item["_id"].(float64))) + "/cache").
+				Arg(api_base() + "/v1/raindrop/" + fmt.Sprint(item.ID) + "/cache").
 				Subtitle("Press enter to open permantent copy")
+			add_edit_modifier(alfred_item, item)
+			add_move_modifier(alfred_item, item)
 		}
 	}
 }
 
+// Function for checking if searching in a collection should also search its subcollections, which is turned on with the include_subcollections setting
+func is_subcollections_included() bool {
+	return wf.Config.Get("include_subcollections", "0") == "1"
+}
+
+// Function for getting the collections that are searched when searching in a collection, which is nil when searching all bookmarks.
+// When subcollections are included, every collection below the collection is added, however deep down it is.
+func searched_collections(collection int, raindrop_collections_sublevel []Collection) map[int]bool {
+	if collection == 0 {
+		return nil
+	}
+	collections := map[int]bool{collection: true}
+	if collection < 0 || !is_subcollections_included() {
+		// Unsorted and the trash don't have any subcollections
+		return collections
+	}
+	for added := true; added; {
+		added = false
+		for _, item := range raindrop_collections_sublevel {
+			if !collections[item.ID] && collections[item.ParentID()] {
+				collections[item.ID] = true
+				added = true
+			}
+		}
+	}
+	return collections
+}
+
 // Function for getting Raindrop.io collections
-func get_collections(token RaindropToken, sublevel bool, caching string) []interface{} {
+func get_collections(token RaindropToken, sublevel bool, caching string) []Collection {
 	// If caching == "check": Redownload collection list only if cache is older than 1 minute, to make searching faster while still not having to wait for new collections to appear
 	// If caching == "trust": Trust the collection list cache to be good enough and use what is cached without checking its age (only download if no chache exists yet)
 	// If caching == "fetch": Always redownload collection list without checking the age of the cache
 
-	var collections []interface{}
-	var cache_base map[string]interface{}
+	var cache_base CollectionsResponse
 
-	var cache_filename string = wf.CacheDir() + "/collections.json"
+	var cache_key string = "collections"
 	if sublevel {
-		cache_filename = wf.CacheDir() + "/collections_sublevel.json"
+		cache_key = "collections_sublevel"
 	}
 
-	// Check if cache file exists
-	if cache_file_stat, err := os.Stat(cache_filename); err == nil {
-		// Ceck modification time of the cache file. Use cache if it is less than 1 minute old, and caching is set "check", or if caching is set to "trust"
-		if caching == "trust" || (time.Since(cache_file_stat.ModTime()).Seconds() < 60 && caching == "check") {
+	// Check if the cache exists
+	if cache_data, cache_time, err := cache_storage.Read(cache_key); err == nil {
+		// Ceck modification time of the cache. Use cache if it is less than 1 minute old, and caching is set "check", or if caching is set to "trust"
+		if caching == "trust" || (time.Since(cache_time).Seconds() < 60 && caching == "check") {
 			// Read stored cached collections
-			cache_file, _ := os.ReadFile(cache_filename)
-			json.Unmarshal(cache_file, &cache_base)
-			if cache_base["items"] != nil && cache_base["items"].([]interface{}) != nil {
-				collections = cache_base["items"].([]interface{})
-				return collections
+			decode_response(cache_data, &cache_base)
+			if cache_base.Items != nil {
+				return cache_base.Items
 			}
 		}
 	}
 
 	// Query Raindrop.io
-	request_url := "https://api.raindrop.io/rest/v1/collections"
-	if sublevel {
-		request_url = "https://api.raindrop.io/rest/v1/collections/childrens"
-	}
-	client := &http.Client{}
-	request, err := http.NewRequest("GET", request_url, nil)
+	collections, err := fetch_collections(token, sublevel)
 	if err != nil {
-		return collections
+		// Fall back to what we have in the cache, even if it's older than we would like
+		log.Printf("Failed to get collections: %v", err)
+		cache_data, _, _ := cache_storage.Read(cache_key)
+		decode_response(cache_data, &cache_base)
+		return cache_base.Items
 	}
-	request.Header.Set("User-Agent", "Alfred (Macintosh; Mac OS X)")
-	request.Header.Set("Authorization", "Bearer "+token.AccessToken)
-	response, err := client.Do(request)
-	if err != nil {
-		return collections
+	return collections
+}
+
+// Function for downloading the collection list from Raindrop.io and writing it to the cache
+func fetch_collections(token RaindropToken, sublevel bool) ([]Collection, error) {
+	var cache_key string = "collections"
+	request_path := "/collections"
+	if sublevel {
+		cache_key = "collections_sublevel"
+		request_path = "/collections/childrens"
 	}
-	response_body, err := io.ReadAll(response.Body)
+
+	response_body, err := api_get(request_path, nil, token)
 	if err != nil {
-		return collections
+		return nil, err
+	}
+	var result CollectionsResponse
+	if err := decode_response(response_body, &result); err != nil {
+		return nil, err
 	}
-	json.Unmarshal(response_body, &cache_base)
-
-	// Write to file
-	os.WriteFile(cache_filename, response_body, 0666)
 
-	// Return collections
-	if cache_base["items"] != nil && cache_base["items"].([]interface{}) != nil {
-		collections = cache_base["items"].([]interface{})
+	// Write to the cache
+	if err := cache_storage.Write(cache_key, response_body); err != nil {
+		return nil, err
 	}
-	return collections
+
+	return result.Items, nil
 }
 
 // Returns only the hostname minus www from a given URL
 func get_hostname(url_string string) string {
-	url_object, _ := url.Parse(url_string)
+	url_object, err := url.Parse(url_string)
+	if err != nil {
+		return ""
+	}
 	re := regexp.MustCompile(`^www\.`)
 	return re.ReplaceAllString(url_object.Host, "")
 }
 
-func collection_paths(raindrop_collections []interface{}, raindrop_collections_sublevel []interface{}, path_list map[int]string, parent_id int, current_object []string, current_level int) map[int]string {
-	var collection_array []interface{}
+func collection_paths(raindrop_collections []Collection, raindrop_collections_sublevel []Collection, path_list map[int]string, parent_id int, current_object []string, current_level int) map[int]string {
+	var collection_array []Collection
 	if parent_id == 0 {
 		collection_array = raindrop_collections
 	} else {
@@ -318,18 +394,13 @@ func collection_paths(raindrop_collections []interface{}, raindrop_collections_s
 		}
 	}
 
-	for _, item_interface := range collection_array {
-		item := item_interface.(map[string]interface{})
-		var item_parent map[string]interface{}
-		if item["parent"] != nil {
-			item_parent = item["parent"].(map[string]interface{})
-		}
-		if parent_id == 0 || (item_parent != nil && item_parent["$id"] != nil && int(item_parent["$id"].(float64)) == parent_id) {
+	for _, item := range collection_array {
+		if parent_id == 0 || item.ParentID() == parent_id {
 			current_level++
-			current_object = append(current_object, item["title"].(string))
-			path_list[int(item["_id"].(float64))] = strings.Join(current_object, "/")
+			current_object = append(current_object, item.Title)
+			path_list[item.ID] = strings.Join(current_object, "/")
 
-			path_list = collection_paths(raindrop_collections, raindrop_collections_sublevel, path_list, int(item["_id"].(float64)), current_object, current_level)
+			path_list = collection_paths(raindrop_collections, raindrop_collections_sublevel, path_list, item.ID, current_object, current_level)
 
 			// Remove last value from current_object
 			if len(current_object) > 0 {
@@ -342,8 +413,8 @@ func collection_paths(raindrop_collections []interface{}, raindrop_collections_s
 }
 
 // Function for rendering Raindrop.io collections in Alfred
-func render_collections(raindrop_collections []interface{}, raindrop_collections_sublevel []interface{}, render_style string, purpose string, parent_id int, current_object []string, current_level int, bookmark_title string, bookmark_url string, goto_prefix string) {
-	var collection_array []interface{}
+func render_collections(raindrop_collections []Collection, raindrop_collections_sublevel []Collection, render_style string, purpose string, parent_id int, current_object []string, current_level int, bookmark_title string, bookmark_url string, goto_prefix string) {
+	var collection_array []Collection
 	if parent_id == 0 {
 		collection_array = raindrop_collections
 	} else {
@@ -354,15 +425,10 @@ func render_collections(raindrop_collections []interface{}, raindrop_collections
 		}
 	}
 
-	for _, item_interface := range collection_array {
-		item := item_interface.(map[string]interface{})
-		var item_parent map[string]interface{}
-		if item["parent"] != nil {
-			item_parent = item["parent"].(map[string]interface{})
-		}
-		if parent_id == 0 || (item_parent != nil && item_parent["$id"] != nil && int(item_parent["$id"].(float64)) == parent_id) {
+	for _, item := range collection_array {
+		if parent_id == 0 || item.ParentID() == parent_id {
 			current_level++
-			current_object = append(current_object, item["title"].(string))
+			current_object = append(current_object, item.Title)
 			indentation := ""
 			sub_indentation := ""
 			if render_style == "tree" {
@@ -380,8 +446,8 @@ func render_collections(raindrop_collections []interface{}, raindrop_collections
 			}
 
 			var icon_file_name = "folder.png"
-			if len(item["cover"].([]interface{})) > 0 {
-				icon_url_array := strings.Split(item["cover"].([]interface{})[0].(string), "/")
+			if len(item.Cover) > 0 {
+				icon_url_array := strings.Split(item.Cover[0], "/")
 				if icon_url_array[len(icon_url_array)-1] != "" {
 					icon_file_name = wf.CacheDir() + "/icon_cache/" + icon_url_array[len(icon_url_array)-1]
 				}
@@ -400,31 +466,31 @@ func render_collections(raindrop_collections []interface{}, raindrop_collections
 					}
 					file, _ := os.Create(icon_file_name)
 					defer file.Close()
-					resp, err := http.Get(item["cover"].([]interface{})[0].(string))
+					resp, err := http.Get(item.Cover[0])
 					if err == nil {
 						io.Copy(file, resp.Body)
+						defer resp.Body.Close()
 					}
-					defer resp.Body.Close()
 				}
 			}
 
-			collection_title := item["title"].(string)
+			collection_title := item.Title
 			if render_style == "paths" {
 				collection_title = strings.Join(current_object, "/")
 			}
 
 			tree_arg_section := ""
 			if render_style == "tree" {
-				tree_arg_section = strings.ToLower(sub_collection_names(raindrop_collections_sublevel, int(item["_id"].(float64))))
+				tree_arg_section = strings.ToLower(sub_collection_names(raindrop_collections_sublevel, item.ID))
 			}
 
 			collection_info := make(map[string]string)
 			if purpose == "adding" {
-				collection_info["collection"] = fmt.Sprint(int(item["_id"].(float64)))
+				collection_info["collection"] = fmt.Sprint(item.ID)
 				collection_info["title"] = bookmark_title
 				collection_info["url"] = bookmark_url
 			} else if purpose == "searching" {
-				collection_info["id"] = fmt.Sprint(int(item["_id"].(float64)))
+				collection_info["id"] = fmt.Sprint(item.ID)
 				collection_info["name"] = strings.Join(current_object, "/")
 				collection_info["icon"] = icon_file_name
 			}
@@ -459,9 +525,33 @@ func render_collections(raindrop_collections []interface{}, raindrop_collections
 					Var("collection_info", string(collection_json)).
 					Var("goto", collection_goto).
 					Subtitle("")
+			} else if purpose == "restoring" {
+				alfred_item := wf.NewItem(indentation+collection_title).
+					Arg(strings.ToLower(strings.Join(current_object, " "))+" "+tree_arg_section).
+					Var("restore_collection", fmt.Sprint(item.ID)).
+					Var("goto", "restore").
+					Valid(true).
+					Icon(&aw.Icon{Value: icon_file_name, Type: ""})
+				alfred_item.Alt().
+					Arg(strings.ToLower(strings.Join(current_object, " "))+" "+tree_arg_section).
+					Var("restore_collection", fmt.Sprint(item.ID)).
+					Var("goto", "restore").
+					Subtitle("")
+			} else if purpose == "moving" {
+				alfred_item := wf.NewItem(indentation+collection_title).
+					Arg(strings.ToLower(strings.Join(current_object, " "))+" "+tree_arg_section).
+					Var("move_collection", fmt.Sprint(item.ID)).
+					Var("goto", "move").
+					Valid(true).
+					Icon(&aw.Icon{Value: icon_file_name, Type: ""})
+				alfred_item.Alt().
+					Arg(strings.ToLower(strings.Join(current_object, " "))+" "+tree_arg_section).
+					Var("move_collection", fmt.Sprint(item.ID)).
+					Var("goto", "move").
+					Subtitle("")
 			}
 
-			render_collections(raindrop_collections, raindrop_collections_sublevel, render_style, purpose, int(item["_id"].(float64)), current_object, current_level, bookmark_title, bookmark_url, goto_prefix)
+			render_collections(raindrop_collections, raindrop_collections_sublevel, render_style, purpose, item.ID, current_object, current_level, bookmark_title, bookmark_url, goto_prefix)
 
 			// Remove last value from current_object
 			if len(current_object) > 0 {
@@ -473,76 +563,69 @@ func render_collections(raindrop_collections []interface{}, raindrop_collections
 }
 
 // Function for getting the names of all sub collections in a string
-func sub_collection_names(raindrop_collections_sublevel []interface{}, parent_id int) string {
+func sub_collection_names(raindrop_collections_sublevel []Collection, parent_id int) string {
 	names := ""
-	for _, item_interface := range raindrop_collections_sublevel {
-		item := item_interface.(map[string]interface{})
-		var item_parent map[string]interface{}
-		if item["parent"] != nil {
-			item_parent = item["parent"].(map[string]interface{})
-		}
-		if item_parent != nil && item_parent["$id"] != nil && int(item_parent["$id"].(float64)) == parent_id {
-			names += item["title"].(string) + " " + sub_collection_names(raindrop_collections_sublevel, int(item["_id"].(float64)))
+	for _, item := range raindrop_collections_sublevel {
+		if item.ParentID() == parent_id {
+			names += item.Title + " " + sub_collection_names(raindrop_collections_sublevel, item.ID)
 		}
 	}
 	return names
 }
 
 // Function for getting Raindrop.io tags
-func get_tags(token RaindropToken, caching string) []interface{} {
+func get_tags(token RaindropToken, caching string) []Tag {
 	// If caching == "check": Redownload tag list only if cache is older than 1 minute, to make searching faster while still not having to wait for new tags to appear
 	// If caching == "trust": Trust the tag list cache to be good enough and use what is cached without checking its age (only download if no chache exists yet)
 	// If caching == "fetch": Always redownload tag list without checking the age of the cache
 
-	var tags []interface{}
-	var cache_base map[string]interface{}
+	var cache_base TagsResponse
 
-	// Check if cache file exists
-	if cache_file_stat, err := os.Stat(wf.CacheDir() + "/tags.json"); err == nil {
-		// Ceck modification time of the cache file. Use cache if it is less than 1 minute old, and caching is set "check", or if caching is set to "trust"
-		if caching == "trust" || (time.Since(cache_file_stat.ModTime()).Seconds() < 60 && caching == "check") {
+	// Check if the cache exists
+	if cache_data, cache_time, err := cache_storage.Read("tags"); err == nil {
+		// Ceck modification time of the cache. Use cache if it is less than 1 minute old, and caching is set "check", or if caching is set to "trust"
+		if caching == "trust" || (time.Since(cache_time).Seconds() < 60 && caching == "check") {
 			// Read stored cached collections
-			cache_file, _ := os.ReadFile(wf.CacheDir() + "/tags.json")
-			json.Unmarshal(cache_file, &cache_base)
-			if cache_base["items"] != nil && cache_base["items"].([]interface{}) != nil {
-				tags = cache_base["items"].([]interface{})
-				return tags
+			decode_response(cache_data, &cache_base)
+			if cache_base.Items != nil {
+				return cache_base.Items
 			}
 		}
 	}
 
 	// Query Raindrop.io
-	request_url := "https://api.raindrop.io/rest/v1/tags/0"
-
-	client := &http.Client{}
-	request, err := http.NewRequest("GET", request_url, nil)
+	tags, err := fetch_tags(token)
 	if err != nil {
-		return tags
+		// Fall back to what we have in the cache, even if it's older than we would like
+		log.Printf("Failed to get tags: %v", err)
+		cache_data, _, _ := cache_storage.Read("tags")
+		decode_response(cache_data, &cache_base)
+		return cache_base.Items
 	}
-	request.Header.Set("User-Agent", "Alfred (Macintosh; Mac OS X)")
-	request.Header.Set("Authorization", "Bearer "+token.AccessToken)
-	response, err := client.Do(request)
+	return tags
+}
+
+// Function for downloading the tag list from Raindrop.io and writing it to the cache
+func fetch_tags(token RaindropToken) ([]Tag, error) {
+	response_body, err := api_get("/tags/0", nil, token)
 	if err != nil {
-		return tags
+		return nil, err
 	}
-	response_body, err := io.ReadAll(response.Body)
-	if err != nil {
-		return tags
+	var result TagsResponse
+	if err := decode_response(response_body, &result); err != nil {
+		return nil, err
 	}
-	json.Unmarshal(response_body, &cache_base)
 
-	// Write to file
-	os.WriteFile(wf.CacheDir()+"/tags.json", response_body, 0666)
-
-	// Return tags
-	if cache_base["items"] != nil && cache_base["items"].([]interface{}) != nil {
-		tags = cache_base["items"].([]interface{})
+	// Write to the cache
+	if err := cache_storage.Write("tags", response_body); err != nil {
+		return nil, err
 	}
-	return tags
+
+	return result.Items, nil
 }
 
-func reverse_interface_array(array []interface{}) []interface{} {
-	new_array := make([]interface{}, len(array))
+func reverse_collection_array(array []Collection) []Collection {
+	new_array := make([]Collection, len(array))
 	for count_up, count_down := 0, len(array)-1; count_up < len(array); count_up, count_down = count_up+1, count_down-1 {
 		new_array[count_up] = array[count_down]
 	}
@@ -551,13 +634,25 @@ func reverse_interface_array(array []interface{}) []interface{} {
 
 // Check if Token has gone through more than half of its lifetime, and in that case, refresh it
 func check_token_lifetime(token RaindropToken) {
+	if token_age(token) > float64(token.Expires)*0.5 {
+		token_manager.refresh(token)
+	}
+}
+
+// Returns how many milliseconds ago the token was created
+func token_age(token RaindropToken) float64 {
 	time_location, _ := time.LoadLocation("UTC")
 	time_format := "2006-01-02 15:04:05"
-	token_time, _ := time.Parse(time_format, token.CreationTime)
-	time_difference := time.Now().In(time_location).Sub(token_time).Milliseconds()
-	if float64(time_difference) > float64(token.Expires)*0.5 {
-		refresh_token(token)
+	token_time, err := time.Parse(time_format, token.CreationTime)
+	if err != nil {
+		return math.Inf(1)
 	}
+	return float64(time.Now().In(time_location).Sub(token_time).Milliseconds())
+}
+
+// Check if Token has gone through all of its lifetime, which means that it has to be refreshed before it can be used
+func token_expired(token RaindropToken) bool {
+	return token_age(token) > float64(token.Expires)
 }
 
 // Function for getting HTML meta description from a given URL
@@ -637,7 +732,7 @@ func get_title(url_string string) string {
 // Function for logging out by removing the token from the Keychain
 func logout() {
 	// Remove the token from the Keychain
-	if err := wf.Keychain.Delete("raindrop_token"); err != nil {
+	if err := token_store.Delete("raindrop_token"); err != nil {
 		wf.NewItem("Failed to remove token from Keychain").
 			Subtitle(err.Error()).
 			Valid(false)
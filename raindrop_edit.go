@@ -0,0 +1,149 @@
+/*
+	Editing the title, description and tags of a bookmark from the search results, which goes through the same steps as adding a bookmark
+
+	By Andreas Westerlind, 2025
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	aw "github.com/deanishe/awgo"
+)
+
+// Function for adding the fn modifier to a bookmark in the search results, which starts editing the bookmark.
+// The bookmark is put in bookmark_info like a new bookmark is, with its ID telling the later steps that an existing bookmark is edited.
+func add_edit_modifier(alfred_item *aw.Item, bookmark Raindrop) {
+	bookmark_info := map[string]string{
+		"id":      fmt.Sprint(bookmark.ID),
+		"title":   bookmark.Title,
+		"excerpt": bookmark.Excerpt,
+	}
+	bookmark_json, _ := json.Marshal(bookmark_info)
+	tags := ""
+	for _, tag := range bookmark.Tags {
+		tags += tag + ", "
+	}
+
+	alfred_item.Fn().
+		Arg(bookmark.Title).
+		Var("goto", "edit").
+		Var("bookmark_info", string(bookmark_json)).
+		Var("bookmark_title", bookmark.Title).
+		Var("bookmark_excerpt", bookmark.Excerpt).
+		Var("bookmark_tags", tags).
+		Subtitle("Edit the title, description and tags of this bookmark")
+}
+
+// Function for checking if the bookmark in bookmark_info is an existing bookmark that is edited, rather than a new bookmark that is added
+func is_editing_bookmark(bookmark_info map[string]string) bool {
+	return bookmark_info["id"] != ""
+}
+
+// Function for the step of editing a bookmark where the description is set, after the title has been set and before the tags are
+func set_excerpt(excerpt string) {
+	original_excerpt := wf.Config.Get("bookmark_excerpt", "")
+	var selection_map map[string]string
+	json.Unmarshal([]byte(wf.Config.Get("bookmark_info", "")), &selection_map)
+	if selection_map == nil {
+		selection_map = make(map[string]string)
+	}
+	selection_map["excerpt"] = excerpt
+	selection_json, _ := json.Marshal(selection_map)
+
+	item_title := "Save with description: " + excerpt
+	if excerpt == "" {
+		item_title = "Save without description"
+	}
+	subtitle := "Original description: " + original_excerpt
+	if original_excerpt == "" {
+		subtitle = "The bookmark has no description"
+	}
+
+	alfred_item := wf.NewItem(item_title).
+		Subtitle(subtitle).
+		Arg().
+		Var("bookmark_info", string(selection_json)).
+		Valid(true)
+	alfred_item.Alt().
+		Subtitle(subtitle).
+		Var("bookmark_info", string(selection_json)).
+		Arg()
+	alfred_item.Cmd().
+		Subtitle("Save now, without changing tags").
+		Var("bookmark_info", string(selection_json)).
+		Arg(wf.Config.Get("bookmark_tags", "")).
+		Var("goto", "save now")
+}
+
+// Function for saving the changes to a bookmark that has been edited, which are also made to the local cache right away,
+// so that the local search shows them without waiting for the next refresh.
+// The title of the bookmark is passed on to the notification, together with the bookmark_action variable that tells that the bookmark was edited.
+func update_bookmark(bookmark_info map[string]string, tags []string) {
+	token := read_token()
+
+	non_empty_tags := []string{}
+	for _, tag := range tags {
+		if tag != "" {
+			non_empty_tags = append(non_empty_tags, tag)
+		}
+	}
+	response_body, err := api_send("PUT", "/raindrop/"+bookmark_info["id"], token, map[string]interface{}{
+		"title":   bookmark_info["title"],
+		"excerpt": bookmark_info["excerpt"],
+		"tags":    non_empty_tags,
+	})
+	var result RaindropResponse
+	if err == nil {
+		err = decode_response(response_body, &result)
+	}
+
+	output := aw.NewArgVars().Var("bookmark_action", "edit")
+	if err != nil || !result.Result {
+		log.Printf("Failed to update bookmark %s: %v %s", bookmark_info["id"], err, response_body)
+		output.Arg("Could not save the changes to the bookmark")
+		output.Send()
+		return
+	}
+
+	if err := update_cached_bookmark(result.Item); err != nil {
+		log.Printf("Failed to update the bookmark in the local cache: %v", err)
+	}
+	output.Arg(result.Item.Title)
+	output.Send()
+}
+
+// Function for replacing a bookmark in the local cache with a new version of it, or adding it first if the cache doesn't have it, when there is a local cache.
+// The cached bookmark keeps when it was last updated, as the newest update in the cache is where the next sync continues from,
+// and changes made at Raindrop.io since the last sync would be skipped if it moved forward to this change.
+// An added bookmark gets no update time for the same reason, and is replaced by the next sync.
+// The cache is locked for writing before it is read, so that bookmarks that a refresh writes in the meantime aren't replaced with the ones read before it.
+func update_cached_bookmark(bookmark Raindrop) error {
+	unlock, err := lock_cache(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cache_data, _, err := cache_storage.Read("bookmarks")
+	if err != nil {
+		// There is no local cache yet
+		return nil
+	}
+	var cache_base RaindropsResponse
+	if err := decode_response(cache_data, &cache_base); err != nil {
+		return err
+	}
+	for i := range cache_base.Items {
+		if cache_base.Items[i].ID == bookmark.ID {
+			bookmark.LastUpdate = cache_base.Items[i].LastUpdate
+			cache_base.Items[i] = bookmark
+			return write_bookmarks_cache(cache_base.Items)
+		}
+	}
+	bookmark.LastUpdate = ""
+	return write_bookmarks_cache(append([]Raindrop{bookmark}, cache_base.Items...))
+}
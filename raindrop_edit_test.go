@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Returns what a function prints, which is what Alfred gets from the commands that aren't script filters
+func capture_output(t *testing.T, function func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	function()
+	writer.Close()
+	output, _ := io.ReadAll(reader)
+	return string(output)
+}
+
+func TestEditSteps(t *testing.T) {
+	setup_test_workflow(t)
+	t.Setenv("bookmark_info", `{"excerpt":"Learn how to use generics in Go","id":"1","title":"Golang generics tutorial"}`)
+	t.Setenv("bookmark_title", "Golang generics tutorial")
+	t.Setenv("bookmark_excerpt", "Learn how to use generics in Go")
+	t.Setenv("bookmark_tags", "golang, tutorial, ")
+
+	// Saving right away keeps the tags of the bookmark
+	set_title("Go generics")
+	if output := feedback_json(); !strings.Contains(output, `\"title\":\"Go generics\"`) || !strings.Contains(output, `"arg":"golang, tutorial, ","subtitle":"Save now, without changing description and tags"`) {
+		t.Errorf("Unexpected title step: %s", output)
+	}
+
+	wf.Feedback.Clear()
+	set_excerpt("")
+	if output := feedback_json(); !strings.Contains(output, `"title":"Save without description","subtitle":"Original description: Learn how to use generics in Go"`) || !strings.Contains(output, `"excerpt\":\"\"`) {
+		t.Errorf("Unexpected description step: %s", output)
+	}
+}
+
+func TestUpdateBookmark(t *testing.T) {
+	fake := setup_test_workflow(t)
+	// Fill the local cache
+	local_search_command("standard", "", "", "", "", false, true)
+
+	t.Setenv("bookmark_info", `{"excerpt":"Type parameters explained","id":"1","title":"Go generics in depth"}`)
+	output := capture_output(t, func() { save_bookmark("golang, #generics, ") })
+	if !strings.Contains(output, `"arg":"Go generics in depth"`) || !strings.Contains(output, `"bookmark_action":"edit"`) {
+		t.Errorf("Unexpected output: %s", output)
+	}
+	if len(fake.saved) != 0 {
+		t.Errorf("Expected the bookmark to be updated, not added again")
+	}
+	for _, bookmark := range fake.bookmarks_in(1002) {
+		if bookmark.ID == 1 && (bookmark.Title != "Go generics in depth" || bookmark.Excerpt != "Type parameters explained" || strings.Join(bookmark.Tags, ",") != "golang,generics") {
+			t.Errorf("Unexpected bookmark at Raindrop.io: %+v", bookmark)
+		}
+	}
+
+	// The local search shows the change right away, without a refresh
+	fake.make_unreachable("/rest/v1/raindrops/")
+	wf.Feedback.Clear()
+	local_search("depth", read_token(), 0, "", false, true)
+	if output := feedback_json(); !strings.Contains(output, `"title":"Go generics in depth"`) || !strings.Contains(output, "#golang #generics") {
+		t.Errorf("Expected the edited bookmark in the local search, got %s", output)
+	}
+}
+
+func TestUpdateBookmarkFailed(t *testing.T) {
+	setup_test_workflow(t)
+	t.Setenv("bookmark_info", `{"excerpt":"","id":"12345","title":"Missing"}`)
+	output := capture_output(t, func() { save_bookmark("") })
+	if !strings.Contains(output, "Could not save the changes to the bookmark") {
+		t.Errorf("Unexpected output: %s", output)
+	}
+}
+
+func TestUpdateBookmarkKeepsSyncPosition(t *testing.T) {
+	fake := setup_test_workflow(t)
+	if _, err := run_refresh(read_token(), "fetch"); err != nil {
+		t.Fatal(err)
+	}
+	synced, _ := last_sync_time()
+
+	// A change at Raindrop.io after the sync, but before the edit
+	fake.update_raindrop(2, time.Now().Add(-time.Minute).UTC().Format(time.RFC3339), func(raindrop *Raindrop) {
+		raindrop.Title = "The Rust Book"
+	})
+	t.Setenv("bookmark_info", `{"excerpt":"","id":"1","title":"Go generics in depth"}`)
+	capture_output(t, func() { save_bookmark("golang, ") })
+
+	if sync_time, _ := last_sync_time(); !sync_time.Equal(synced) {
+		t.Errorf("Expected the edit not to count as a sync, got %v instead of %v", sync_time, synced)
+	}
+	if _, err := run_refresh(read_token(), "sync"); err != nil {
+		t.Fatal(err)
+	}
+	bookmarks, _ := get_all_bookmarks(read_token(), "trust")
+	titles := ""
+	for _, bookmark := range bookmarks {
+		titles += bookmark.Title + ","
+	}
+	if !strings.Contains(titles, "The Rust Book,") || !strings.Contains(titles, "Go generics in depth,") {
+		t.Errorf("Expected the change made before the edit to be synced, got %s", titles)
+	}
+}
+
+func TestUpdateCachedBookmarkWaitsForRefresh(t *testing.T) {
+	setup_test_workflow(t)
+	write_bookmarks_cache([]Raindrop{{ID: 1, Title: "Go generics"}})
+
+	// A refresh in another process is writing the cache
+	refresh, err := os.OpenFile(wf.CacheDir()+"/cache.lock", os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refresh.Close()
+	syscall.Flock(int(refresh.Fd()), syscall.LOCK_EX)
+	updated := make(chan error)
+	go func() {
+		updated <- update_cached_bookmark(Raindrop{ID: 1, Title: "Go generics in depth"})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	result, _ := json.Marshal(RaindropsResponse{Result: true, Items: []Raindrop{{ID: 1, Title: "Go generics"}, {ID: 2, Title: "The Rust Book"}}})
+	cache_storage.Write("bookmarks", result)
+	syscall.Flock(int(refresh.Fd()), syscall.LOCK_UN)
+
+	// The bookmark is updated in what the refresh wrote, rather than in what was cached before it
+	if err := <-updated; err != nil {
+		t.Fatal(err)
+	}
+	cache_data, _, _ := cache_storage.Read("bookmarks")
+	var cache_base RaindropsResponse
+	decode_response(cache_data, &cache_base)
+	if len(cache_base.Items) != 2 || cache_base.Items[0].Title != "Go generics in depth" || cache_base.Items[1].Title != "The Rust Book" {
+		t.Errorf("Unexpected bookmarks: %+v", cache_base.Items)
+	}
+	index, _ := load_search_index()
+	if candidates, _ := index.bookmarks(index.candidates("rust", 0)); bookmark_ids(candidates) != "2" {
+		t.Errorf("Expected the index to be rebuilt with the bookmarks, got %s", bookmark_ids(candidates))
+	}
+}
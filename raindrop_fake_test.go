@@ -0,0 +1,526 @@
+/*
+	A fake Raindrop.io server for testing the workflow without talking to the real API
+
+	By Andreas Westerlind, 2021-2025
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	aw "github.com/deanishe/awgo"
+)
+
+// In-memory replacement for the Keychain
+type memory_token_store struct {
+	mutex  sync.Mutex
+	values map[string]string
+}
+
+func (store *memory_token_store) Get(account string) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if value, ok := store.values[account]; ok {
+		return value, nil
+	}
+	return "", errors.New("not found")
+}
+
+func (store *memory_token_store) Set(account string, password string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.values[account] = password
+	return nil
+}
+
+func (store *memory_token_store) Delete(account string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.values, account)
+	return nil
+}
+
+// Fake Raindrop.io server, serving the fixtures in testdata/api
+type fake_raindrop struct {
+	server *httptest.Server
+
+	mutex         sync.Mutex
+	access_token  string
+	refresh_token string
+	raindrops     []json.RawMessage
+	raindrop_data []Raindrop
+	saved         []Raindrop
+	requests      []string
+	// Requests to paths that start with any of these are dropped, as if the server couldn't be reached
+	unreachable []string
+	// The text of the page of each bookmark, which the full-text search finds bookmarks by
+	page_text map[int]string
+	// The parent of each subcollection, for searching a collection together with its subcollections
+	collection_parents map[int]int
+	// Called with the page number before a page of bookmarks is served, such as for adding bookmarks while they are being fetched
+	before_page func(page int)
+}
+
+func new_fake_raindrop(t *testing.T) *fake_raindrop {
+	fake := &fake_raindrop{
+		access_token:  "access-token",
+		refresh_token: "refresh-token",
+		page_text:     make(map[int]string),
+	}
+
+	// Keep the raw JSON of each raindrop, so that null values and such are served just as they are in the fixture
+	var fixture struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(read_fixture(t, "raindrops.json"), &fixture); err != nil {
+		t.Fatal(err)
+	}
+	fake.raindrops = fixture.Items
+	for _, raw := range fixture.Items {
+		var raindrop Raindrop
+		decode_response(raw, &raindrop)
+		fake.raindrop_data = append(fake.raindrop_data, raindrop)
+	}
+	var subcollections CollectionsResponse
+	decode_response(read_fixture(t, "collections_childrens.json"), &subcollections)
+	fake.collection_parents = make(map[int]int)
+	for _, collection := range subcollections.Items {
+		fake.collection_parents[collection.ID] = collection.ParentID()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/v1/raindrops/", fake.authenticated(fake.handle_raindrops))
+	mux.HandleFunc("/rest/v1/raindrop", fake.authenticated(fake.handle_save))
+	mux.HandleFunc("/rest/v1/collections", fake.authenticated(fake.serve_fixture("collections.json")))
+	mux.HandleFunc("/rest/v1/collections/childrens", fake.authenticated(fake.serve_fixture("collections_childrens.json")))
+	mux.HandleFunc("/rest/v1/tags/0", fake.authenticated(fake.serve_fixture("tags.json")))
+	mux.HandleFunc("/oauth/access_token", fake.handle_access_token)
+	mux.HandleFunc("/rest/v1/raindrop/", fake.authenticated(fake.handle_raindrop))
+	mux.HandleFunc("/rest/v1/collection/-99", fake.authenticated(fake.handle_empty_trash))
+	mux.HandleFunc("/pages/", fake.handle_page)
+	mux.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><head><title>A page to bookmark</title><meta name="description" content="Description of the page"></head><body></body></html>`)
+	})
+	fake.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mutex.Lock()
+		unreachable := fake.unreachable
+		fake.mutex.Unlock()
+		for _, prefix := range unreachable {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				panic(http.ErrAbortHandler)
+			}
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+func read_fixture(t *testing.T, name string) []byte {
+	data, err := os.ReadFile("testdata/api/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Rejects requests that don't carry the currently valid access token
+func (fake *fake_raindrop) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fake.mutex.Lock()
+		fake.requests = append(fake.requests, r.Method+" "+r.URL.Path)
+		valid := r.Header.Get("Authorization") == "Bearer "+fake.access_token
+		fake.mutex.Unlock()
+		if !valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"result":false,"errorMessage":"Unauthorized"}`)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (fake *fake_raindrop) serve_fixture(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, _ := os.ReadFile("testdata/api/" + name)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
+
+// Serves /raindrops/{collection}, with a simplified version of the Raindrop.io search syntax and pagination
+func (fake *fake_raindrop) handle_raindrops(w http.ResponseWriter, r *http.Request) {
+	collection, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/rest/v1/raindrops/"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	perpage, err := strconv.Atoi(query.Get("perpage"))
+	if err != nil || perpage > 50 {
+		perpage = 25
+	}
+	if fake.before_page != nil {
+		fake.before_page(page)
+	}
+
+	fake.mutex.Lock()
+	var matches []int
+	for i, raindrop := range fake.raindrop_data {
+		// Like at Raindrop.io, collection 0 is all bookmarks except those in the trash
+		if (collection != 0 && !fake.in_collection(raindrop.Collection.ID, collection, query.Get("nested") == "true")) || (collection == 0 && raindrop.Collection.ID == -99) {
+			continue
+		}
+		if fake_search_matches(raindrop, fake.page_text[raindrop.ID], query.Get("search")) {
+			matches = append(matches, i)
+		}
+	}
+	if query.Get("sort") == "-lastUpdate" {
+		sort.SliceStable(matches, func(a, b int) bool {
+			return fake.raindrop_data[matches[a]].LastUpdate > fake.raindrop_data[matches[b]].LastUpdate
+		})
+	}
+
+	items := []json.RawMessage{}
+	for i := page * perpage; i < len(matches) && i < (page+1)*perpage; i++ {
+		items = append(items, fake.raindrops[matches[i]])
+	}
+	fake.mutex.Unlock()
+	response, _ := json.Marshal(map[string]interface{}{
+		"result": true,
+		"items":  items,
+		"count":  len(matches),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// Checks if a bookmark in one collection is found when searching another, which also finds the bookmarks in its subcollections when nested is set
+func (fake *fake_raindrop) in_collection(bookmark_collection int, collection int, nested bool) bool {
+	for bookmark_collection != 0 {
+		if bookmark_collection == collection {
+			return true
+		}
+		if !nested {
+			return false
+		}
+		bookmark_collection = fake.collection_parents[bookmark_collection]
+	}
+	return false
+}
+
+func fake_search_matches(raindrop Raindrop, page_text string, search string) bool {
+	text := strings.ToLower(raindrop.Title + " " + raindrop.Excerpt + " " + raindrop.Link + " " + page_text)
+	for _, word := range strings.Fields(strings.ToLower(search)) {
+		if strings.HasPrefix(word, "#") {
+			found := false
+			for _, tag := range raindrop.Tags {
+				if strings.ToLower(tag) == word[1:] {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		} else if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func (fake *fake_raindrop) handle_save(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var raindrop Raindrop
+	if err := json.Unmarshal(body, &raindrop); err != nil || raindrop.Link == "" {
+		// Like at Raindrop.io, a bookmark needs a link
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"result":false,"errorMessage":"Incorrect link"}`)
+		return
+	}
+	fake.mutex.Lock()
+	raindrop.ID = 1000 + len(fake.saved)
+	fake.saved = append(fake.saved, raindrop)
+	fake.mutex.Unlock()
+	response, _ := json.Marshal(map[string]interface{}{"result": true, "item": raindrop})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+func (fake *fake_raindrop) handle_access_token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.requests = append(fake.requests, r.Method+" "+r.URL.Path)
+	switch {
+	case r.Form.Get("grant_type") == "authorization_code" && r.Form.Get("code") == "auth-code":
+	case r.Form.Get("grant_type") == "refresh_token" && r.Form.Get("refresh_token") == fake.refresh_token:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_grant"}`)
+		return
+	}
+	fake.access_token = "access-token-" + fmt.Sprint(len(fake.requests))
+	response, _ := json.Marshal(RaindropToken{
+		AccessToken:  fake.access_token,
+		RefreshToken: fake.refresh_token,
+		TokenType:    "Bearer",
+		Expires:      1209599768,
+		ExpiresIn:    1209599,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// Adds a number of generated bookmarks to the fake server, where every tenth is a favourite
+func (fake *fake_raindrop) add_generated_raindrops(count int) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	// The numbers continue after the bookmarks that have been generated before
+	first := 0
+	for _, raindrop := range fake.raindrop_data {
+		if raindrop.ID >= 10000 {
+			first++
+		}
+	}
+	for i := first; i < first+count; i++ {
+		raindrop := Raindrop{
+			ID:         10000 + i,
+			Title:      "Generated bookmark " + fmt.Sprint(i),
+			Link:       "https://example.com/generated/" + fmt.Sprint(i),
+			Tags:       []string{"generated"},
+			Important:  i%10 == 9,
+			Collection: RaindropRef{Ref: "collections", ID: 2001},
+		}
+		raw, _ := json.Marshal(raindrop)
+		fake.raindrops = append(fake.raindrops, raw)
+		fake.raindrop_data = append(fake.raindrop_data, raindrop)
+	}
+}
+
+// Changes a bookmark on the fake server, and marks it as updated at the given time
+func (fake *fake_raindrop) update_raindrop(id int, update_time string, change func(raindrop *Raindrop)) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for i := range fake.raindrop_data {
+		if fake.raindrop_data[i].ID == id {
+			change(&fake.raindrop_data[i])
+			fake.raindrop_data[i].LastUpdate = update_time
+			fake.raindrops[i], _ = json.Marshal(fake.raindrop_data[i])
+		}
+	}
+}
+
+// Serves the page of a bookmark, with the text in page_text, at /pages/<id>
+func (fake *fake_raindrop) handle_page(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/pages/"))
+	fake.mutex.Lock()
+	fake.requests = append(fake.requests, r.Method+" "+r.URL.Path)
+	text, found := fake.page_text[id]
+	fake.mutex.Unlock()
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintf(w, `<html><head><title>Page %d</title><script>var menu = "script";</script></head><body><nav>Home About</nav><article><p>%s</p></article><footer>Copyright</footer></body></html>`, id, text)
+}
+
+// Serves /rest/v1/raindrop/<id>, where a bookmark can be moved to another collection or edited, and its permanent copy
+func (fake *fake_raindrop) handle_raindrop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		fake.handle_permanent_copy(w, r)
+		return
+	}
+	id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/rest/v1/raindrop/"))
+	var update struct {
+		Collection *RaindropRef `json:"collection"`
+		Title      *string      `json:"title"`
+		Excerpt    *string      `json:"excerpt"`
+		Tags       []string     `json:"tags"`
+	}
+	body, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &update); err != nil || (update.Collection == nil && update.Title == nil) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fake.mutex.Lock()
+	fake.requests = append(fake.requests, r.Method+" "+r.URL.Path+" "+string(body))
+	fake.mutex.Unlock()
+
+	found := false
+	fake.update_raindrop(id, time.Now().UTC().Format(time.RFC3339), func(raindrop *Raindrop) {
+		if update.Collection != nil {
+			raindrop.Collection.ID = update.Collection.ID
+		}
+		if update.Title != nil {
+			raindrop.Title = *update.Title
+		}
+		if update.Excerpt != nil {
+			raindrop.Excerpt = *update.Excerpt
+		}
+		if update.Tags != nil {
+			raindrop.Tags = update.Tags
+		}
+		found = true
+	})
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	fake.mutex.Lock()
+	var item json.RawMessage
+	for i := range fake.raindrop_data {
+		if fake.raindrop_data[i].ID == id {
+			item = fake.raindrops[i]
+		}
+	}
+	fake.mutex.Unlock()
+	response, _ := json.Marshal(map[string]interface{}{"result": true, "item": item})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// Permanently deletes the bookmarks in the trash
+func (fake *fake_raindrop) handle_empty_trash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	fake.mutex.Lock()
+	fake.requests = append(fake.requests, r.Method+" "+r.URL.Path)
+	fake.mutex.Unlock()
+	for _, raindrop := range fake.bookmarks_in(trash_collection) {
+		fake.delete_raindrop(raindrop.ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"result":true}`)
+}
+
+// Returns the bookmarks on the fake server that are in a collection
+func (fake *fake_raindrop) bookmarks_in(collection int) []Raindrop {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	bookmarks := []Raindrop{}
+	for _, raindrop := range fake.raindrop_data {
+		if raindrop.Collection.ID == collection {
+			bookmarks = append(bookmarks, raindrop)
+		}
+	}
+	return bookmarks
+}
+
+// Serves the permanent copy of a bookmark at /rest/v1/raindrop/<id>/cache, with the text in page_text
+func (fake *fake_raindrop) handle_permanent_copy(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/rest/v1/raindrop/"), "/cache"))
+	fake.mutex.Lock()
+	text, found := fake.page_text[id]
+	fake.mutex.Unlock()
+	if !found || !strings.HasSuffix(r.URL.Path, "/cache") {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintf(w, `<html><body><main>%s</main></body></html>`, text)
+}
+
+// Removes a bookmark from the fake server completely, as if it had been deleted from the trash
+func (fake *fake_raindrop) delete_raindrop(id int) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for i := range fake.raindrop_data {
+		if fake.raindrop_data[i].ID == id {
+			fake.raindrop_data = append(fake.raindrop_data[:i], fake.raindrop_data[i+1:]...)
+			fake.raindrops = append(fake.raindrops[:i], fake.raindrops[i+1:]...)
+			return
+		}
+	}
+}
+
+// Makes the next requests fail with 401 until the token is refreshed
+func (fake *fake_raindrop) expire_token() {
+	fake.mutex.Lock()
+	fake.access_token = "expired"
+	fake.mutex.Unlock()
+}
+
+// Makes both the access token and the refresh token invalid, as if the user had revoked access for the workflow
+func (fake *fake_raindrop) revoke_token() {
+	fake.mutex.Lock()
+	fake.access_token = "revoked"
+	fake.refresh_token = "revoked"
+	fake.mutex.Unlock()
+}
+
+// Makes requests to paths that start with prefix fail, as if the server couldn't be reached
+func (fake *fake_raindrop) make_unreachable(prefix string) {
+	fake.mutex.Lock()
+	fake.unreachable = append(fake.unreachable, prefix)
+	fake.mutex.Unlock()
+}
+
+// Counts how many times the token has been refreshed
+func (fake *fake_raindrop) refresh_count() int {
+	count := 0
+	for _, request := range fake.request_log() {
+		if request == "POST /oauth/access_token" {
+			count++
+		}
+	}
+	return count
+}
+
+func (fake *fake_raindrop) request_log() []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]string{}, fake.requests...)
+}
+
+// Sets up a workflow with its own cache directory, pointed at a fake Raindrop.io server and with a valid token in the store
+func setup_test_workflow(t *testing.T) *fake_raindrop {
+	fake := new_fake_raindrop(t)
+
+	t.Setenv("alfred_workflow_bundleid", "com.example.raindrop-test")
+	t.Setenv("alfred_workflow_cache", t.TempDir())
+	t.Setenv("alfred_workflow_data", t.TempDir())
+	t.Setenv("api_base_url", fake.server.URL)
+	wf = aw.New()
+	cache_storage = open_cache_storage()
+	raindrop_client = new_raindrop_client()
+	raindrop_client.sleep = func(time.Duration) {}
+	token_manager = new_token_manager()
+
+	token_store = &memory_token_store{values: map[string]string{}}
+	store_test_token(fake, time.Now())
+	return fake
+}
+
+// Puts a token for the fake server in the token store, created at the given time
+func store_test_token(fake *fake_raindrop, creation_time time.Time) {
+	location, _ := time.LoadLocation("UTC")
+	token_json, _ := json.Marshal(RaindropToken{
+		AccessToken:  fake.access_token,
+		RefreshToken: fake.refresh_token,
+		TokenType:    "Bearer",
+		CreationTime: creation_time.In(location).Format("2006-01-02 15:04:05"),
+		Expires:      1209599768,
+		ExpiresIn:    1209599,
+	})
+	token_store.Set("raindrop_token", string(token_json))
+}
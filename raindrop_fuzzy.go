@@ -0,0 +1,142 @@
+/*
+	Typo tolerant matching for the local search, where a search term that isn't found can match similar words in the titles, tags and domains of the bookmarks
+
+	By Andreas Westerlind, 2025
+*/
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// How many similar words a search term can match at most, where the most similar ones are used
+const max_term_alternatives = 20
+
+// The similar words that each search term can also match, by term
+type TermAlternatives map[string][]string
+
+// Function for checking if typo tolerant matching should be used, which can be turned off with the local_search_fuzzy setting
+func is_fuzzy_enabled() bool {
+	return wf.Config.Get("local_search_fuzzy", "1") != "0"
+}
+
+// Function for getting how many typos a search term can have, which is more for longer terms, as short terms would match too many other words.
+// It is never more than the local_search_fuzzy_max_distance setting (default 2).
+func fuzzy_max_distance(term string) int {
+	max_distance, err := strconv.Atoi(wf.Config.Get("local_search_fuzzy_max_distance", "2"))
+	if err != nil {
+		max_distance = 2
+	}
+	distance := 0
+	switch length := utf8.RuneCountInString(term); {
+	case length >= 9:
+		distance = 2
+	case length >= 5:
+		distance = 1
+	}
+	if distance > max_distance {
+		distance = max_distance
+	}
+	return distance
+}
+
+// Function for finding the words in the titles, tags and domains of the indexed bookmarks that each search term of a query is close to.
+// Only terms of a single word that no bookmark matches get alternatives, as they are there for finding bookmarks despite a typo,
+// and not for adding every similar word to a search that already finds what it is looking for.
+func (index *SearchIndex) term_alternatives(query string) TermAlternatives {
+	if !is_fuzzy_enabled() {
+		return nil
+	}
+	alternatives := make(TermAlternatives)
+	for _, term := range parse_query(query).Terms {
+		if words := split_words(term); len(words) != 1 || words[0] != term {
+			continue
+		}
+		max_distance := fuzzy_max_distance(term)
+		if max_distance == 0 || index.has_matches(term) {
+			continue
+		}
+
+		type similar_word struct {
+			word     string
+			distance int
+		}
+		var similar []similar_word
+		seen := make(map[string]bool)
+		for _, field := range []int{field_title, field_tags, field_domain} {
+			for _, word := range strings.Split(strings.TrimSuffix(index.Fields[field].Words, "\n"), "\n") {
+				if word == "" || seen[word] || strings.Contains(word, term) {
+					continue
+				}
+				seen[word] = true
+				if distance := edit_distance(term, word, max_distance); distance <= max_distance {
+					similar = append(similar, similar_word{word, distance})
+				}
+			}
+		}
+		sort.SliceStable(similar, func(i, j int) bool {
+			return similar[i].distance < similar[j].distance
+		})
+		for i := 0; i < len(similar) && i < max_term_alternatives; i++ {
+			alternatives[term] = append(alternatives[term], similar[i].word)
+		}
+	}
+	return alternatives
+}
+
+// Function for counting how many characters have to be added, removed, replaced or swapped with the next one to turn one word into another
+// (the optimal string alignment distance), where swapping is included as it is one of the most common typos.
+// Counting stops as soon as it is clear that the distance is more than max_distance, and max_distance+1 is returned then.
+func edit_distance(from string, to string, max_distance int) int {
+	from_runes := []rune(from)
+	to_runes := []rune(to)
+	if length_difference := len(from_runes) - len(to_runes); length_difference > max_distance || -length_difference > max_distance {
+		return max_distance + 1
+	}
+
+	before_previous := make([]int, len(to_runes)+1)
+	previous := make([]int, len(to_runes)+1)
+	current := make([]int, len(to_runes)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(from_runes); i++ {
+		current[0] = i
+		row_min := current[0]
+		for j := 1; j <= len(to_runes); j++ {
+			cost := 1
+			if from_runes[i-1] == to_runes[j-1] {
+				cost = 0
+			}
+			current[j] = min_int(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if i > 1 && j > 1 && from_runes[i-1] == to_runes[j-2] && from_runes[i-2] == to_runes[j-1] {
+				current[j] = min_int(current[j], before_previous[j-2]+1)
+			}
+			if current[j] < row_min {
+				row_min = current[j]
+			}
+		}
+		if row_min > max_distance {
+			return max_distance + 1
+		}
+		before_previous, previous, current = previous, current, before_previous
+	}
+	if previous[len(to_runes)] > max_distance {
+		return max_distance + 1
+	}
+	return previous[len(to_runes)]
+}
+
+func min_int(values ...int) int {
+	smallest := values[0]
+	for _, value := range values[1:] {
+		if value < smallest {
+			smallest = value
+		}
+	}
+	return smallest
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		from     string
+		to       string
+		distance int
+	}{
+		{"kubernetes", "kubernetes", 0},
+		{"kubernets", "kubernetes", 1},
+		{"kuberentes", "kubernetes", 1},
+		{"kuebrentes", "kubernetes", 2},
+		{"generics", "genetics", 1},
+		{"café", "cafe", 1},
+		{"rust", "golang", 3},
+		{"", "go", 2},
+	}
+	for _, test := range tests {
+		if distance := edit_distance(test.from, test.to, 2); distance != min_int(test.distance, 3) {
+			t.Errorf("edit_distance(%q, %q) = %d, expected %d", test.from, test.to, distance, min_int(test.distance, 3))
+		}
+	}
+}
+
+func TestFuzzyMaxDistance(t *testing.T) {
+	setup_test_workflow(t)
+	for term, expected := range map[string]int{"go": 0, "rust": 0, "tokio": 1, "generics": 1, "kubernetes": 2} {
+		if distance := fuzzy_max_distance(term); distance != expected {
+			t.Errorf("fuzzy_max_distance(%q) = %d, expected %d", term, distance, expected)
+		}
+	}
+	t.Setenv("local_search_fuzzy_max_distance", "1")
+	if distance := fuzzy_max_distance("kubernetes"); distance != 1 {
+		t.Errorf("The max distance setting was not followed, got %d", distance)
+	}
+}
+
+func TestTermAlternatives(t *testing.T) {
+	setup_test_workflow(t)
+	index := build_search_index([]Raindrop{
+		{ID: 1, Title: "Kubernetes the hard way", Tags: []string{"containers"}},
+		{ID: 2, Title: "Notes", Excerpt: "kubernetos is only in the excerpt"},
+	}, nil)
+	expected := TermAlternatives{"kubernets": {"kubernetes"}, "contaners": {"containers"}}
+	if alternatives := index.term_alternatives(`kubernets contaners go "kubernets way"`); !reflect.DeepEqual(alternatives, expected) {
+		t.Errorf("Unexpected alternatives: %v", alternatives)
+	}
+
+	// A term that is found as it is doesn't get any alternatives
+	if alternatives := index.term_alternatives("kubernetes notes"); len(alternatives) != 0 {
+		t.Errorf("Expected no alternatives for terms that are found, got %v", alternatives)
+	}
+
+	t.Setenv("local_search_fuzzy", "0")
+	if alternatives := index.term_alternatives("kubernets"); alternatives != nil {
+		t.Errorf("Expected no alternatives with fuzzy matching turned off, got %v", alternatives)
+	}
+}
+
+func TestRankBookmarksFuzzy(t *testing.T) {
+	bookmarks := []Raindrop{
+		{ID: 1, Title: "Kubernetes the hard way"},
+		{ID: 2, Title: "Cooking", Tags: []string{"kubernets"}},
+		{ID: 3, Title: "Unrelated"},
+	}
+	// The exact match comes first, even though the fuzzy match is in the title, which otherwise counts more
+	alternatives := TermAlternatives{"kubernets": {"kubernetes"}}
+	if ids := bookmark_ids(rank_bookmarks_fuzzy(bookmarks, "kubernets", alternatives, nil)); ids != "2,1" {
+		t.Errorf("Unexpected ranking: %s", ids)
+	}
+	if ids := bookmark_ids(rank_bookmarks(bookmarks, "kubernets")); ids != "2" {
+		t.Errorf("Unexpected ranking without alternatives: %s", ids)
+	}
+}
+
+func TestLocalSearchTypo(t *testing.T) {
+	setup_test_workflow(t)
+	for query, expected := range map[string]string{"golang generis": "Golang generics tutorial", "Programing langauge": "The Rust Programming Language"} {
+		wf.Feedback.Clear()
+		local_search_command("standard", query, "", "", "", false, true)
+		if first := item_json(wf.Feedback.Items[0]); !strings.Contains(first, expected) {
+			t.Errorf("Expected %q to find %q despite the typos, got %s", query, expected, first)
+		}
+	}
+}
+
+func TestFuzzyCandidatesExactHit(t *testing.T) {
+	setup_test_workflow(t)
+	index := build_search_index([]Raindrop{
+		{ID: 1, Title: "About topic42"},
+		{ID: 2, Title: "About topic43"},
+		{ID: 3, Title: "About topic44"},
+	}, nil)
+
+	// The near misses aren't added to a term that matches
+	candidates, _ := index.bookmarks(index.fuzzy_candidates("topic42", nil, index.term_alternatives("topic42")))
+	if ids := bookmark_ids(candidates); ids != "1" {
+		t.Errorf("Expected only the exact hit, got %s", ids)
+	}
+	// Even when alternatives are given for it
+	candidates, _ = index.bookmarks(index.fuzzy_candidates("topic42", nil, TermAlternatives{"topic42": {"topic43"}}))
+	if ids := bookmark_ids(candidates); ids != "1" {
+		t.Errorf("Expected only the exact hit with alternatives, got %s", ids)
+	}
+	// A typo that matches nothing still finds the similar words
+	candidates, _ = index.bookmarks(index.fuzzy_candidates("topic45", nil, index.term_alternatives("topic45")))
+	if ids := bookmark_ids(candidates); ids != "1,2,3" {
+		t.Errorf("Expected the near misses for a typo, got %s", ids)
+	}
+}
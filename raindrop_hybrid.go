@@ -0,0 +1,152 @@
+/*
+	Hybrid search, where results from the local cache are shown right away, and full-text matches from Raindrop.io are added to them as soon as they have been fetched
+
+	By Andreas Westerlind, 2025
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+// How long the full-text results for a query are kept, so that the reruns and the next searches for the same query don't have to fetch them again
+const hybrid_results_lifetime = 5 * time.Minute
+
+// How many queries the full-text results are kept for
+const hybrid_results_max = 20
+
+// The full-text results from Raindrop.io for a query
+type HybridResults struct {
+	Query      string     `json:"query"`
+	Collection int        `json:"collection"`
+	Tag        string     `json:"tag"`
+	Fetched    time.Time  `json:"fetched"`
+	Bookmarks  []Raindrop `json:"bookmarks"`
+}
+
+// Main function for handling hybrid search command from Alfred
+func hybrid_search_command(variant string, query string, collection_json string, tag string, from string, descr_in_list bool, favs_first bool) {
+	run_local_search_command(variant, query, collection_json, tag, from, descr_in_list, favs_first, hybrid_search)
+}
+
+// Function for searching the local cache, and adding the full-text matches from Raindrop.io that the local search didn't find.
+// The local results are shown first, and Alfred is asked to run the search again right away, which is when the full-text results are fetched.
+// While they are being fetched, Alfred keeps showing the local results, so the list doesn't change until the full-text results can be added to it.
+func hybrid_search(query string, token RaindropToken, collection int, tag string, descr_in_list bool, favs_first bool) {
+	// Without a query, the local cache has all bookmarks there are to show
+	if query == "" {
+		local_search(query, token, collection, tag, descr_in_list, favs_first)
+		return
+	}
+
+	full_text, found := cached_hybrid_results(query, collection, tag)
+	if !found && wf.Config.Get("hybrid_query", "") != query {
+		// Show the local results, and tell Alfred to run again for getting the full-text results.
+		// The query is passed on to the rerun, so that the full-text results are only fetched when the query has stayed the same.
+		local_search_with_full_text(query, token, collection, tag, descr_in_list, favs_first, nil)
+		wf.NewItem("Searching the full text of your bookmarks...").
+			Subtitle("Matches from Raindrop.io are added to the list when they have been found").
+			Valid(false)
+		wf.Var("hybrid_query", query)
+		wf.Rerun(0.1)
+		return
+	}
+
+	var err error
+	if !found {
+		full_text, _, err = search_request(query, token, collection, tag, 0)
+		if errors.Is(err, err_no_results) {
+			full_text, err = []Raindrop{}, nil
+		}
+		if err == nil {
+			save_hybrid_results(query, collection, tag, full_text)
+		}
+	}
+	for i := range full_text {
+		full_text[i].FullText = true
+	}
+	local_search_with_full_text(query, token, collection, tag, descr_in_list, favs_first, full_text)
+
+	if err != nil {
+		// The local results are still worth showing, so the search isn't replaced with an error
+		log.Printf("Failed to get full-text results: %v", err)
+		subtitle := err.Error()
+		if errors.Is(err, err_network) {
+			subtitle = "Could not connect to Raindrop.io"
+		}
+		wf.NewItem("Full-text results are not available").
+			Subtitle(subtitle).
+			Valid(false)
+	}
+}
+
+// Function for reading the full-text results that were fetched for a query a moment ago, if any
+func cached_hybrid_results(query string, collection int, tag string) ([]Raindrop, bool) {
+	for _, results := range read_hybrid_results() {
+		if results.Query == query && results.Collection == collection && results.Tag == tag && time.Since(results.Fetched) < hybrid_results_lifetime {
+			return results.Bookmarks, true
+		}
+	}
+	return nil, false
+}
+
+func read_hybrid_results() []HybridResults {
+	var all_results []HybridResults
+	if data, _, err := cache_storage.Read("hybrid_results"); err == nil {
+		json.Unmarshal(data, &all_results)
+	}
+	return all_results
+}
+
+// Function for saving the full-text results for a query, together with those of the latest other queries
+func save_hybrid_results(query string, collection int, tag string, bookmarks []Raindrop) {
+	all_results := []HybridResults{{Query: query, Collection: collection, Tag: tag, Fetched: time.Now(), Bookmarks: bookmarks}}
+	for _, results := range read_hybrid_results() {
+		if len(all_results) >= hybrid_results_max {
+			break
+		}
+		same_query := results.Query == query && results.Collection == collection && results.Tag == tag
+		if !same_query && time.Since(results.Fetched) < hybrid_results_lifetime {
+			all_results = append(all_results, results)
+		}
+	}
+	results_json, _ := json.Marshal(all_results)
+	if err := cache_storage.Write("hybrid_results", results_json); err != nil {
+		log.Printf("Failed to cache the full-text results: %v", err)
+	}
+}
+
+// Function for putting favourites before the other bookmarks, and otherwise keeping the order they are ranked in.
+// Full-text matches from Raindrop.io stay after the bookmarks that the local search found, even when they are favourites,
+// as a weak match somewhere in the text of a page shouldn't take the place of a bookmark that matches by its title.
+func favourites_first(bookmarks []Raindrop) []Raindrop {
+	sorted := append([]Raindrop{}, bookmarks...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].FullText != sorted[j].FullText {
+			return !sorted[i].FullText
+		}
+		return sorted[i].Important && !sorted[j].Important
+	})
+	return sorted
+}
+
+// Function for getting the full-text results that aren't already among the local results
+func missing_bookmarks(local []Raindrop, full_text []Raindrop) []Raindrop {
+	shown := make(map[int]bool)
+	for _, bookmark := range local {
+		shown[bookmark.ID] = true
+	}
+	var missing []Raindrop
+	for _, bookmark := range full_text {
+		if !shown[bookmark.ID] {
+			shown[bookmark.ID] = true
+			missing = append(missing, bookmark)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	aw "github.com/deanishe/awgo"
+)
+
+func TestHybridSearch(t *testing.T) {
+	fake := setup_test_workflow(t)
+	get_all_bookmarks(read_token(), "fetch")
+	// Only the full-text search finds the Rust book, while the pancake recipe is found by both
+	fake.page_text[2] = "A chapter about ownership, written while eating pancakes"
+	searches := func() int {
+		count := 0
+		for _, request := range fake.request_log() {
+			if strings.HasPrefix(request, "GET /rest/v1/raindrops/0") {
+				count++
+			}
+		}
+		return count
+	}
+	searches_before := searches()
+
+	// The local results are shown first, without waiting for Raindrop.io
+	hybrid_search_command("standard", "pancake", "", "", "", false, true)
+	check_golden(t, fake, "hybrid_search_local")
+	if searches() != searches_before {
+		t.Error("Raindrop.io was searched before the local results were shown")
+	}
+
+	// The rerun adds the full-text matches that the local search didn't find
+	t.Setenv("hybrid_query", "pancake")
+	wf = aw.New()
+	hybrid_search_command("standard", "pancake", "", "", "", false, true)
+	check_golden(t, fake, "hybrid_search_full_text")
+
+	// The full-text results are kept for the next runs, so the list stays the same without searching again
+	t.Setenv("hybrid_query", "")
+	wf = aw.New()
+	hybrid_search_command("standard", "pancake", "", "", "", false, true)
+	check_golden(t, fake, "hybrid_search_full_text")
+	if searches() != searches_before+1 {
+		t.Errorf("Expected Raindrop.io to be searched once, got %d", searches()-searches_before)
+	}
+}
+
+func TestHybridSearchFavouritesFirst(t *testing.T) {
+	fake := setup_test_workflow(t)
+	get_all_bookmarks(read_token(), "fetch")
+	// Only the full-text search finds the Go tutorial, which is a favourite, while the Rust book matches by its title
+	fake.page_text[1] = "Unlike Rust, Go has had generics for a while"
+	t.Setenv("hybrid_query", "rust")
+	hybrid_search_command("standard", "rust", "", "", "", false, true)
+
+	items := wf.Feedback.Items
+	if len(items) < 2 || !strings.Contains(item_json(items[0]), `"title":"The Rust Programming Language"`) || !strings.Contains(item_json(items[1]), `"title":"Golang generics tutorial"`) {
+		t.Errorf("Expected the local match before the full-text favourite, got %v", feedback_json())
+	}
+}
+
+func TestFavouritesFirst(t *testing.T) {
+	bookmarks := []Raindrop{
+		{ID: 1},
+		{ID: 2, Important: true},
+		{ID: 3},
+		{ID: 4, FullText: true},
+		{ID: 5, FullText: true, Important: true},
+	}
+	if ids := bookmark_ids(favourites_first(bookmarks)); ids != "2,1,3,5,4" {
+		t.Errorf("Unexpected order: %s", ids)
+	}
+}
+
+func TestHybridSearchOffline(t *testing.T) {
+	fake := setup_test_workflow(t)
+	get_all_bookmarks(read_token(), "fetch")
+	fake.make_unreachable("/rest/")
+	t.Setenv("hybrid_query", "pancake")
+	hybrid_search_command("standard", "pancake", "", "", "", false, true)
+
+	// The local results are kept, with an item that tells why there are no full-text results
+	items := wf.Feedback.Items
+	if !strings.Contains(item_json(items[0]), "Fluffy pancakes") || !strings.Contains(item_json(items[len(items)-1]), "Full-text results are not available") {
+		t.Errorf("Unexpected items: %s ... %s", item_json(items[0]), item_json(items[len(items)-1]))
+	}
+	if _, found := cached_hybrid_results("pancake", 0, ""); found {
+		t.Error("Failed full-text results were cached")
+	}
+}
@@ -0,0 +1,439 @@
+/*
+	Search index for the local bookmark cache, so that a local search doesn't have to read and go through every cached bookmark
+
+	By Andreas Westerlind, 2025
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Increase this when the format of the index changes, so that indexes written by older versions are rebuilt
+const search_index_version = 6
+
+// The fields of a bookmark that are indexed, in the same order as in the index
+const (
+	field_title = iota
+	field_tags
+	field_domain
+	field_excerpt
+	field_notes
+	field_path
+	field_content
+	field_count
+)
+
+// How much a match in each field is worth, in the same order as in the index
+var field_weights = [field_count]int{weight_title, weight_tags, weight_domain, weight_excerpt, weight_notes, weight_path, weight_content}
+
+// The index is stored as a few large strings and lists of numbers rather than as maps and lists of bookmarks,
+// as that is much faster to read for each search
+type SearchIndex struct {
+	Version int
+	// Where the JSON of each bookmark starts in the docs file, which has all bookmarks after each other, in the same order as in the cache.
+	// Only the bookmarks that a search might match are read from the docs file.
+	DocStarts []int
+	// The checksum of the docs file that the index was built together with, so that an index is never used with the docs of another one
+	DocsChecksum string
+	// The collection and ID of each bookmark
+	Collections []int
+	IDs         []int
+	// The words of each field, and which bookmarks they are found in
+	Fields []IndexField
+
+	// The contents of the docs file, for an index that has been built rather than read from the cache
+	docs []byte
+}
+
+type IndexField struct {
+	// All words in the field, sorted and separated by newlines, where WordStarts is where each word starts
+	Words      string
+	WordStarts []int
+	// The positions of the bookmarks that each word is found in, after each other, where PostingStarts is where each word's list starts
+	Postings      []int
+	PostingStarts []int
+}
+
+// Function for building a search index for a list of bookmarks, together with the text of their pages, which is nil when it isn't indexed.
+// The text of the bookmarked pages is kept in the docs, so that it can be searched like the rest of each bookmark.
+func build_search_index(bookmarks []Raindrop, page_texts map[int]PageText) *SearchIndex {
+	index := &SearchIndex{
+		Version:     search_index_version,
+		DocStarts:   make([]int, 0, len(bookmarks)+1),
+		Collections: make([]int, 0, len(bookmarks)),
+		IDs:         make([]int, 0, len(bookmarks)),
+	}
+	field_postings := make([]map[string][]int, field_count)
+	for field := range field_postings {
+		field_postings[field] = make(map[string][]int)
+	}
+
+	var docs bytes.Buffer
+	for doc, bookmark := range bookmarks {
+		bookmark.PageText = page_texts[bookmark.ID].Text
+		bookmark_json, _ := json.Marshal(bookmark)
+		index.DocStarts = append(index.DocStarts, docs.Len())
+		docs.Write(bookmark_json)
+		index.Collections = append(index.Collections, bookmark.Collection.ID)
+		index.IDs = append(index.IDs, bookmark.ID)
+
+		for field, text := range search_field_list(search_fields(bookmark)) {
+			for _, word := range unique_words(text) {
+				field_postings[field][word] = append(field_postings[field][word], doc)
+			}
+		}
+	}
+	index.DocStarts = append(index.DocStarts, docs.Len())
+	index.docs = docs.Bytes()
+	index.DocsChecksum = cache_checksum(index.docs)
+
+	for _, postings := range field_postings {
+		words := make([]string, 0, len(postings))
+		for word := range postings {
+			words = append(words, word)
+		}
+		sort.Strings(words)
+
+		var field IndexField
+		var all_words strings.Builder
+		for _, word := range words {
+			field.WordStarts = append(field.WordStarts, all_words.Len())
+			all_words.WriteString(word)
+			all_words.WriteByte('\n')
+			field.PostingStarts = append(field.PostingStarts, len(field.Postings))
+			field.Postings = append(field.Postings, postings[word]...)
+		}
+		field.WordStarts = append(field.WordStarts, all_words.Len())
+		field.PostingStarts = append(field.PostingStarts, len(field.Postings))
+		field.Words = all_words.String()
+		index.Fields = append(index.Fields, field)
+	}
+	return index
+}
+
+// Function for getting the fields of a bookmark in the order they are indexed in
+func search_field_list(fields SearchFields) []string {
+	list := make([]string, field_count)
+	list[field_title] = fields.Title
+	list[field_tags] = fields.Tags
+	list[field_domain] = fields.Domain
+	list[field_excerpt] = fields.Excerpt
+	list[field_notes] = fields.Notes
+	list[field_path] = fields.Path
+	list[field_content] = fields.Content
+	return list
+}
+
+// Function for splitting a text into words, in the same way as word boundaries are found when scoring a match
+func split_words(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !is_word_rune(r)
+	})
+}
+
+func unique_words(text string) []string {
+	seen := make(map[string]bool)
+	words := []string{}
+	for _, word := range split_words(text) {
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// Function for writing the search index to the cache.
+// The docs are written first, as the index is treated as up to date if it is newer than the bookmarks cache.
+func save_search_index(index *SearchIndex) error {
+	unlock, err := lock_cache(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := cache_storage.Write("search_index_docs", index.docs); err != nil {
+		return err
+	}
+	var index_data bytes.Buffer
+	if err := gob.NewEncoder(&index_data).Encode(index); err != nil {
+		return err
+	}
+	return cache_storage.Write("search_index", index_data.Bytes())
+}
+
+// Function for reading the search index of the bookmarks cache.
+// If the index is missing, or older than the bookmarks cache, it is built again from the cache.
+func load_search_index() (*SearchIndex, error) {
+	index, err := read_search_index()
+	if index != nil || err != nil {
+		return index, err
+	}
+	index, err = rebuild_search_index(indexed_page_texts())
+	if index != nil {
+		// The index can be searched even if it couldn't be saved
+		return index, nil
+	}
+	return nil, err
+}
+
+// Function for reading the search index while the cache is locked, so that it isn't replaced halfway through.
+// No index is returned if it has to be built again.
+func read_search_index() (*SearchIndex, error) {
+	unlock, err := lock_cache(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	cache_time, err := cache_storage.Modified("bookmarks")
+	if err != nil {
+		return nil, err
+	}
+	if index_data, index_time, err := cache_storage.Read("search_index"); err == nil && !index_time.Before(cache_time) {
+		var index SearchIndex
+		err := gob.NewDecoder(bytes.NewReader(index_data)).Decode(&index)
+		if err == nil && index.Version == search_index_version && len(index.Fields) == field_count {
+			return &index, nil
+		}
+	}
+	return nil, nil
+}
+
+// Function for building the search index again from the bookmarks cache, together with the text of their pages, and saving it.
+// The cache is locked for writing before the bookmarks are read, so that they can't be replaced before the index of them has been saved.
+// The index is returned also if it couldn't be saved.
+func rebuild_search_index(page_texts map[int]PageText) (*SearchIndex, error) {
+	unlock, err := lock_cache(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	cache_data, _, err := cache_storage.Read("bookmarks")
+	if err != nil {
+		return nil, err
+	}
+	var cache_base RaindropsResponse
+	if err := decode_response(cache_data, &cache_base); err != nil {
+		return nil, err
+	}
+	if cache_base.Items == nil {
+		return nil, errors.New("the bookmarks cache is empty")
+	}
+	index := build_search_index(cache_base.Items, page_texts)
+	return index, save_search_index(index)
+}
+
+// Function for finding the bookmarks that might match a search query, in a collection if one is given.
+// Every word of every search term has to be part of a word in the bookmark, which gives a list that can then be scored without going through all bookmarks.
+func (index *SearchIndex) candidates(query string, collection int) []int {
+	var collections map[int]bool
+	if collection != 0 {
+		collections = map[int]bool{collection: true}
+	}
+	return index.fuzzy_candidates(query, collections, nil)
+}
+
+// Function for finding the bookmarks that might match a search query in the given collections (or in all collections if none are given),
+// where a term can also be matched by one of its alternatives
+func (index *SearchIndex) fuzzy_candidates(query string, collections map[int]bool, alternatives TermAlternatives) []int {
+	var docs []int
+	if collections != nil {
+		for doc, doc_collection := range index.Collections {
+			if collections[doc_collection] {
+				docs = append(docs, doc)
+			}
+		}
+	} else {
+		docs = make([]int, len(index.Collections))
+		for doc := range docs {
+			docs[doc] = doc
+		}
+	}
+
+	for _, term := range parse_query(query).Terms {
+		for _, term_word := range split_words(term) {
+			matching := index.matching_docs(term_word)
+			// Only terms of a single word have alternatives, so they can be added to the matches of that word when it doesn't match anything itself
+			if len(alternatives[term]) > 0 && !has_match(matching) {
+				for _, alternative := range alternatives[term] {
+					for doc, found := range index.matching_docs(alternative) {
+						if found {
+							matching[doc] = true
+						}
+					}
+				}
+			}
+			filtered := docs[:0]
+			for _, doc := range docs {
+				if matching[doc] {
+					filtered = append(filtered, doc)
+				}
+			}
+			docs = filtered
+		}
+	}
+	return docs
+}
+
+// Function for checking if a word is part of any of the indexed words
+func (index *SearchIndex) has_matches(term_word string) bool {
+	for _, field := range index.Fields {
+		if strings.Contains(field.Words, term_word) {
+			return true
+		}
+	}
+	return false
+}
+
+func has_match(matching []bool) bool {
+	for _, found := range matching {
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// Function for finding the bookmarks where a word is part of one of the indexed words
+func (index *SearchIndex) matching_docs(term_word string) []bool {
+	matching := make([]bool, len(index.Collections))
+	for _, field := range index.Fields {
+		for offset := 0; offset < len(field.Words); {
+			found := strings.Index(field.Words[offset:], term_word)
+			if found < 0 {
+				break
+			}
+			// Find which word the match is in, and continue searching from the next word
+			word := sort.SearchInts(field.WordStarts, offset+found+1) - 1
+			for _, doc := range field.Postings[field.PostingStarts[word]:field.PostingStarts[word+1]] {
+				matching[doc] = true
+			}
+			offset = field.WordStarts[word+1]
+		}
+	}
+	return matching
+}
+
+// Function for keeping the candidates of a search that match it best, so that only those have to be read from the docs file.
+// They are scored by the indexed words that the terms are found in, which is close to the score that ranking the bookmarks gives them afterwards,
+// apart from matches at the very start of a field and phrases that are matched word by word.
+func (index *SearchIndex) best_candidates(docs []int, query string, alternatives TermAlternatives, frecency map[int]int, limit int) []int {
+	if len(docs) <= limit {
+		return docs
+	}
+	scores := make([]int, len(index.Collections))
+	for _, term := range parse_query(query).Terms {
+		for _, term_word := range split_words(term) {
+			word_scores := index.word_scores(term_word)
+			// Like when finding the candidates, the alternatives of a term are only used when the term doesn't match anything itself
+			if len(alternatives[term]) > 0 && !has_score(word_scores) {
+				for _, alternative := range alternatives[term] {
+					for doc, score := range index.word_scores(alternative) {
+						if score > word_scores[doc] {
+							word_scores[doc] = score
+						}
+					}
+				}
+			}
+			for doc, score := range word_scores {
+				scores[doc] += score
+			}
+		}
+	}
+	for doc, score := range scores {
+		scores[doc] = boost_by_frecency(score, frecency[index.IDs[doc]])
+	}
+
+	best := append([]int{}, docs...)
+	sort.SliceStable(best, func(i, j int) bool {
+		return scores[best[i]] > scores[best[j]]
+	})
+	return best[:limit]
+}
+
+// Function for scoring each bookmark by how well a word matches the indexed words of its fields, in the same way as when ranking the bookmarks:
+// 1 if the word is found inside an indexed word, 2 if it is found at the start of one, and 3 if it is the whole word, times the weight of the field
+func (index *SearchIndex) word_scores(term_word string) []int {
+	scores := make([]int, len(index.Collections))
+	for field_number, field := range index.Fields {
+		field_scores := make([]int, len(index.Collections))
+		for offset := 0; offset < len(field.Words); {
+			found := strings.Index(field.Words[offset:], term_word)
+			if found < 0 {
+				break
+			}
+			word := sort.SearchInts(field.WordStarts, offset+found+1) - 1
+			score := 1
+			if offset+found == field.WordStarts[word] {
+				score = 2
+				if len(term_word) == field.WordStarts[word+1]-field.WordStarts[word]-1 {
+					score = 3
+				}
+			}
+			for _, doc := range field.Postings[field.PostingStarts[word]:field.PostingStarts[word+1]] {
+				if score > field_scores[doc] {
+					field_scores[doc] = score
+				}
+			}
+			offset = field.WordStarts[word+1]
+		}
+		for doc, score := range field_scores {
+			scores[doc] += field_weights[field_number] * score
+		}
+	}
+	return scores
+}
+
+func has_score(scores []int) bool {
+	for _, score := range scores {
+		if score > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Function for reading the bookmarks at the given positions in the index.
+// This fails if the docs file has been replaced since the index was read, in which case the index has to be read again.
+func (index *SearchIndex) bookmarks(docs []int) ([]Raindrop, error) {
+	sort.Ints(docs)
+	bookmarks := make([]Raindrop, 0, len(docs))
+
+	parts := make([][2]int, len(docs))
+	for i, doc := range docs {
+		parts[i] = [2]int{index.DocStarts[doc], index.DocStarts[doc+1]}
+	}
+	var docs_json [][]byte
+	if index.docs != nil {
+		for _, part := range parts {
+			docs_json = append(docs_json, index.docs[part[0]:part[1]])
+		}
+	} else {
+		unlock, err := lock_cache(false)
+		if err != nil {
+			return bookmarks, err
+		}
+		docs_json, err = cache_storage.ReadParts("search_index_docs", index.DocsChecksum, parts)
+		unlock()
+		if err != nil {
+			return bookmarks, err
+		}
+	}
+
+	for _, doc_json := range docs_json {
+		var bookmark Raindrop
+		if decode_response(doc_json, &bookmark) == nil {
+			bookmarks = append(bookmarks, bookmark)
+		}
+	}
+	return bookmarks, nil
+}
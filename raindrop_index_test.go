@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	aw "github.com/deanishe/awgo"
+)
+
+func TestSearchIndexMatchesFullScan(t *testing.T) {
+	fake := setup_test_workflow(t)
+	fake.add_generated_raindrops(100)
+	bookmarks := fake.raindrop_data
+	index := build_search_index(bookmarks, nil)
+
+	// Looking up the candidates in the index must give the same results as going through all bookmarks
+	for _, query := range []string{"", "generics", "ene", "go generics tutorial", "go.dev", `"pancake recipe"`, "#golang", "bookmark 4", "-generated", "nothingmatchesthis", "ycombinator news"} {
+		expected := bookmark_ids(rank_bookmarks(bookmarks, query))
+		candidates, _ := index.bookmarks(index.candidates(query, 0))
+		if ids := bookmark_ids(rank_bookmarks(candidates, query)); ids != expected {
+			t.Errorf("Query %q gave %q from the index, expected %q", query, ids, expected)
+		}
+	}
+	if candidates, _ := index.bookmarks(index.candidates("", 2001)); len(candidates) != 101 || candidates[0].ID != 3 {
+		t.Errorf("Unexpected candidates in collection: %s", bookmark_ids(candidates))
+	}
+}
+
+func TestSearchIndexRebuiltWhenStale(t *testing.T) {
+	setup_test_workflow(t)
+	if err := write_bookmarks_cache([]Raindrop{{ID: 1, Title: "First version"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the cache without updating the index, like an older version of the workflow would have done
+	cache_storage.Write("bookmarks", []byte(`{"result":true,"items":[{"_id":2,"title":"Second version"}]}`))
+
+	index, err := load_search_index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates, err := index.bookmarks(index.candidates("version", 0))
+	if ids := bookmark_ids(candidates); err != nil || ids != "2" {
+		t.Errorf("Index was not rebuilt, got %s", ids)
+	}
+	index_time, _ := cache_storage.Modified("search_index")
+	if cache_time, _ := cache_storage.Modified("bookmarks"); index_time.Before(cache_time) {
+		t.Error("Rebuilt index was not saved")
+	}
+}
+
+func TestSearchIndexReplacedDocs(t *testing.T) {
+	setup_test_workflow(t)
+	write_bookmarks_cache([]Raindrop{{ID: 1, Title: "First version"}})
+	index, err := load_search_index()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A refresh replaces the cache after the index has been read
+	write_bookmarks_cache([]Raindrop{{ID: 2, Title: "Second version with a longer title"}})
+	if _, err := index.bookmarks(index.candidates("version", 0)); !errors.Is(err, err_corrupt_cache) {
+		t.Errorf("Expected the old index to be rejected, got %v", err)
+	}
+	index, _ = load_search_index()
+	if candidates, err := index.bookmarks(index.candidates("version", 0)); err != nil || bookmark_ids(candidates) != "2" {
+		t.Errorf("Unexpected bookmarks from the new index: %s, %v", bookmark_ids(candidates), err)
+	}
+}
+
+func TestSearchIndexRebuiltWhileRefreshing(t *testing.T) {
+	setup_test_workflow(t)
+	write_bookmarks_cache([]Raindrop{{ID: 1, Title: "First version"}})
+	// Replace the cache without updating the index, so that the next search has to build it again
+	cache_storage.Write("bookmarks", []byte(`{"result":true,"items":[{"_id":2,"title":"Second version"}]}`))
+
+	// A refresh in another process is reading the cache, and replaces it before the search can build the index
+	refresh, err := os.OpenFile(wf.CacheDir()+"/cache.lock", os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refresh.Close()
+	syscall.Flock(int(refresh.Fd()), syscall.LOCK_SH)
+	loaded := make(chan *SearchIndex)
+	go func() {
+		index, err := load_search_index()
+		if err != nil {
+			t.Error(err)
+		}
+		loaded <- index
+	}()
+	time.Sleep(100 * time.Millisecond)
+	syscall.Flock(int(refresh.Fd()), syscall.LOCK_EX)
+	cache_storage.Write("bookmarks", []byte(`{"result":true,"items":[{"_id":3,"title":"Third version"}]}`))
+	syscall.Flock(int(refresh.Fd()), syscall.LOCK_UN)
+
+	// The index is built from the bookmarks that the refresh wrote, and is up to date with them
+	index := <-loaded
+	if candidates, err := index.bookmarks(index.candidates("version", 0)); err != nil || bookmark_ids(candidates) != "3" {
+		t.Errorf("Expected the index of the new bookmarks, got %s, %v", bookmark_ids(candidates), err)
+	}
+	if index, err := read_search_index(); index == nil || err != nil {
+		t.Errorf("Expected the rebuilt index to be up to date, got %v", err)
+	}
+}
+
+func TestBestCandidates(t *testing.T) {
+	bookmarks := make([]Raindrop, 300)
+	for i := range bookmarks {
+		bookmarks[i] = Raindrop{ID: i + 1, Title: fmt.Sprintf("Bookmark %d", i), Excerpt: fmt.Sprintf("Notes about topic%d", i%70)}
+		if i%50 == 25 {
+			bookmarks[i].Title = fmt.Sprintf("Something about topic%d", i%70)
+		}
+	}
+	index := build_search_index(bookmarks, nil)
+
+	// The best candidates are the bookmarks that come first when ranking all of them
+	frecency := map[int]int{100: 50}
+	for _, query := range []string{"about", "topic3", "bout", "notes topic6"} {
+		expected := rank_bookmarks_fuzzy(bookmarks, query, nil, frecency)[:10]
+		best, _ := index.bookmarks(index.best_candidates(index.candidates(query, 0), query, nil, frecency, 10))
+		if ids := bookmark_ids(rank_bookmarks_fuzzy(best, query, nil, frecency)); ids != bookmark_ids(expected) {
+			t.Errorf("Query %q gave %q as the best candidates, expected %q", query, ids, bookmark_ids(expected))
+		}
+	}
+}
+
+func TestReadCandidates(t *testing.T) {
+	setup_test_workflow(t)
+	bookmarks := make([]Raindrop, local_search_max_results+100)
+	for i := range bookmarks {
+		bookmarks[i] = Raindrop{ID: i + 1, Title: fmt.Sprintf("Bookmark %d about something", i), Tags: []string{"reading"}}
+	}
+	index := build_search_index(bookmarks, nil)
+
+	// Only the best matches are read for a query of search terms, but all candidates for operators and tags, which are checked afterwards
+	for _, test := range []struct {
+		query    string
+		tag      string
+		expected int
+	}{
+		{"about", "", local_search_max_results},
+		{"about -nothing", "", len(bookmarks)},
+		{"about #reading", "", len(bookmarks)},
+		{"about", "reading", len(bookmarks)},
+		{"", "", len(bookmarks)},
+	} {
+		candidates, err := read_candidates(index, test.query, nil, nil, test.tag, nil)
+		if err != nil || len(candidates) != test.expected {
+			t.Errorf("Query %q with tag %q read %d bookmarks, expected %d (%v)", test.query, test.tag, len(candidates), test.expected, err)
+		}
+	}
+}
+
+func BenchmarkLocalSearchIndex(b *testing.B) {
+	index := build_search_index(benchmark_bookmarks(), nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		candidates, _ := index.bookmarks(index.candidates("topic42 tag17", 0))
+		rank_bookmarks(candidates, "topic42 tag17")
+	}
+}
+
+// The search that is done for each key press, with the index and the bookmarks read from the cache
+func BenchmarkLocalSearchStored(b *testing.B) {
+	b.Setenv("alfred_workflow_bundleid", "com.example.raindrop-test")
+	b.Setenv("alfred_workflow_cache", b.TempDir())
+	b.Setenv("alfred_workflow_data", b.TempDir())
+	wf = aw.New()
+	cache_storage = open_cache_storage()
+	if err := write_bookmarks_cache(benchmark_bookmarks()); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, query := range []string{"topic42 tag17", "about"} {
+		b.Run(query, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				index, err := load_search_index()
+				if err != nil {
+					b.Fatal(err)
+				}
+				alternatives := index.term_alternatives(query)
+				candidates, err := read_candidates(index, query, nil, alternatives, "", nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				rank_bookmarks_fuzzy(candidates, query, alternatives, nil)
+			}
+		})
+	}
+}
+
+func benchmark_bookmarks() []Raindrop {
+	bookmarks := make([]Raindrop, 50000)
+	for i := range bookmarks {
+		bookmarks[i] = Raindrop{
+			ID:      i,
+			Title:   fmt.Sprintf("Bookmark number %d about topic%d", i, i%500),
+			Excerpt: fmt.Sprintf("An excerpt that describes bookmark %d in a few more words", i),
+			Link:    fmt.Sprintf("https://site%d.example.com/articles/%d", i%1000, i),
+			Tags:    []string{fmt.Sprintf("tag%d", i%200)},
+		}
+	}
+	return bookmarks
+}
@@ -8,164 +8,462 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
+	"log"
 	"net/url"
-	"os"
-	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	aw "github.com/deanishe/awgo"
 )
 
-// Function for fetching and caching all bookmarks from Raindrop.io
-func get_all_bookmarks(token RaindropToken, caching string) []interface{} {
+// Function for fetching and caching all bookmarks from Raindrop.io.
+// If fetching fails, the bookmarks that are already in the cache are returned together with the error.
+func get_all_bookmarks(token RaindropToken, caching string) ([]Raindrop, error) {
 	// If caching == "check": Redownload bookmarks only if cache is older than the configured refresh interval
 	// If caching == "trust": Trust the bookmarks cache to be good enough and use what is cached without checking its age (only download if no cache exists yet)
 	// If caching == "fetch": Always redownload bookmarks without checking the age of the cache
+	// If caching == "sync": Only download bookmarks that have changed since the cache was last updated, and remove deleted ones
 
-	var bookmarks []interface{}
-	var cache_base map[string]interface{}
-	var cache_filename string = wf.CacheDir() + "/bookmarks.json"
+	var cache_base RaindropsResponse
 
-	// Check if cache files exist
-	var bookmarks_cache_exists bool = false
-	var collections_cache_exists bool = false
-	var collections_sublevel_cache_exists bool = false
-	var tags_cache_exists bool = false
-
-	if _, err := os.Stat(wf.CacheDir() + "/bookmarks.json"); err == nil {
-		bookmarks_cache_exists = true
-	}
-	if _, err := os.Stat(wf.CacheDir() + "/collections.json"); err == nil {
-		collections_cache_exists = true
-	}
-	if _, err := os.Stat(wf.CacheDir() + "/collections_sublevel.json"); err == nil {
-		collections_sublevel_cache_exists = true
-	}
-	if _, err := os.Stat(wf.CacheDir() + "/tags.json"); err == nil {
-		tags_cache_exists = true
-	}
+	// Read the cached bookmarks, and check if the other caches exist
+	cache_data, _, err := cache_storage.Read("bookmarks")
+	var bookmarks_cache_exists bool = err == nil
+	cache_time, _ := last_sync_time()
+	var collections_cache_exists bool = is_cached("collections")
+	var collections_sublevel_cache_exists bool = is_cached("collections_sublevel")
+	var tags_cache_exists bool = is_cached("tags")
+	decode_response(cache_data, &cache_base)
 
 	// If any cache doesn't exist and caching is set to "trust", switch to "fetch"
 	if caching == "trust" && (!bookmarks_cache_exists || !collections_cache_exists || !collections_sublevel_cache_exists || !tags_cache_exists) {
 		caching = "fetch"
 	}
 
-	// Get cache refresh interval from config (default: 24 hours)
-	refresh_interval_str := wf.Config.Get("local_cache_refresh_interval", "24")
+	// Get cache refresh interval from config (default: 1 hour)
+	refresh_interval_str := wf.Config.Get("local_cache_refresh_interval", "1")
 	refresh_interval, err := strconv.ParseFloat(refresh_interval_str, 64)
 	if err != nil {
-		refresh_interval = 24 // Default to 24 hours if parsing fails
+		refresh_interval = 1 // Default to 1 hour if parsing fails
 	}
 
-	// Check if cache file exists
-	if cache_file_stat, err := os.Stat(cache_filename); err == nil {
+	// Check if the cache exists
+	if bookmarks_cache_exists {
 		// Use cache if caching is set to "trust", or if it's not older than the configured refresh interval and caching is set to "check"
-		if caching == "trust" || (time.Since(cache_file_stat.ModTime()).Hours() < refresh_interval && caching == "check") {
-			// Read stored cached bookmarks
-			cache_file, _ := os.ReadFile(cache_filename)
-			json.Unmarshal(cache_file, &cache_base)
-			if cache_base["items"] != nil && cache_base["items"].([]interface{}) != nil {
-				bookmarks = cache_base["items"].([]interface{})
-				return bookmarks
+		if caching == "trust" || (time.Since(cache_time).Hours() < refresh_interval && caching == "check") {
+			if cache_base.Items != nil {
+				return cache_base.Items, nil
 			}
 		}
 	}
 
 	// Cache doesn't exist, is too old, or force refresh is enabled
-	// Fetch all bookmarks from Raindrop.io
-	all_bookmarks := []interface{}{}
-	page := 0
-	perPage := 50 // The Raindrop.io API seems to limit results to 50 per page independent of this value
+	var all_bookmarks []Raindrop
+	if caching == "sync" && bookmarks_cache_exists && !should_full_sync() {
+		// Only fetch what has changed since the last refresh, and merge it into the cache
+		all_bookmarks, err = sync_bookmarks(token, cache_base.Items)
+	} else {
+		// Fetch all bookmarks from Raindrop.io.
+		// This also takes care of bookmarks that have been deleted permanently, which can't be found by syncing.
+		all_bookmarks, err = fetch_all_bookmarks(token, cache_base.Items)
+		if err == nil {
+			update_full_sync_timestamp()
+		}
+	}
+	if err == nil {
+		// The refresh might have been cancelled while the last page was downloaded
+		err = report_refresh_progress("saving", 0, 0)
+	}
+	if err != nil {
+		// Keep the existing cache, rather than replacing it with an incomplete list of bookmarks
+		return cache_base.Items, err
+	}
 
-	for {
-		// Query Raindrop.io for a page of bookmarks
-		client := &http.Client{}
-		params := url.Values{
+	// Write to the cache
+	if err := write_bookmarks_cache(all_bookmarks); err != nil {
+		return all_bookmarks, err
+	}
+	update_sync_timestamp()
+
+	// If we've updated the bookmarks cache, also update tags and collections
+	if caching == "fetch" || caching == "sync" {
+		if err := report_refresh_progress("tags", 0, 0); err != nil {
+			return all_bookmarks, err
+		}
+		if _, err := fetch_tags(token); err != nil {
+			return all_bookmarks, err
+		}
+		if err := report_refresh_progress("collections", 0, 0); err != nil {
+			return all_bookmarks, err
+		}
+		if _, err := fetch_collections(token, false); err != nil {
+			return all_bookmarks, err
+		}
+		if _, err := fetch_collections(token, true); err != nil {
+			return all_bookmarks, err
+		}
+	}
+
+	return all_bookmarks, nil
+}
+
+// Function for writing bookmarks to the cache, together with the search index for them.
+// The cache is locked while writing, so that a search doesn't read the new bookmarks with the old index.
+func write_bookmarks_cache(bookmarks []Raindrop) error {
+	unlock, err := lock_cache(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Create a result object with the same structure as the API response
+	result := RaindropsResponse{
+		Result: true,
+		Items:  bookmarks,
+	}
+	result_json, _ := json.Marshal(result)
+	if err := cache_storage.Write("bookmarks", result_json); err != nil {
+		return err
+	}
+	return save_search_index(build_search_index(bookmarks, indexed_page_texts()))
+}
+
+// Function for getting the search index for the bookmarks cache, where all bookmarks are fetched first if there is no cache yet
+func get_search_index(token RaindropToken) (*SearchIndex, error) {
+	if index, err := load_search_index(); err == nil {
+		return index, nil
+	}
+	bookmarks, err := get_all_bookmarks(token, "trust")
+	return build_search_index(bookmarks, indexed_page_texts()), err
+}
+
+// Function for downloading all bookmarks from Raindrop.io, with several pages being fetched at the same time.
+// The trash is downloaded too, and kept in a cache of its own together with which of the cached bookmarks it has in it.
+func fetch_all_bookmarks(token RaindropToken, cached []Raindrop) ([]Raindrop, error) {
+	perPage := 50 // The Raindrop.io API seems to limit results to 50 per page independent of this value
+	page_params := func(page int) url.Values {
+		return url.Values{
 			"perpage": []string{fmt.Sprint(perPage)},
 			"page":    []string{fmt.Sprint(page)},
 		}
-		u := &url.URL{
-			Scheme:   "https",
-			Host:     "api.raindrop.io",
-			Path:     "/rest/v1/raindrops/0",
-			RawQuery: params.Encode(),
+	}
+
+	// The first page tells how many bookmarks there are, and by that how many pages that are left to fetch
+	first_page, count, err := fetch_bookmarks_page(0, page_params(0), token)
+	if err != nil {
+		return nil, err
+	}
+	page_count := (count + perPage - 1) / perPage
+	if page_count == 0 && len(first_page) > 0 {
+		page_count = 1
+	}
+	pages := make([][]Raindrop, page_count)
+	if page_count > 0 {
+		pages[0] = first_page
+	}
+	pages_done := int32(1)
+	// The largest number of bookmarks that any page has told about, which grows if bookmarks are added while fetching
+	latest_count := count
+	var count_mutex sync.Mutex
+	if err := report_refresh_progress("bookmarks", 1, page_count); err != nil {
+		return nil, err
+	}
+
+	// Fetch the rest of the pages in parallel, with a limited number of requests at a time to stay within the rate limit.
+	// The client waits for the rate limit to reset if it is reached anyway.
+	workers, err := strconv.Atoi(wf.Config.Get("local_cache_fetch_workers", "4"))
+	if err != nil || workers < 1 {
+		workers = 4
+	}
+	page_numbers := make(chan int)
+	var wait_group sync.WaitGroup
+	var error_once sync.Once
+	var fetch_err error
+	failed := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		wait_group.Add(1)
+		go func() {
+			defer wait_group.Done()
+			for page := range page_numbers {
+				page_bookmarks, page_total, err := fetch_bookmarks_page(0, page_params(page), token)
+				if err == nil {
+					count_mutex.Lock()
+					if page_total > latest_count {
+						latest_count = page_total
+					}
+					count_mutex.Unlock()
+					err = report_refresh_progress("bookmarks", int(atomic.AddInt32(&pages_done, 1)), page_count)
+				}
+				if err != nil {
+					error_once.Do(func() {
+						fetch_err = err
+						close(failed)
+					})
+					continue
+				}
+				pages[page] = page_bookmarks
+			}
+		}()
+	}
+dispatch:
+	for page := 1; page < page_count; page++ {
+		select {
+		case page_numbers <- page:
+		case <-failed:
+			break dispatch // Don't start fetching more pages when one has failed
+		}
+	}
+	close(page_numbers)
+	wait_group.Wait()
+	if fetch_err != nil {
+		return nil, fetch_err
+	}
+
+	// Put the pages together in order.
+	// Bookmarks that are added while fetching push the others on to the next page, so some bookmarks can show up twice.
+	all_bookmarks := []Raindrop{}
+	seen := make(map[int]bool)
+	add_page := func(page_bookmarks []Raindrop) {
+		for _, bookmark := range page_bookmarks {
+			if !seen[bookmark.ID] {
+				seen[bookmark.ID] = true
+				all_bookmarks = append(all_bookmarks, bookmark)
+			}
 		}
-		request, err := http.NewRequest("GET", u.String(), nil)
-		if err != nil {
-			return bookmarks
+	}
+	for _, page_bookmarks := range pages {
+		add_page(page_bookmarks)
+	}
+
+	// Bookmarks that were added while fetching push the last ones on to pages after those that the first page told about, so get those pages too
+	for page := page_count; page < (latest_count+perPage-1)/perPage; page++ {
+		page_bookmarks, page_total, err := fetch_bookmarks_page(0, page_params(page), token)
+		if err == nil {
+			err = report_refresh_progress("bookmarks", page+1, 0)
 		}
-		request.Header.Set("User-Agent", "Alfred (Macintosh; Mac OS X)")
-		request.Header.Set("Authorization", "Bearer "+token.AccessToken)
-		response, err := client.Do(request)
 		if err != nil {
-			return bookmarks
+			return nil, err
+		}
+		add_page(page_bookmarks)
+		if page_total > latest_count {
+			latest_count = page_total
+		}
+	}
+
+	trash, err := fetch_trash(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := update_trash_cache(trash, cached); err != nil {
+		return nil, err
+	}
+
+	return all_bookmarks, nil
+}
+
+// Function for getting the bookmarks that have been created or changed since the newest bookmark in the cache was updated,
+// and for merging them into the cached bookmarks, together with removing bookmarks that have been moved to the trash
+func sync_bookmarks(token RaindropToken, cached []Raindrop) ([]Raindrop, error) {
+	newest := newest_update(cached)
+
+	// Get bookmarks with the most recently updated first, until we reach those that are already in the cache
+	changed := []Raindrop{}
+	for page := 0; ; page++ {
+		params := url.Values{
+			"perpage": []string{fmt.Sprint(search_page_size)},
+			"page":    []string{fmt.Sprint(page)},
+			"sort":    []string{"-lastUpdate"},
+		}
+		page_bookmarks, _, err := fetch_bookmarks_page(0, params, token)
+		if err == nil {
+			err = report_refresh_progress("changes", page+1, 0)
 		}
-		response_body, err := io.ReadAll(response.Body)
 		if err != nil {
-			return bookmarks
+			return nil, err
 		}
 
-		var result map[string]interface{}
-		json.Unmarshal(response_body, &result)
+		reached_cache := false
+		for _, bookmark := range page_bookmarks {
+			// Bookmarks updated at the same time as the newest cached one are included, as they might not all be in the cache
+			if parse_update_time(bookmark.LastUpdate).Before(newest) {
+				reached_cache = true
+				break
+			}
+			changed = append(changed, bookmark)
+		}
+		if reached_cache || len(page_bookmarks) < search_page_size {
+			break
+		}
+	}
 
-		// Check if we got valid results
-		if result["items"] == nil || len(result["items"].([]interface{})) == 0 {
-			break // No more bookmarks to fetch
+	// Get the bookmarks in the trash, so that they can be removed from the cache.
+	// Moving a bookmark to the trash doesn't necessarily update it, so the whole trash is read rather than only what has changed.
+	// The trash is also kept in a cache of its own, for browsing it when Raindrop.io can't be reached.
+	trash, err := fetch_trash(token)
+	if err != nil {
+		return nil, err
+	}
+	trashed := make(map[int]bool)
+	for _, bookmark := range trash {
+		trashed[bookmark.ID] = true
+	}
+	if err := update_trash_cache(trash, cached); err != nil {
+		return nil, err
+	}
+
+	return merge_bookmarks(cached, changed, trashed), nil
+}
+
+// Function for getting all bookmarks in the trash from Raindrop.io
+func fetch_trash(token RaindropToken) ([]Raindrop, error) {
+	trash := []Raindrop{}
+	for page := 0; ; page++ {
+		params := url.Values{
+			"perpage": []string{fmt.Sprint(search_page_size)},
+			"page":    []string{fmt.Sprint(page)},
+		}
+		page_bookmarks, _, err := fetch_bookmarks_page(trash_collection, params, token)
+		if err == nil {
+			err = report_refresh_progress("trash", page+1, 0)
+		}
+		if err != nil {
+			return nil, err
 		}
+		trash = append(trash, page_bookmarks...)
+		if len(page_bookmarks) < search_page_size {
+			return trash, nil
+		}
+	}
+}
 
-		// Add this page's bookmarks to our cache collection
-		page_bookmarks := result["items"].([]interface{})
-		all_bookmarks = append(all_bookmarks, page_bookmarks...)
+// Function for getting one page of bookmarks in a collection from Raindrop.io, together with the total number of bookmarks
+func fetch_bookmarks_page(collection int, params url.Values, token RaindropToken) ([]Raindrop, int, error) {
+	response_body, err := api_get("/raindrops/"+fmt.Sprint(collection), params, token)
+	if err != nil {
+		return nil, 0, err
+	}
+	var result RaindropsResponse
+	if err := decode_response(response_body, &result); err != nil {
+		return nil, 0, err
+	}
+	return result.Items, result.Count, nil
+}
 
-		// If we got fewer bookmarks than requested, we've reached the end
-		if len(page_bookmarks) < perPage {
-			break
+// Function for merging changed bookmarks into the cached ones.
+// Changed bookmarks replace the cached version of themselves, and new bookmarks are put first, like they are when fetching all bookmarks.
+func merge_bookmarks(cached []Raindrop, changed []Raindrop, trashed map[int]bool) []Raindrop {
+	changed_by_id := make(map[int]Raindrop)
+	for _, bookmark := range changed {
+		changed_by_id[bookmark.ID] = bookmark
+	}
+	in_cache := make(map[int]bool)
+	for _, bookmark := range cached {
+		in_cache[bookmark.ID] = true
+	}
+
+	merged := []Raindrop{}
+	for _, bookmark := range changed {
+		if !in_cache[bookmark.ID] && !trashed[bookmark.ID] {
+			merged = append(merged, bookmark)
+			in_cache[bookmark.ID] = true
+		}
+	}
+	for _, bookmark := range cached {
+		if trashed[bookmark.ID] {
+			continue
 		}
+		if changed_bookmark, ok := changed_by_id[bookmark.ID]; ok {
+			bookmark = changed_bookmark
+		}
+		merged = append(merged, bookmark)
+	}
+	return merged
+}
 
-		// Move to the next page
-		page++
+// Function for finding when the most recently updated bookmark was updated
+func newest_update(bookmarks []Raindrop) time.Time {
+	var newest time.Time
+	for _, bookmark := range bookmarks {
+		if update_time := parse_update_time(bookmark.LastUpdate); update_time.After(newest) {
+			newest = update_time
+		}
 	}
+	return newest
+}
 
-	// Create a result object with the same structure as the API response
-	result := map[string]interface{}{
-		"items": all_bookmarks,
+// Function for parsing the lastUpdate of a bookmark, where a missing or invalid value gives the zero time
+func parse_update_time(last_update string) time.Time {
+	update_time, err := time.Parse(time.RFC3339, last_update)
+	if err != nil {
+		return time.Time{}
 	}
+	return update_time
+}
 
-	// Write to cache file
-	result_json, _ := json.Marshal(result)
-	os.WriteFile(cache_filename, result_json, 0666)
+// Function to check if it is time to fetch all bookmarks again, rather than only syncing the changes
+func should_full_sync() bool {
+	// Get full sync interval from config (default: 24 hours)
+	full_sync_interval, err := strconv.ParseFloat(wf.Config.Get("local_cache_full_sync_interval", "24"), 64)
+	if err != nil {
+		full_sync_interval = 24 // Default to 24 hours if parsing fails
+	}
 
-	// If we've updated the bookmarks cache, also update tags and collections
-	if caching == "fetch" {
-		get_tags(token, "fetch")
-		get_collections(token, false, "fetch")
-		get_collections(token, true, "fetch")
+	if full_sync_time, err := cache_storage.Modified("full_sync_timestamp"); err == nil {
+		return time.Since(full_sync_time).Hours() >= full_sync_interval
 	}
+	return true
+}
 
-	return all_bookmarks
+// Function to update the timestamp of when all bookmarks were last fetched
+func update_full_sync_timestamp() {
+	cache_storage.Write("full_sync_timestamp", []byte(time.Now().String()))
+}
+
+// Function for getting when the bookmarks cache was last fetched or synced from Raindrop.io.
+// This is kept apart from when the cache was written, as editing or moving a bookmark also writes the cache without syncing it.
+// A cache from before the timestamp was kept was last synced when it was written.
+func last_sync_time() (time.Time, error) {
+	if sync_time, err := cache_storage.Modified("sync_timestamp"); err == nil {
+		return sync_time, nil
+	}
+	return cache_storage.Modified("bookmarks")
+}
+
+// Function to update the timestamp of when the bookmarks were last fetched or synced
+func update_sync_timestamp() {
+	cache_storage.Write("sync_timestamp", []byte(time.Now().String()))
 }
 
 // Function for searching the local bookmark cache
 func local_search(query string, token RaindropToken, collection int, tag string, descr_in_list bool, favs_first bool) {
-	// Fetch all bookmarks from cache (or from API if no cache exists at all)
-	bookmarks := get_all_bookmarks(token, "trust")
+	local_search_with_full_text(query, token, collection, tag, descr_in_list, favs_first, nil)
+}
+
+// Function for searching the local bookmark cache, where full-text matches from Raindrop.io that the local search didn't find are added after the local results
+func local_search_with_full_text(query string, token RaindropToken, collection int, tag string, descr_in_list bool, favs_first bool, full_text []Raindrop) {
+	// Get the search index of the cached bookmarks (or fetch them from the API if no cache exists at all)
+	index, err := get_search_index(token)
+	if err != nil {
+		log.Printf("Failed to get bookmarks: %v", err)
+	}
 
 	// If we got no bookmarks, show a message and return
-	if len(bookmarks) == 0 {
+	if len(index.Collections) == 0 {
 		wf.NewItem("No bookmarks found in cache").
 			Subtitle("Try refreshing the cache or check your Raindrop.io account").
 			Valid(false)
+		cache_status_item(0)
 		return
 	}
 
 	// Get collection list from cache
-	raindrop_collections := reverse_interface_array(get_collections(token, false, "trust"))
-	raindrop_collections_sublevel := reverse_interface_array(get_collections(token, true, "trust"))
+	raindrop_collections := reverse_collection_array(get_collections(token, false, "trust"))
+	raindrop_collections_sublevel := reverse_collection_array(get_collections(token, true, "trust"))
 
 	// If no query and not searching in a collection or by tag, show default options
 	if query == "" && collection == 0 && tag == "" {
@@ -186,99 +484,58 @@ func local_search(query string, token RaindropToken, collection int, tag string,
 		alfred_item2.Alt().
 			Var("goto", "local_browse").
 			Subtitle("")
+		recently_opened_item()
 	}
 
-	// Filter bookmarks by collection if specified
-	if collection != 0 {
-		filtered_bookmarks := []interface{}{}
-		for _, bookmark := range bookmarks {
-			bookmark_map := bookmark.(map[string]interface{})
-			if bookmark_map["collection"] != nil {
-				collection_map := bookmark_map["collection"].(map[string]interface{})
-				if collection_map["$id"] != nil && int(collection_map["$id"].(float64)) == collection {
-					filtered_bookmarks = append(filtered_bookmarks, bookmark)
-				}
-			}
+	// Show the status of the cache when nothing has been searched for yet, where it doesn't take the place of the best match
+	if query == "" {
+		cache_status_item(len(index.Collections))
+	}
+
+	// Only read the bookmarks in the collection if specified (and its subcollections if they are included), that can match the query, also with a typo or two
+	collections := searched_collections(collection, raindrop_collections_sublevel)
+	frecency := frecency_scores()
+	alternatives := index.term_alternatives(query)
+	bookmarks, err := read_candidates(index, query, collections, alternatives, tag, frecency)
+	if err != nil {
+		// The cache was refreshed after the index was read, so search the new one instead
+		log.Printf("Failed to read bookmarks from the search index: %v", err)
+		if index, err = get_search_index(token); err == nil {
+			alternatives = index.term_alternatives(query)
+			bookmarks, _ = read_candidates(index, query, collections, alternatives, tag, frecency)
 		}
-		bookmarks = filtered_bookmarks
 	}
 
 	// Filter bookmarks by tag if specified
 	if tag != "" {
-		filtered_bookmarks := []interface{}{}
+		filtered_bookmarks := []Raindrop{}
 		for _, bookmark := range bookmarks {
-			bookmark_map := bookmark.(map[string]interface{})
-			if bookmark_map["tags"] != nil {
-				tags := bookmark_map["tags"].([]interface{})
-				for _, t := range tags {
-					if strings.ToLower(t.(string)) == strings.ToLower(tag) {
-						filtered_bookmarks = append(filtered_bookmarks, bookmark)
-						break
-					}
+			for _, t := range bookmark.Tags {
+				if normalize_text(t) == normalize_text(tag) {
+					filtered_bookmarks = append(filtered_bookmarks, bookmark)
+					break
 				}
 			}
 		}
 		bookmarks = filtered_bookmarks
 	}
 
-	// Filter bookmarks by query if specified
+	// Filter bookmarks by query if specified, and sort them with the best matches first
 	if query != "" {
-		filtered_bookmarks := []interface{}{}
-		query_lower := strings.ToLower(query)
-		for _, bookmark := range bookmarks {
-			bookmark_map := bookmark.(map[string]interface{})
-
-			// Check title
-			title := ""
-			if bookmark_map["title"] != nil {
-				title = strings.ToLower(bookmark_map["title"].(string))
-			}
-
-			// Check excerpt
-			excerpt := ""
-			if bookmark_map["excerpt"] != nil {
-				excerpt = strings.ToLower(bookmark_map["excerpt"].(string))
-			}
-
-			// Check URL
-			link := ""
-			if bookmark_map["link"] != nil {
-				link = strings.ToLower(bookmark_map["link"].(string))
-			}
-
-			// Check tags
-			tags_str := ""
-			if bookmark_map["tags"] != nil {
-				tags := bookmark_map["tags"].([]interface{})
-				for _, t := range tags {
-					tags_str += strings.ToLower(t.(string)) + " "
-				}
-			}
-
-			// If any field contains the query, add the bookmark to results
-			if strings.Contains(title, query_lower) ||
-				strings.Contains(excerpt, query_lower) ||
-				strings.Contains(link, query_lower) ||
-				strings.Contains(tags_str, query_lower) {
-				filtered_bookmarks = append(filtered_bookmarks, bookmark)
-			}
-		}
-		bookmarks = filtered_bookmarks
+		bookmarks = rank_bookmarks_fuzzy(bookmarks, query, alternatives, frecency)
 	}
+	bookmarks = append(bookmarks, missing_bookmarks(bookmarks, full_text)...)
 
 	var current_object []string
 	collection_names := collection_paths(raindrop_collections, raindrop_collections_sublevel, make(map[int]string), 0, current_object, -1)
 
-	var render_favourites string = "all"
-
-	// Prepare favourites for being viewed in Alfred (if favourites_first is enabled)
+	// Put favourites first (if favourites_first is enabled), over the local results and full-text matches together
 	if favs_first {
-		render_results(bookmarks, "only", collection_names, descr_in_list)
-		render_favourites = "none"
+		bookmarks = favourites_first(bookmarks)
 	}
 
-	// Prepare the rest of the results (or all results if favourites_first is disabled) for being viewed in Alfred
-	render_results(bookmarks, render_favourites, collection_names, descr_in_list)
+	// Prepare the results for being viewed in Alfred
+	render_results(bookmarks, "all", collection_names, descr_in_list)
 
 	// If no results after filtering, show a message
 	if len(bookmarks) == 0 {
@@ -289,6 +546,8 @@ func local_search(query string, token RaindropToken, collection int, tag string,
 
 	// Always show collections and tags at the bottom when doing a local cache search
 	if collection == 0 && tag == "" {
+		first_item := len(wf.Feedback.Items)
+
 		// Render collections
 		var current_object []string
 		render_collections(raindrop_collections, raindrop_collections_sublevel, "paths", "searching", 0, current_object, -1, "", "", "local")
@@ -297,23 +556,71 @@ func local_search(query string, token RaindropToken, collection int, tag string,
 		raindrop_tags := get_tags(token, "trust")
 
 		// Render tags
-		for _, item_interface := range raindrop_tags {
-			item := item_interface.(map[string]interface{})
-			alfred_item := wf.NewItem(item["_id"].(string)).
-				Var("current_tag", item["_id"].(string)).
+		for _, item := range raindrop_tags {
+			alfred_item := wf.NewItem(item.ID).
+				Var("current_tag", item.ID).
 				Var("goto", "local_tag").
 				Valid(true).
 				Icon(&aw.Icon{Value: "tag.png", Type: ""})
 			alfred_item.Alt().
-				Var("current_tag", item["_id"].(string)).
+				Var("current_tag", item.ID).
 				Var("goto", "local_tag").
 				Subtitle("")
 		}
+
+		// Only keep the collections and tags that match the query
+		if query != "" {
+			filter_items_from(first_item, query)
+		}
+	}
+}
+
+// The most bookmarks that are read from the cache for a search, as reading all bookmarks that contain a common word takes far longer than the search itself
+const local_search_max_results = 200
+
+// Function for reading the bookmarks from the search index that can match a query in the given collections.
+// When nothing but search terms is searched for, only the best matches are read. Operators and tags are checked on the bookmarks after they are read,
+// so all candidates are read for those, as they could otherwise filter out all of the best matches.
+func read_candidates(index *SearchIndex, query string, collections map[int]bool, alternatives TermAlternatives, tag string, frecency map[int]int) ([]Raindrop, error) {
+	docs := index.fuzzy_candidates(query, collections, alternatives)
+	if tag == "" && parse_query(query).has_only_terms() {
+		docs = index.best_candidates(docs, query, alternatives, frecency, local_search_max_results)
+	}
+	return index.bookmarks(docs)
+}
+
+// Function for removing the items from the given position and on whose names don't contain every word of the search terms in a query.
+// If the query only has operators, all of them are removed, as the operators only apply to bookmarks.
+func filter_items_from(first_item int, query string) {
+	var words []string
+	// The terms of a parsed query are already normalized
+	for _, term := range parse_query(query).Terms {
+		words = append(words, split_words(term)...)
+	}
+	kept := wf.Feedback.Items[:first_item]
+	for i := first_item; i < len(wf.Feedback.Items); i++ {
+		name := normalize_text(wf.Feedback.Keywords(i))
+		matches := len(words) > 0
+		for _, word := range words {
+			if !strings.Contains(name, word) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			kept = append(kept, wf.Feedback.Items[i])
+		}
 	}
+	wf.Feedback.Items = kept
 }
 
 // Main function for handling local search command from Alfred
 func local_search_command(variant string, query string, collection_json string, tag string, from string, descr_in_list bool, favs_first bool) {
+	run_local_search_command(variant, query, collection_json, tag, from, descr_in_list, favs_first, local_search)
+}
+
+// Function for running a search of the local cache, with the items for going back from a collection or tag before the results of the search function
+func run_local_search_command(variant string, query string, collection_json string, tag string, from string, descr_in_list bool, favs_first bool, search_function func(query string, token RaindropToken, collection int, tag string, descr_in_list bool, favs_first bool)) {
 	// Try to read token, and initiate authentication mechanism if it fails
 	token := read_token()
 	if token.Error != "" {
@@ -321,12 +628,10 @@ func local_search_command(variant string, query string, collection_json string,
 		return
 	}
 
-	// Check if token has expired
-	time_location, _ := time.LoadLocation("UTC")
-	time_format := "2006-01-02 15:04:05"
-	token_time, err := time.Parse(time_format, token.CreationTime)
-	if err != nil || time.Now().In(time_location).Sub(token_time).Milliseconds() > int64(token.Expires) {
-		init_auth()
+	// Refresh the token if it has expired, and only ask the user to authenticate again if that isn't possible
+	token, err := token_manager.valid(token)
+	if errors.Is(err, err_unauthorized) {
+		reauthenticate()
 		return
 	}
 
@@ -392,7 +697,7 @@ func local_search_command(variant string, query string, collection_json string,
 	}
 
 	// Search the local cache
-	local_search(query, token, collection_search_id, tag, descr_in_list, favs_first)
+	search_function(query, token, collection_search_id, tag, descr_in_list, favs_first)
 
 	// Check if the cache needs to be refreshed and spawn a background process if needed
 	check_and_refresh_cache()
@@ -410,6 +715,9 @@ func local_browse(query string, full_collection_paths bool) {
 	alfred_item.Alt().
 		Var("goto", "back").
 		Subtitle("⬅︎ Go back to search all bookmarks")
+	if query == "" {
+		cache_status_item(-1)
+	}
 	alfred_item2 := wf.NewItem("Unsorted").
 		Var("collection_info", "{\"icon\":\"folder.png\",\"id\":\"-1\",\"name\":\"Unsorted\"}").
 		Var("goto", "local_collection").
@@ -420,18 +728,19 @@ func local_browse(query string, full_collection_paths bool) {
 		Var("collection_info", "{\"icon\":\"folder.png\",\"id\":\"-1\",\"name\":\"Unsorted\"}").
 		Var("goto", "local_collection").
 		Subtitle("")
+	trash_browse_item("local")
 
 	render_style := "tree"
 	if full_collection_paths {
 		render_style = "paths"
 	}
 
-	var raindrop_collections []interface{}
-	var raindrop_collections_sublevel []interface{}
+	var raindrop_collections []Collection
+	var raindrop_collections_sublevel []Collection
 
 	// Get collection list
-	raindrop_collections = reverse_interface_array(get_collections(token, false, "trust"))
-	raindrop_collections_sublevel = reverse_interface_array(get_collections(token, true, "trust"))
+	raindrop_collections = reverse_collection_array(get_collections(token, false, "trust"))
+	raindrop_collections_sublevel = reverse_collection_array(get_collections(token, true, "trust"))
 
 	// Render collections
 	var current_object []string
@@ -447,22 +756,20 @@ func local_browse(query string, full_collection_paths bool) {
 
 // Function to check if the cache needs to be refreshed
 func should_refresh_cache() bool {
-	var cache_filename string = wf.CacheDir() + "/bookmarks.json"
-
-	// Get cache refresh interval from config (default: 24 hours)
-	refresh_interval_str := wf.Config.Get("local_cache_refresh_interval", "24")
+	// Get cache refresh interval from config (default: 1 hour)
+	refresh_interval_str := wf.Config.Get("local_cache_refresh_interval", "1")
 	refresh_interval, err := strconv.ParseFloat(refresh_interval_str, 64)
 	if err != nil {
-		refresh_interval = 24 // Default to 24 hours if parsing fails
+		refresh_interval = 1 // Default to 1 hour if parsing fails
 	}
 
-	// Check if cache file exists and if it's older than the refresh interval
-	if cache_file_stat, err := os.Stat(cache_filename); err == nil {
-		if time.Since(cache_file_stat.ModTime()).Hours() >= refresh_interval {
+	// Check if the cache exists and if it's older than the refresh interval
+	if cache_time, err := last_sync_time(); err == nil {
+		if time.Since(cache_time).Hours() >= refresh_interval {
 			return true
 		}
 	} else {
-		// Cache file doesn't exist
+		// Cache doesn't exist
 		return true
 	}
 
@@ -475,8 +782,9 @@ func spawn_background_refresh() {
 	update_background_refresh_timestamp()
 
 	// Start a background process to refresh the cache
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("nohup ./raindrop_alfred background_refresh > /dev/null 2>&1 & disown"))
-	cmd.Start()
+	if err := start_refresh_process(); err != nil {
+		log.Printf("Failed to start the background refresh: %v", err)
+	}
 }
 
 // Function to handle background refresh of the cache
@@ -487,33 +795,30 @@ func background_refresh_cache() {
 		return // Can't authenticate in the background
 	}
 
-	// Check if token has expired
-	time_location, _ := time.LoadLocation("UTC")
-	time_format := "2006-01-02 15:04:05"
-	token_time, err := time.Parse(time_format, token.CreationTime)
-	if err != nil || time.Now().In(time_location).Sub(token_time).Milliseconds() > int64(token.Expires) {
+	// Refresh the token if it has expired
+	token, err := token_manager.valid(token)
+	if err != nil {
 		return // Can't authenticate in the background
 	}
 
 	// Check token lifetime and refresh if needed
 	check_token_lifetime(token)
 
-	// Force refresh the caches.
-	// Unfortunately, there is no way of only getting bookmarks that where changed after the last refresh.
-	// New bookmarks would be possible to get this way, but then we would not get changes to existing ones.
-	// For that reason, we are simply refetching all bookmarks, with a default to only do it once per day to not overload the Raindrop.io API.
-	// Note: get_all_bookmarks will also refresh tags and collections when called with "fetch"
-	get_all_bookmarks(token, "fetch")
+	// Sync the caches.
+	// Only bookmarks that have changed since the last refresh are fetched, which is cheap enough to do often.
+	// Bookmarks that have been deleted permanently can't be found this way, so all bookmarks are still refetched once in a while (default once per day).
+	// Note: get_all_bookmarks will also refresh tags and collections when called with "sync"
+	if _, err := run_refresh(token, "sync"); err != nil && !errors.Is(err, err_refresh_running) {
+		log.Printf("Background refresh of the cache failed: %v", err)
+	}
 }
 
 // Function to check if a background refresh was triggered recently (within the last minute)
 func was_background_refresh_triggered_recently() bool {
-	var timestamp_filename string = wf.CacheDir() + "/background_refresh_timestamp.txt"
-
-	// Check if timestamp file exists
-	if timestamp_file_stat, err := os.Stat(timestamp_filename); err == nil {
+	// Check if the timestamp exists
+	if timestamp, err := cache_storage.Modified("background_refresh_timestamp"); err == nil {
 		// Check if the timestamp is less than 1 minute old
-		if time.Since(timestamp_file_stat.ModTime()).Seconds() < 60 {
+		if time.Since(timestamp).Seconds() < 60 {
 			return true
 		}
 	}
@@ -523,20 +828,21 @@ func was_background_refresh_triggered_recently() bool {
 
 // Function to update the background refresh timestamp
 func update_background_refresh_timestamp() {
-	var timestamp_filename string = wf.CacheDir() + "/background_refresh_timestamp.txt"
-
-	// Create or update the timestamp file
-	os.WriteFile(timestamp_filename, []byte(time.Now().String()), 0666)
+	// Create or update the timestamp
+	cache_storage.Write("background_refresh_timestamp", []byte(time.Now().String()))
 }
 
 // Function to check if the cache needs to be refreshed and spawn a background process if needed
 func check_and_refresh_cache() {
 	// Check if the cache needs to be refreshed
 	if should_refresh_cache() {
-		// Check if a background refresh was triggered recently
+		// Check if a background refresh was triggered recently, or is still running
 		if was_background_refresh_triggered_recently() {
 			return // Skip this refresh as one was triggered recently
 		}
+		if _, running := running_refresh_status(); running {
+			return
+		}
 
 		// Try to read token
 		token := read_token()
@@ -548,8 +854,34 @@ func check_and_refresh_cache() {
 	}
 }
 
-// Function to force refresh the local cache
-func refresh_local_cache() {
+// Function to force refresh the local cache.
+// The query can be "cancel" for stopping a refresh that is running, and anything else only shows the status of the refresh,
+// so that a refresh isn't started for every letter that is typed after the keyword.
+func refresh_local_cache(query string) {
+	query = strings.TrimSpace(query)
+	if query == "cancel" {
+		if cancelled, err := cancel_refresh(); err != nil {
+			wf.NewItem("Failed to cancel the refresh").
+				Subtitle(err.Error()).
+				Valid(false)
+		} else if cancelled {
+			wf.NewItem("The refresh of the local cache has been cancelled").
+				Subtitle("The cache keeps the bookmarks it had before the refresh").
+				Valid(false)
+		} else {
+			wf.NewItem("The local cache is not being refreshed").
+				Valid(false)
+		}
+		return
+	}
+	if status, running := running_refresh_status(); running || query != "" {
+		if !running {
+			status, _ = read_refresh_status()
+		}
+		show_refresh_status(status, running)
+		return
+	}
+
 	// Try to read token, and initiate authentication mechanism if it fails
 	token := read_token()
 	if token.Error != "" {
@@ -557,12 +889,10 @@ func refresh_local_cache() {
 		return
 	}
 
-	// Check if token has expired
-	time_location, _ := time.LoadLocation("UTC")
-	time_format := "2006-01-02 15:04:05"
-	token_time, err := time.Parse(time_format, token.CreationTime)
-	if err != nil || time.Now().In(time_location).Sub(token_time).Milliseconds() > int64(token.Expires) {
-		init_auth()
+	// Refresh the token if it has expired, and only ask the user to authenticate again if that isn't possible
+	token, err := token_manager.valid(token)
+	if errors.Is(err, err_unauthorized) {
+		reauthenticate()
 		return
 	}
 
@@ -571,10 +901,94 @@ func refresh_local_cache() {
 
 	// Force refresh all caches
 	// Note: get_all_bookmarks will also refresh tags and collections when called with "fetch"
-	get_all_bookmarks(token, "fetch")
+	status, err := run_refresh(token, "fetch")
+	switch {
+	case errors.Is(err, err_refresh_running):
+		// Another refresh started after the check above
+		status, _ := running_refresh_status()
+		show_refresh_status(status, true)
+	case errors.Is(err, err_refresh_cancelled):
+		wf.NewItem("The refresh of the local cache was cancelled").
+			Subtitle("The cache keeps the bookmarks it had before the refresh").
+			Valid(false)
+	case err != nil:
+		wf.NewItem("Failed to refresh the local caches").
+			Subtitle(err.Error()).
+			Valid(false)
+	default:
+		// Show what the cache contains now, to confirm the refresh
+		wf.NewItem("Local caches have been refreshed").
+			Subtitle(fmt.Sprintf("The cache now contains %s bookmarks, with the latest tags and collections from Raindrop.io", format_count(status.Bookmarks))).
+			Valid(false)
+	}
+}
 
-	// Show a message to confirm the refresh
-	wf.NewItem("Local caches have been refreshed").
-		Subtitle("The caches now contain the latest bookmarks, tags, and collections from Raindrop.io").
-		Valid(false)
+// Function for refreshing the local cache when asked to from the cache status item, where the status of the refresh is shown in the searches rather than here
+func force_refresh_cache() {
+	token := read_token()
+	if token.Error != "" {
+		return
+	}
+	token, err := token_manager.valid(token)
+	if err != nil {
+		log.Printf("Failed to refresh the token: %v", err)
+		return
+	}
+	if _, err := run_refresh(token, "fetch"); err != nil {
+		log.Printf("Refresh of the cache failed: %v", err)
+	}
+}
+
+// Function for showing an item with how many bookmarks there are in the local cache, when it was last synced, and how a refresh is going.
+// The number of bookmarks is read from the search index if it isn't given (as -1).
+// Actioning the item refreshes the cache.
+func cache_status_item(bookmark_count int) {
+	if bookmark_count < 0 {
+		bookmark_count = 0
+		if index, err := load_search_index(); err == nil {
+			bookmark_count = len(index.Collections)
+		}
+	}
+	title := "Cache: " + format_count(bookmark_count) + " bookmarks"
+	if bookmark_count == 1 {
+		title = "Cache: 1 bookmark"
+	}
+	if cache_time, err := last_sync_time(); err == nil {
+		title += ", synced " + format_age(time.Since(cache_time))
+	} else {
+		title += ", not synced yet"
+	}
+
+	subtitle := "Press enter to refresh the cache now"
+	if status, running := running_refresh_status(); running {
+		title += ", " + describe_refresh_progress(status)
+		subtitle = describe_refresh_status(status)
+	} else if status, err := read_refresh_status(); err == nil && status.LastError != "" {
+		title += ", last refresh failed"
+		subtitle = status.LastError + " (" + format_age(time.Since(status.LastErrorTime)) + "). Press enter to try again"
+	}
+
+	alfred_item := wf.NewItem(title).
+		Var("goto", "refresh").
+		Subtitle(subtitle).
+		Valid(true)
+	alfred_item.Alt().
+		Var("goto", "refresh").
+		Subtitle(subtitle)
+}
+
+// Function for showing the status of the latest refresh of the local cache
+func show_refresh_status(status RefreshStatus, running bool) {
+	if running {
+		wf.NewItem("The local cache is being refreshed").
+			Subtitle(describe_refresh_status(status) + ". Type \"rr cancel\" to stop it.").
+			Valid(false)
+	} else if status.Phase != "" {
+		wf.NewItem("The local cache is not being refreshed").
+			Subtitle("Latest refresh: " + describe_refresh_status(status)).
+			Valid(false)
+	} else {
+		wf.NewItem("The local cache has not been refreshed yet").
+			Valid(false)
+	}
 }
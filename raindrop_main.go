@@ -13,8 +13,11 @@ import (
 
 var wf *aw.Workflow
 
-func init() {
+// Set up the workflow, the token storage and the cache storage from the Alfred environment
+func init_workflow() {
 	wf = aw.New()
+	token_store = wf.Keychain
+	cache_storage = open_cache_storage()
 }
 
 func run() {
@@ -58,8 +61,26 @@ func run() {
 	if f == "local_search" {
 		local_search_command(variant, query, wf.Config.Get("collection_info", ""), tags, wf.Config.Get("from", ""), descr_in_list, favs_first)
 	}
+	if f == "hybrid_search" {
+		hybrid_search_command(variant, query, wf.Config.Get("collection_info", ""), tags, wf.Config.Get("from", ""), descr_in_list, favs_first)
+	}
+	if f == "recent" {
+		recently_opened(query, descr_in_list)
+	}
+	if f == "trash" {
+		browse_trash(query, descr_in_list)
+	}
+	if f == "restore_to" {
+		select_restore_collection(query, full_collection_paths)
+	}
+	if f == "move_to" {
+		select_move_collection(query, full_collection_paths)
+	}
+	if f == "confirm_empty_trash" {
+		confirm_empty_trash()
+	}
 	if f == "refresh_cache" {
-		refresh_local_cache()
+		refresh_local_cache(query)
 	}
 	if f == "browse" {
 		browse(query, full_collection_paths)
@@ -76,6 +97,9 @@ func run() {
 	if f == "set_title" {
 		set_title(title)
 	}
+	if f == "set_excerpt" {
+		set_excerpt(query)
+	}
 	if f == "set_tags" {
 		set_tags(tags)
 	}
@@ -84,12 +108,20 @@ func run() {
 }
 
 func main() {
+	init_workflow()
+
 	if os.Args[1] == "authserver" {
 		// If the first argument is "authserver", start the authserver
 		authserver()
 	} else if os.Args[1] == "background_refresh" {
 		// If the first argument is "background_refresh", refresh the cache in the background
 		background_refresh_cache()
+	} else if os.Args[1] == "force_refresh" {
+		// If the first argument is "force_refresh", refresh the cache right away, which is done when the cache status item is actioned
+		force_refresh_cache()
+	} else if os.Args[1] == "cancel_refresh" {
+		// If the first argument is "cancel_refresh", stop a refresh of the cache that is running
+		cancel_refresh()
 	} else if os.Args[1] == "save_bookmark" {
 		// If the first argument is "save_bookmark", then go and save the bookmark
 		var tags string
@@ -97,6 +129,22 @@ func main() {
 		flagSet.StringVar(&tags, "tags", "", "Comma separated bookmark tags")
 		flagSet.Parse(os.Args[2:])
 		save_bookmark(tags)
+	} else if os.Args[1] == "open" {
+		// If the first argument is "open", log the bookmark that is opened, and pass its link on to the browser
+		var link string
+		flagSet := flag.NewFlagSet("", flag.ExitOnError)
+		flagSet.StringVar(&link, "query", "", "Link of the bookmark that is opened")
+		flagSet.Parse(os.Args[2:])
+		open_bookmark(link)
+	} else if os.Args[1] == "restore" {
+		// If the first argument is "restore", move a bookmark from the trash back to a collection
+		restore_bookmark()
+	} else if os.Args[1] == "move" {
+		// If the first argument is "move", move a bookmark to another collection
+		move_bookmark()
+	} else if os.Args[1] == "empty_trash" {
+		// If the first argument is "empty_trash", permanently delete the bookmarks in the trash
+		empty_trash()
 	} else if os.Args[1] == "logout" {
 		// If the first argument is "logout", remove the token from the Keychain
 		logout()
@@ -0,0 +1,99 @@
+/*
+	Moving a bookmark from the search results to another collection, which is also done in the local cache right away
+
+	By Andreas Westerlind, 2025
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	aw "github.com/deanishe/awgo"
+)
+
+// Function for adding the cmd+shift modifier to a bookmark in the search results, which lets the user select a collection to move the bookmark to
+func add_move_modifier(alfred_item *aw.Item, bookmark Raindrop) {
+	alfred_item.NewModifier(aw.ModCmd, aw.ModShift).
+		Arg(bookmark.Title).
+		Var("goto", "move_to").
+		Var("move_id", fmt.Sprint(bookmark.ID)).
+		Subtitle("Move this bookmark to another collection")
+}
+
+// Function for listing the collections that a bookmark can be moved to
+func select_move_collection(query string, full_collection_paths bool) {
+	token := read_token()
+
+	alfred_item := wf.NewItem("Move to Unsorted").
+		Var("goto", "move").
+		Var("move_collection", "-1").
+		Subtitle("Or select a collection below").
+		Valid(true).
+		Icon(&aw.Icon{Value: "folder.png", Type: ""})
+	alfred_item.Alt().
+		Var("goto", "move").
+		Var("move_collection", "-1").
+		Subtitle("Or select a collection below")
+
+	render_style := "tree"
+	if full_collection_paths {
+		render_style = "paths"
+	}
+	raindrop_collections := reverse_collection_array(get_collections(token, false, "check"))
+	raindrop_collections_sublevel := reverse_collection_array(get_collections(token, true, "check"))
+	var current_object []string
+	render_collections(raindrop_collections, raindrop_collections_sublevel, render_style, "moving", 0, current_object, -1, "", "", "")
+
+	if query != "" {
+		wf.Filter(query)
+	}
+}
+
+// Function for handling the move command, which moves the bookmark in the move_id variable to the collection in the move_collection variable.
+// The bookmark is moved in the local cache as well, so that it is found in its new collection by the local browser without waiting for the next refresh,
+// which leaves where the next sync continues from as it was.
+// What is printed is shown to the user as a notification.
+func move_bookmark() {
+	id, err := strconv.Atoi(wf.Config.Get("move_id", ""))
+	if err != nil || id <= 0 {
+		log.Printf("Invalid bookmark to move: %q", wf.Config.Get("move_id", ""))
+		fmt.Print("Could not move the bookmark, as it wasn't known which bookmark to move")
+		return
+	}
+	collection, err := strconv.Atoi(wf.Config.Get("move_collection", "-1"))
+	if err != nil || collection == 0 {
+		collection = -1
+	}
+
+	bookmark, err := move_raindrop(id, collection, read_token())
+	if err != nil {
+		log.Printf("Failed to move bookmark %d: %v", id, err)
+		fmt.Print("Could not move the bookmark")
+		return
+	}
+	if err := update_cached_bookmark(bookmark); err != nil {
+		log.Printf("Failed to move the bookmark in the local cache: %v", err)
+	}
+	fmt.Print(bookmark.Title)
+}
+
+// Function for moving a bookmark to a collection at Raindrop.io, which returns the bookmark as it is after being moved
+func move_raindrop(id int, collection int, token RaindropToken) (Raindrop, error) {
+	response_body, err := api_send("PUT", "/raindrop/"+fmt.Sprint(id), token, map[string]interface{}{
+		"collection": RaindropRef{Ref: "collections", ID: collection},
+	})
+	if err != nil {
+		return Raindrop{}, err
+	}
+	var result RaindropResponse
+	if err := decode_response(response_body, &result); err != nil {
+		return Raindrop{}, err
+	}
+	if !result.Result {
+		return Raindrop{}, fmt.Errorf("unexpected response from Raindrop.io: %s", response_body)
+	}
+	return result.Item, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectMoveCollection(t *testing.T) {
+	setup_test_workflow(t)
+	select_move_collection("rust", true)
+	output := feedback_json()
+	if !strings.Contains(output, `"title":"Dev/Rust"`) || !strings.Contains(output, `"move_collection":"1003"`) || !strings.Contains(output, `"goto":"move"`) || strings.Contains(output, "Recipes") {
+		t.Errorf("Unexpected collections: %s", output)
+	}
+}
+
+func TestMoveModifier(t *testing.T) {
+	setup_test_workflow(t)
+	render_results([]Raindrop{{ID: 3, Title: "Fluffy pancakes"}}, "all", nil, false)
+	if output := feedback_json(); !strings.Contains(output, `"cmd+shift":{"arg":"Fluffy pancakes","subtitle":"Move this bookmark to another collection","variables":{"bookmark_id":"3","goto":"move_to","move_id":"3"}}`) {
+		t.Errorf("Unexpected modifier: %s", output)
+	}
+}
+
+func TestMoveBookmark(t *testing.T) {
+	fake := setup_test_workflow(t)
+	// Fill the local cache
+	local_search_command("standard", "", "", "", "", false, true)
+
+	t.Setenv("move_id", "3")
+	t.Setenv("move_collection", "1003")
+	if output := capture_output(t, move_bookmark); output != "Fluffy pancakes" {
+		t.Errorf("Unexpected output: %s", output)
+	}
+	if bookmarks := fake.bookmarks_in(1003); len(bookmarks) != 2 || bookmarks[1].ID != 3 {
+		t.Errorf("Expected the bookmark to be moved at Raindrop.io, got %v", bookmarks)
+	}
+	if requests := strings.Join(fake.request_log(), "\n"); !strings.Contains(requests, `PUT /rest/v1/raindrop/3 {"collection":{"$ref":"collections","$id":1003}}`) {
+		t.Errorf("Unexpected requests: %s", requests)
+	}
+
+	// The local cache has the bookmark in its new collection right away, without a refresh
+	fake.make_unreachable("/rest/v1/raindrops/")
+	wf.Feedback.Clear()
+	local_search("", read_token(), 1003, "", false, true)
+	if output := feedback_json(); !strings.Contains(output, `"title":"Fluffy pancakes"`) {
+		t.Errorf("Expected the moved bookmark in its new collection, got %s", output)
+	}
+	wf.Feedback.Clear()
+	local_search("", read_token(), 2001, "", false, true)
+	if output := feedback_json(); strings.Contains(output, `"title":"Fluffy pancakes"`) {
+		t.Errorf("Expected the moved bookmark to be gone from its old collection, got %s", output)
+	}
+}
+
+func TestMoveBookmarkFailed(t *testing.T) {
+	fake := setup_test_workflow(t)
+	t.Setenv("move_id", "")
+	if output := capture_output(t, move_bookmark); output != "Could not move the bookmark, as it wasn't known which bookmark to move" {
+		t.Errorf("Unexpected output: %s", output)
+	}
+	if requests := fake.request_log(); len(requests) != 0 {
+		t.Errorf("Expected nothing to be sent to Raindrop.io, got %v", requests)
+	}
+
+	t.Setenv("move_id", "12345")
+	t.Setenv("move_collection", "1003")
+	if output := capture_output(t, move_bookmark); output != "Could not move the bookmark" {
+		t.Errorf("Unexpected output: %s", output)
+	}
+}
+
+func TestMoveBookmarkKeepsSyncPosition(t *testing.T) {
+	fake := setup_test_workflow(t)
+	if _, err := run_refresh(read_token(), "fetch"); err != nil {
+		t.Fatal(err)
+	}
+	synced, _ := last_sync_time()
+
+	// A change at Raindrop.io after the sync, but before the move
+	fake.update_raindrop(1, time.Now().Add(-time.Minute).UTC().Format(time.RFC3339), func(raindrop *Raindrop) {
+		raindrop.Title = "Go generics"
+	})
+	t.Setenv("move_id", "3")
+	t.Setenv("move_collection", "1003")
+	capture_output(t, move_bookmark)
+
+	if sync_time, _ := last_sync_time(); !sync_time.Equal(synced) {
+		t.Errorf("Expected the move not to count as a sync, got %v instead of %v", sync_time, synced)
+	}
+	if _, err := run_refresh(read_token(), "sync"); err != nil {
+		t.Fatal(err)
+	}
+	bookmarks, _ := get_all_bookmarks(read_token(), "trust")
+	for _, bookmark := range bookmarks {
+		if (bookmark.ID == 1 && bookmark.Title != "Go generics") || (bookmark.ID == 3 && bookmark.Collection.ID != 1003) {
+			t.Errorf("Expected the changes made before and by the move to be synced, got %+v", bookmark)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+/*
+	Text of the bookmarked pages for the local search, which is fetched in the background when the cache is refreshed,
+	so that the local search can find bookmarks by what the pages say, also when Raindrop.io can't be reached
+
+	By Andreas Westerlind, 2025
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// How much of the text of each page is kept, in bytes
+const page_text_max_length = 20000
+
+// How much of each page is downloaded at most, so that a huge page or file doesn't have to be downloaded in full
+const page_download_max_size = 2 << 20
+
+// How many pages are fetched in each refresh, so that a refresh doesn't take too long when there are many bookmarks without text yet
+const page_text_batch_size = 200
+
+// How long to wait before trying again to fetch a page that didn't give any text
+const page_text_retry_after = 7 * 24 * time.Hour
+
+// The text of a bookmarked page, and the link that it was fetched from
+type PageText struct {
+	Link    string    `json:"link"`
+	Fetched time.Time `json:"fetched"`
+	Text    string    `json:"text,omitempty"`
+}
+
+// Elements that don't have any of the readable text of a page
+var page_skipped_elements = map[string]bool{
+	"head": true, "script": true, "style": true, "noscript": true, "template": true, "svg": true,
+	"nav": true, "header": true, "footer": true, "aside": true, "form": true, "button": true, "select": true, "iframe": true,
+}
+
+// Skipped elements that the HTML tokenizer takes everything up to the end tag of as text, without looking for other tags in it
+var page_raw_text_elements = map[string]bool{
+	"script": true, "style": true, "noscript": true, "iframe": true,
+}
+
+// An element that is skipped, with the text in it that is kept aside in case the element is never closed
+type SkippedElement struct {
+	name  string
+	texts []PageTextPart
+	// The rest of the page, if the element is one that the tokenizer reads as text and it isn't closed
+	raw []byte
+}
+
+type PageTextPart struct {
+	text    string
+	in_main bool
+}
+
+// Function for checking if the text of bookmarked pages should be fetched for the local search, which is turned on with the local_cache_page_text setting
+func is_page_text_enabled() bool {
+	return wf.Config.Get("local_cache_page_text", "0") == "1"
+}
+
+// Function for getting the text of the bookmarked pages for the search index, which is empty when fetching it isn't turned on
+func indexed_page_texts() map[int]PageText {
+	if !is_page_text_enabled() {
+		return nil
+	}
+	return read_page_texts()
+}
+
+func read_page_texts() map[int]PageText {
+	page_texts := make(map[int]PageText)
+	if data, _, err := cache_storage.Read("page_texts"); err == nil {
+		json.Unmarshal(data, &page_texts)
+	}
+	return page_texts
+}
+
+// Function for fetching the text of the pages that there is no text for yet, and updating the search index with it.
+// The text of the newest bookmarks is kept first, until the cache size that the page_text_cache_size setting allows (in MB, default 50) has been reached.
+func update_page_texts(token RaindropToken, bookmarks []Raindrop) error {
+	max_size_mb, err := strconv.ParseFloat(wf.Config.Get("page_text_cache_size", "50"), 64)
+	if err != nil {
+		max_size_mb = 50
+	}
+	max_size := int(max_size_mb * (1 << 20))
+
+	// Keep the text of the pages that are still bookmarked with the same link, and find the pages that should be fetched
+	cached := read_page_texts()
+	page_texts := make(map[int]PageText)
+	var to_fetch []Raindrop
+	size := 0
+	for _, bookmark := range bookmarks {
+		page_text, found := cached[bookmark.ID]
+		if found && page_text.Link == bookmark.Link && (page_text.Text != "" || time.Since(page_text.Fetched) < page_text_retry_after) {
+			size += len(page_text.Text)
+			if size > max_size {
+				break
+			}
+			page_texts[bookmark.ID] = page_text
+			continue
+		}
+		if len(to_fetch) >= page_text_batch_size {
+			// Left for the next refresh
+			continue
+		}
+		// Room is kept for the longest text that a page can give
+		size += page_text_max_length
+		if size > max_size {
+			break
+		}
+		to_fetch = append(to_fetch, bookmark)
+	}
+	if len(to_fetch) == 0 && len(page_texts) == len(cached) {
+		return nil
+	}
+
+	err = fetch_page_texts(token, to_fetch, page_texts)
+
+	// Also save the pages that were fetched before a refresh was cancelled, so that they don't have to be fetched again
+	page_texts_json, _ := json.Marshal(page_texts)
+	if write_err := cache_storage.Write("page_texts", page_texts_json); write_err != nil {
+		return write_err
+	}
+	if err != nil {
+		return err
+	}
+	_, err = rebuild_search_index(page_texts)
+	return err
+}
+
+// Function for fetching the text of several pages at the same time, and adding it to page_texts
+func fetch_page_texts(token RaindropToken, bookmarks []Raindrop, page_texts map[int]PageText) error {
+	workers, err := strconv.Atoi(wf.Config.Get("local_cache_fetch_workers", "4"))
+	if err != nil || workers < 1 {
+		workers = 4
+	}
+	if err := report_refresh_progress("pages", 0, len(bookmarks)); err != nil {
+		return err
+	}
+
+	var mutex sync.Mutex
+	var first_err error
+	var pages_done int32
+	var wait sync.WaitGroup
+	jobs := make(chan Raindrop)
+	for worker := 0; worker < workers; worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for bookmark := range jobs {
+				page_text := PageText{Link: bookmark.Link, Fetched: time.Now(), Text: fetch_page_text(token, bookmark)}
+				err := report_refresh_progress("pages", int(atomic.AddInt32(&pages_done, 1)), len(bookmarks))
+
+				mutex.Lock()
+				page_texts[bookmark.ID] = page_text
+				if err != nil && first_err == nil {
+					first_err = err
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, bookmark := range bookmarks {
+		mutex.Lock()
+		stop := first_err != nil
+		mutex.Unlock()
+		if stop {
+			break
+		}
+		jobs <- bookmark
+	}
+	close(jobs)
+	wait.Wait()
+	return first_err
+}
+
+// Function for getting the readable text of a bookmarked page.
+// If the page itself can't be fetched, the permanent copy at Raindrop.io is used, if there is one.
+func fetch_page_text(token RaindropToken, bookmark Raindrop) string {
+	text, err := download_page_text(bookmark.Link)
+	if err == nil && text != "" {
+		return text
+	}
+	if bookmark.Cache != nil && bookmark.Cache.Status == "ready" {
+		copy_data, copy_err := api_get(fmt.Sprintf("/raindrop/%d/cache", bookmark.ID), nil, token)
+		if copy_err == nil {
+			return extract_page_text(copy_data)
+		}
+		err = copy_err
+	}
+	if err != nil {
+		log.Printf("Failed to get the text of %s: %v", bookmark.Link, err)
+	}
+	return text
+}
+
+func download_page_text(link string) (string, error) {
+	client := &http.Client{Timeout: 15 * time.Second}
+	request, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("User-Agent", "Alfred (Macintosh; Mac OS X)")
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response: %s", response.Status)
+	}
+
+	content_type, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if content_type != "" && content_type != "text/html" && content_type != "application/xhtml+xml" && content_type != "text/plain" {
+		// Files like PDFs and images don't have any text that can be read here
+		return "", nil
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, page_download_max_size))
+	if err != nil {
+		return "", err
+	}
+	if content_type == "text/plain" {
+		return limit_page_text(strings.Join(strings.Fields(string(data)), " ")), nil
+	}
+	return extract_page_text(data), nil
+}
+
+// Function for getting the readable text of an HTML page, without menus, scripts and such.
+// If the page marks where its main content is, only that is used.
+func extract_page_text(page []byte) string {
+	all_text, main_text := page_text_parts(page, 0)
+	if len(main_text) > 0 {
+		return limit_page_text(strings.Join(main_text, " "))
+	}
+	return limit_page_text(strings.Join(all_text, " "))
+}
+
+// Function for getting all the text of an HTML page, and the text in its main content, where main_depth tells if the page starts inside the main content.
+// The text of a skipped element is kept aside until the element ends, so that a skipped element that is never closed doesn't take the rest of the page with it.
+func page_text_parts(page []byte, main_depth int) ([]string, []string) {
+	tokenizer := html.NewTokenizer(bytes.NewReader(page))
+	var all_text, main_text []string
+	var skipped []*SkippedElement
+	add_text := func(part PageTextPart) {
+		all_text = append(all_text, part.text)
+		if part.in_main {
+			main_text = append(main_text, part.text)
+		}
+	}
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			// The skipped elements that are still open were never closed, so what is in them is part of the page after all
+			for _, element := range skipped {
+				for _, part := range element.texts {
+					add_text(part)
+				}
+				if element.raw != nil {
+					raw_all_text, raw_main_text := page_text_parts(element.raw, main_depth)
+					all_text = append(all_text, raw_all_text...)
+					main_text = append(main_text, raw_main_text...)
+				}
+			}
+			return all_text, main_text
+		case html.StartTagToken:
+			name, _ := tokenizer.TagName()
+			if page_skipped_elements[string(name)] {
+				skipped = append(skipped, &SkippedElement{name: string(name)})
+			}
+			if string(name) == "main" || string(name) == "article" {
+				main_depth++
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			// The end tag closes the innermost skipped element with the same name, together with those inside it, and a stray end tag is left alone
+			for i := len(skipped) - 1; i >= 0; i-- {
+				if skipped[i].name == string(name) {
+					skipped = skipped[:i]
+					break
+				}
+			}
+			if (string(name) == "main" || string(name) == "article") && main_depth > 0 {
+				main_depth--
+			}
+		case html.TextToken:
+			if len(skipped) > 0 && page_raw_text_elements[skipped[len(skipped)-1].name] {
+				skipped[len(skipped)-1].raw = append([]byte{}, tokenizer.Raw()...)
+				continue
+			}
+			words := strings.Fields(string(tokenizer.Text()))
+			if len(words) == 0 {
+				continue
+			}
+			part := PageTextPart{text: strings.Join(words, " "), in_main: main_depth > 0}
+			if len(skipped) > 0 {
+				skipped[len(skipped)-1].texts = append(skipped[len(skipped)-1].texts, part)
+				continue
+			}
+			add_text(part)
+		}
+	}
+}
+
+// Function for cutting a text down to the length that is kept of each page, without cutting a character in half
+func limit_page_text(text string) string {
+	if len(text) <= page_text_max_length {
+		return text
+	}
+	end := page_text_max_length
+	for end > 0 && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	return text[:end]
+}
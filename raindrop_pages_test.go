@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExtractPageText(t *testing.T) {
+	page := `<html><head><title>Title</title><style>body { color: red }</style></head>
+		<body><header>Logo</header><nav><a href="/">Home</a></nav>
+		<article><h1>Ownership</h1><p>Every value has an <em>owner</em> &amp; a   scope.</p><script>track()</script></article>
+		<footer>Copyright</footer></body></html>`
+	if text := extract_page_text([]byte(page)); text != "Ownership Every value has an owner & a scope." {
+		t.Errorf("Unexpected text: %q", text)
+	}
+
+	// Without an article or main element, all text outside of menus and such is used
+	page = `<html><body><nav>Menu</nav><div>First</div><p>Second</p></body></html>`
+	if text := extract_page_text([]byte(page)); text != "First Second" {
+		t.Errorf("Unexpected text: %q", text)
+	}
+
+	// A skipped element that is never closed doesn't take the rest of the page with it
+	for page, expected := range map[string]string{
+		`<html><body><script>var a = 1;<p>First</p><p>Second</p></body></html>`:                "var a = 1; First Second",
+		`<html><body><style>p { color: red }<article><p>Main text</p></article></body></html>`: "Main text",
+		`<html><body><p>Before</p><nav>Menu<p>After</p></body></html>`:                         "Before Menu After",
+		`<html><body><nav>Menu<script>var a = 1;</script><p>Text</p></body></html>`:            "Menu Text",
+		`<html><body><p>Before</p><script>var a = 1;</script><p>After</p></body></html>`:       "Before After",
+		`<html><body><nav>Menu</footer><p>Text</p></body></html>`:                              "Menu Text",
+		`<html><body><nav>Menu<aside>Links</nav><p>Text</p></body></html>`:                     "Text",
+	} {
+		if text := extract_page_text([]byte(page)); text != expected {
+			t.Errorf("Unexpected text for %s: %q, expected %q", page, text, expected)
+		}
+	}
+
+	// A long text is cut without breaking a character in half
+	page = "<p>" + strings.Repeat("å", page_text_max_length) + "</p>"
+	if text := extract_page_text([]byte(page)); len(text) != page_text_max_length || !strings.HasSuffix(text, "å") {
+		t.Errorf("Unexpected length of text: %d", len(text))
+	}
+}
+
+func TestLocalSearchNotesAndHighlights(t *testing.T) {
+	fake := setup_test_workflow(t)
+	fake.update_raindrop(4, "2025-01-01T00:00:00.000Z", func(raindrop *Raindrop) {
+		raindrop.Note = "Check the comments about sourdough"
+	})
+	fake.update_raindrop(2, "2025-01-01T00:00:00.000Z", func(raindrop *Raindrop) {
+		raindrop.Highlights = []Highlight{{ID: "h1", Text: "The borrow checker", Note: "Read again before the meetup"}}
+	})
+	get_all_bookmarks(read_token(), "fetch")
+
+	for query, expected := range map[string]string{"sourdough": "Hacker News", "borrow checker": "The Rust Programming Language", "meetup": "The Rust Programming Language"} {
+		wf.Feedback.Clear()
+		local_search_command("standard", query, "", "", "", false, true)
+		if !strings.Contains(item_json(wf.Feedback.Items[0]), expected) {
+			t.Errorf("Expected %q to find %q", query, expected)
+		}
+	}
+}
+
+func TestLocalSearchPageText(t *testing.T) {
+	fake := setup_test_workflow(t)
+	t.Setenv("local_cache_page_text", "1")
+	token := read_token()
+	fake.page_text[2] = "A chapter about ownership and lifetimes"
+	fake.page_text[1] = "Type parameters let functions work with many types"
+	fake.update_raindrop(2, "2025-01-01T00:00:00.000Z", func(raindrop *Raindrop) {
+		raindrop.Link = fake.server.URL + "/pages/2"
+	})
+	// The page of this bookmark can't be fetched, but Raindrop.io has a permanent copy of it
+	fake.update_raindrop(1, "2025-01-01T00:00:00.000Z", func(raindrop *Raindrop) {
+		raindrop.Link = fake.server.URL + "/pages/missing"
+		raindrop.Cache = &PageCache{Status: "ready"}
+	})
+	for _, id := range []int{3, 4} {
+		fake.update_raindrop(id, "2025-01-01T00:00:00.000Z", func(raindrop *Raindrop) {
+			raindrop.Link = fake.server.URL + "/pages/missing"
+		})
+	}
+	get_all_bookmarks(token, "fetch")
+
+	// The text of the pages is fetched by the background refreshes
+	if _, err := run_refresh(token, "sync"); err != nil {
+		t.Fatal(err)
+	}
+	page_texts := read_page_texts()
+	if page_texts[2].Text != "A chapter about ownership and lifetimes" || page_texts[1].Text != "Type parameters let functions work with many types" {
+		t.Errorf("Unexpected page texts: %+v", page_texts)
+	}
+	for query, expected := range map[string]string{"lifetimes": "The Rust Programming Language", "type parameters": "Golang generics tutorial"} {
+		wf.Feedback.Clear()
+		local_search_command("standard", query, "", "", "", false, true)
+		if !strings.Contains(item_json(wf.Feedback.Items[0]), expected) {
+			t.Errorf("Expected %q to find %q", query, expected)
+		}
+	}
+
+	// Pages that have been fetched aren't fetched again
+	requests := len(fake.request_log())
+	if _, err := run_refresh(token, "sync"); err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range fake.request_log()[requests:] {
+		if strings.Contains(request, "/pages/2") || strings.Contains(request, "/cache") {
+			t.Errorf("A page was fetched again: %s", request)
+		}
+	}
+
+	// Without the setting, the text of the pages isn't searched
+	t.Setenv("local_cache_page_text", "0")
+	get_all_bookmarks(token, "fetch")
+	wf.Feedback.Clear()
+	local_search_command("standard", "lifetimes", "", "", "", false, true)
+	if strings.Contains(item_json(wf.Feedback.Items[0]), "The Rust Programming Language") {
+		t.Error("The text of a page was searched without local_cache_page_text")
+	}
+}
+
+func TestPageTextCacheSize(t *testing.T) {
+	fake := setup_test_workflow(t)
+	t.Setenv("local_cache_page_text", "1")
+	// Only room for the text of one page, which is kept for the newest bookmark
+	t.Setenv("page_text_cache_size", "0.03")
+	for id := 1; id <= 4; id++ {
+		fake.page_text[id] = "Text of the page"
+		fake.update_raindrop(id, "2025-01-01T00:00:00.000Z", func(raindrop *Raindrop) {
+			raindrop.Link = fmt.Sprintf("%s/pages/%d", fake.server.URL, raindrop.ID)
+		})
+	}
+	token := read_token()
+	bookmarks, _ := get_all_bookmarks(token, "fetch")
+	if _, err := run_refresh(token, "sync"); err != nil {
+		t.Fatal(err)
+	}
+	page_texts := read_page_texts()
+	if len(page_texts) != 1 || page_texts[bookmarks[0].ID].Text != "Text of the page" {
+		t.Errorf("Expected only the text of bookmark %d to be kept, got %+v", bookmarks[0].ID, page_texts)
+	}
+}
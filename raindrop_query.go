@@ -0,0 +1,251 @@
+/*
+	Parsing of the Raindrop.io search syntax, for using the same operators in the local search as in the search at Raindrop.io
+
+	By Andreas Westerlind, 2025
+*/
+
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A search query that has been split up into search terms and operators
+type LocalQuery struct {
+	// Words and quoted phrases that have to be found in a bookmark, and that are used for ranking the results
+	Terms []string
+	// Words and quoted phrases that must not be found in a bookmark
+	ExcludedTerms []string
+	// #tag and -#tag
+	Tags         []string
+	ExcludedTags []string
+	// site:example.com and -site:example.com
+	Sites         []string
+	ExcludedSites []string
+	// type:article, where several types can be given like type:article|video
+	Types         [][]string
+	ExcludedTypes []string
+	// ❤️ or is:fav, where the bookmark must be a favourite, and -❤️ or -is:fav where it must not
+	Favourite    bool
+	NotFavourite bool
+	// created:>2024-01-01, created:<2024-01-01 and created:2024-01-01, where the date can also be only a year and month, or a year
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// Function for parsing a search query that uses the Raindrop.io search syntax
+func parse_query(query string) LocalQuery {
+	var parsed LocalQuery
+	for _, token := range split_query(query) {
+		negated := false
+		if len(token) > 1 && strings.HasPrefix(token, "-") {
+			negated = true
+			token = token[1:]
+		}
+		lower := normalize_text(token)
+
+		switch {
+		case lower == "-" || lower == "#" || lower == "site:" || lower == "type:" || lower == "is:" || lower == "created:":
+			// An operator that hasn't been written yet is ignored, so that the results don't disappear while typing it
+		case strings.HasPrefix(lower, "#") && len(lower) > 1:
+			tag := unquote(lower[1:])
+			if negated {
+				parsed.ExcludedTags = append(parsed.ExcludedTags, tag)
+			} else {
+				parsed.Tags = append(parsed.Tags, tag)
+			}
+		case strings.HasPrefix(lower, "site:") && len(lower) > len("site:"):
+			site := strings.TrimPrefix(unquote(lower[len("site:"):]), "www.")
+			if negated {
+				parsed.ExcludedSites = append(parsed.ExcludedSites, site)
+			} else {
+				parsed.Sites = append(parsed.Sites, site)
+			}
+		case strings.HasPrefix(lower, "type:") && len(lower) > len("type:"):
+			types := strings.Split(unquote(lower[len("type:"):]), "|")
+			if negated {
+				parsed.ExcludedTypes = append(parsed.ExcludedTypes, types...)
+			} else {
+				parsed.Types = append(parsed.Types, types)
+			}
+		case lower == "is:fav" || strings.TrimRight(lower, "\ufe0f") == "\u2764":
+			if negated {
+				parsed.NotFavourite = true
+			} else {
+				parsed.Favourite = true
+			}
+		case strings.HasPrefix(lower, "created:") && parse_created(&parsed, lower[len("created:"):]):
+			// The date has been parsed into the query
+		default:
+			// Anything else is a search term, also if it looks like an operator that couldn't be parsed
+			term := unquote(lower)
+			if term == "" {
+				continue
+			}
+			if negated {
+				parsed.ExcludedTerms = append(parsed.ExcludedTerms, term)
+			} else {
+				parsed.Terms = append(parsed.Terms, term)
+			}
+		}
+	}
+	return parsed
+}
+
+// Function for splitting a search query by whitespace, except for whitespace that is inside quotes
+func split_query(query string) []string {
+	var tokens []string
+	var current strings.Builder
+	in_quotes := false
+	for _, r := range query {
+		if r == '"' {
+			in_quotes = !in_quotes
+		}
+		if unicode.IsSpace(r) && !in_quotes {
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+			continue
+		}
+		current.WriteRune(r)
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+func unquote(text string) string {
+	return strings.TrimSpace(strings.ReplaceAll(text, `"`, ""))
+}
+
+// Function for parsing the value of created:, and returns false if it isn't a date
+func parse_created(parsed *LocalQuery, value string) bool {
+	comparison := ""
+	if strings.HasPrefix(value, ">") || strings.HasPrefix(value, "<") {
+		comparison = value[:1]
+		value = value[1:]
+	}
+
+	// The date is a whole period, where the start and end of it depends on how precisely it is given
+	var start, end time.Time
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		start, end = date, date.AddDate(0, 0, 1)
+	} else if date, err := time.Parse("2006-01", value); err == nil {
+		start, end = date, date.AddDate(0, 1, 0)
+	} else if date, err := time.Parse("2006", value); err == nil {
+		start, end = date, date.AddDate(1, 0, 0)
+	} else {
+		return false
+	}
+
+	switch comparison {
+	case ">":
+		parsed.CreatedAfter = end
+	case "<":
+		parsed.CreatedBefore = start
+	default:
+		parsed.CreatedAfter = start
+		parsed.CreatedBefore = end
+	}
+	return true
+}
+
+// Function for checking if a search query has search terms and no operators, which means that whether a bookmark matches it only depends on the terms
+func (query LocalQuery) has_only_terms() bool {
+	return len(query.Terms) > 0 && len(query.ExcludedTerms) == 0 &&
+		len(query.Tags) == 0 && len(query.ExcludedTags) == 0 &&
+		len(query.Sites) == 0 && len(query.ExcludedSites) == 0 &&
+		len(query.Types) == 0 && len(query.ExcludedTypes) == 0 &&
+		!query.Favourite && !query.NotFavourite &&
+		query.CreatedAfter.IsZero() && query.CreatedBefore.IsZero()
+}
+
+// Function for checking if a bookmark fulfills all the operators of a search query, and doesn't contain any of the excluded terms.
+// The search terms are not checked here, as that is done when scoring the bookmark.
+func (query LocalQuery) matches(bookmark Raindrop, fields SearchFields) bool {
+	if query.Favourite && !bookmark.Important {
+		return false
+	}
+	if query.NotFavourite && bookmark.Important {
+		return false
+	}
+
+	for _, tag := range query.Tags {
+		if !has_tag(bookmark, tag) {
+			return false
+		}
+	}
+	for _, tag := range query.ExcludedTags {
+		if has_tag(bookmark, tag) {
+			return false
+		}
+	}
+
+	for _, site := range query.Sites {
+		if !is_on_site(fields.Domain, site) {
+			return false
+		}
+	}
+	for _, site := range query.ExcludedSites {
+		if is_on_site(fields.Domain, site) {
+			return false
+		}
+	}
+
+	for _, types := range query.Types {
+		if !contains_string(types, normalize_text(bookmark.Type)) {
+			return false
+		}
+	}
+	if contains_string(query.ExcludedTypes, normalize_text(bookmark.Type)) {
+		return false
+	}
+
+	if !query.CreatedAfter.IsZero() || !query.CreatedBefore.IsZero() {
+		created, err := time.Parse(time.RFC3339, bookmark.Created)
+		if err != nil {
+			return false
+		}
+		if !query.CreatedAfter.IsZero() && created.Before(query.CreatedAfter) {
+			return false
+		}
+		if !query.CreatedBefore.IsZero() && !created.Before(query.CreatedBefore) {
+			return false
+		}
+	}
+
+	for _, term := range query.ExcludedTerms {
+		if score_term(fields, term) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func has_tag(bookmark Raindrop, tag string) bool {
+	for _, bookmark_tag := range bookmark.Tags {
+		if normalize_text(bookmark_tag) == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Function for checking if a domain is the given site, or a subdomain of it
+func is_on_site(domain string, site string) bool {
+	domain = strings.TrimPrefix(domain, "www.")
+	return domain == site || strings.HasSuffix(domain, "."+site)
+}
+
+func contains_string(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
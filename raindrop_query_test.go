@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	parsed := parse_query(`Go -java "generics tutorial" -"old news" #golang -#"c sharp" site:www.Go.dev -site:example.com type:article|video -type:link is:fav created:>2024-01`)
+	expected := LocalQuery{
+		Terms:         []string{"go", "generics tutorial"},
+		ExcludedTerms: []string{"java", "old news"},
+		Tags:          []string{"golang"},
+		ExcludedTags:  []string{"c sharp"},
+		Sites:         []string{"go.dev"},
+		ExcludedSites: []string{"example.com"},
+		Types:         [][]string{{"article", "video"}},
+		ExcludedTypes: []string{"link"},
+		Favourite:     true,
+		CreatedAfter:  time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("Unexpected result:\n%+v\nexpected:\n%+v", parsed, expected)
+	}
+}
+
+func TestParseQueryNotOperators(t *testing.T) {
+	// Operators without a value are ignored, and operators with a value that can't be parsed are searched for as they are
+	parsed := parse_query("site: created:yesterday # - -❤️")
+	expected := LocalQuery{
+		Terms:        []string{"created:yesterday"},
+		NotFavourite: true,
+	}
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("Unexpected result:\n%+v\nexpected:\n%+v", parsed, expected)
+	}
+}
+
+func TestRankBookmarksOperators(t *testing.T) {
+	fake := setup_test_workflow(t)
+	bookmarks := fake.raindrop_data
+
+	tests := []struct {
+		query string
+		ids   string
+	}{
+		{"#golang", "1"},
+		{"-#golang", "2,3,4"},
+		{"#golang #rust", ""},
+		{"site:rust-lang.org", "2"},
+		{"site:example.com", "3"},
+		{"-site:example.com -site:go.dev", "2,4"},
+		{"type:article", "1,3"},
+		{"type:document|link", "2,4"},
+		{"-type:article", "2,4"},
+		{"❤️", "1"},
+		{"is:fav generics", "1"},
+		{"-is:fav", "2,3,4"},
+		{"created:>2023-01-01", "1,2"},
+		{"created:<2023", "3,4"},
+		{"created:2022-05", "3"},
+		{"created:2022-05-14", "3"},
+		{"created:2022-05-15", ""},
+		{`"pancake recipe"`, "3"},
+		{`"recipe pancake"`, ""},
+		{"the -rust", "3"},
+		{`-"hacker news" -"programming language" -golang`, "3"},
+		{"type:article learn", "1"},
+	}
+	for _, test := range tests {
+		if ids := bookmark_ids(rank_bookmarks(bookmarks, test.query)); ids != test.ids {
+			t.Errorf("Query %q gave %q, expected %q", test.query, ids, test.ids)
+		}
+	}
+}
+
+func TestLocalSearchOperators(t *testing.T) {
+	fake := setup_test_workflow(t)
+	local_search_command("standard", "#golang is:fav site:go.dev", "", "", "", false, true)
+	check_golden(t, fake, "local_search_operators")
+}
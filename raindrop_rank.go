@@ -0,0 +1,225 @@
+/*
+	Scoring of bookmarks against a search query, for ranking the results of the local search
+
+	By Andreas Westerlind, 2025
+*/
+
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/text/width"
+)
+
+// How much a match in each field of a bookmark is worth, from the most to the least important
+const (
+	weight_title   = 16
+	weight_tags    = 8
+	weight_domain  = 4
+	weight_excerpt = 2
+	weight_notes   = 2
+	weight_path    = 1
+	weight_content = 1
+)
+
+// The text of a bookmark that a search query is matched against, split up in fields that are weighted differently
+type SearchFields struct {
+	Title   string
+	Tags    string
+	Domain  string
+	Excerpt string
+	Notes   string
+	Path    string
+	Content string
+}
+
+// Function for getting the normalized fields of a bookmark that are searched
+func search_fields(bookmark Raindrop) SearchFields {
+	domain := bookmark.Domain
+	if domain == "" {
+		domain = get_hostname(bookmark.Link)
+	}
+	path := ""
+	if link, err := url.Parse(bookmark.Link); err == nil {
+		path = link.Path
+		if link.RawQuery != "" {
+			path += "?" + link.RawQuery
+		}
+	}
+	// The note of the bookmark and the highlights in the page, with the notes of each highlight
+	notes := []string{bookmark.Note}
+	for _, highlight := range bookmark.Highlights {
+		notes = append(notes, highlight.Text, highlight.Note)
+	}
+	return SearchFields{
+		Title:   normalize_text(bookmark.Title),
+		Tags:    normalize_text(strings.Join(bookmark.Tags, " ")),
+		Domain:  normalize_text(domain),
+		Excerpt: normalize_text(bookmark.Excerpt),
+		Notes:   normalize_text(strings.Join(notes, "\n")),
+		Path:    normalize_text(path),
+		Content: normalize_text(bookmark.PageText),
+	}
+}
+
+// The combining diacritical marks, which are the accents of Latin, Greek and Cyrillic letters.
+// Marks in other scripts, such as the dakuten in Japanese or the vowel signs in Devanagari and Thai, are part of what the letter is, and are kept.
+var combining_diacritics = &unicode.RangeTable{
+	R16: []unicode.Range16{{Lo: 0x0300, Hi: 0x036f, Stride: 1}},
+}
+
+// Function for normalizing a text for matching, so that case, accents and full-width characters don't matter, where both "Café" and "ＣＡＦＥ" become "cafe".
+// Everything that is matched in the local search goes through this, both the bookmarks and what is searched for.
+func normalize_text(text string) string {
+	is_ascii := true
+	for i := 0; i < len(text); i++ {
+		if text[i] >= utf8.RuneSelf {
+			is_ascii = false
+			break
+		}
+	}
+	if is_ascii {
+		// Nothing to do other than lowercasing, which is much faster than the full normalization
+		return strings.ToLower(text)
+	}
+
+	// Fold the width and case, split the characters from their accents and remove the accents, and put together what is left, like Hangul syllables
+	normalizer := transform.Chain(width.Fold, cases.Fold(), norm.NFKD, runes.Remove(runes.In(combining_diacritics)), norm.NFC)
+	normalized, _, err := transform.String(normalizer, text)
+	if err != nil {
+		return strings.ToLower(text)
+	}
+	return normalized
+}
+
+// Function for scoring a bookmark against the terms of a search query.
+// Every term has to match somewhere in the bookmark, otherwise the score is 0.
+// A term that isn't found can be matched by one of its alternatives instead, and the number of terms that were matched like that is returned too.
+func score_bookmark(fields SearchFields, terms []string, alternatives TermAlternatives) (int, int) {
+	score := 0
+	fuzzy_matches := 0
+	for _, term := range terms {
+		term_score := score_term(fields, term)
+		if term_score == 0 && len(alternatives[term]) > 0 {
+			for _, alternative := range alternatives[term] {
+				if alternative_score := score_term(fields, alternative); alternative_score > term_score {
+					term_score = alternative_score
+				}
+			}
+			fuzzy_matches++
+		}
+		if term_score == 0 {
+			return 0, 0
+		}
+		score += term_score
+	}
+	return score, fuzzy_matches
+}
+
+// Function for scoring a single search term against all fields of a bookmark
+func score_term(fields SearchFields, term string) int {
+	return weight_title*match_score(fields.Title, term) +
+		weight_tags*match_score(fields.Tags, term) +
+		weight_domain*match_score(fields.Domain, term) +
+		weight_excerpt*match_score(fields.Excerpt, term) +
+		weight_notes*match_score(fields.Notes, term) +
+		weight_path*match_score(fields.Path, term) +
+		weight_content*match_score(fields.Content, term)
+}
+
+// Function for scoring how well a term matches a text, where the best occurrence of the term counts:
+// 0 if the term isn't found, 1 if it is found inside a word, 2 if it is found at the start of a word, and 3 if it is a whole word.
+// Matching the very start of the text gives one more point.
+func match_score(text string, term string) int {
+	best := 0
+	for offset := 0; offset < len(text); {
+		index := strings.Index(text[offset:], term)
+		if index < 0 {
+			break
+		}
+		start := offset + index
+		end := start + len(term)
+
+		score := 1
+		if is_word_boundary(text, start) {
+			score = 2
+			if is_word_boundary(text, end) {
+				score = 3
+			}
+			if start == 0 {
+				score++
+			}
+		}
+		if score > best {
+			best = score
+		}
+
+		_, size := utf8.DecodeRuneInString(text[start:])
+		offset = start + size
+	}
+	return best
+}
+
+// Function for checking if a position in a text is between a word and something that isn't part of that word
+func is_word_boundary(text string, position int) bool {
+	if position <= 0 || position >= len(text) {
+		return true
+	}
+	before, _ := utf8.DecodeLastRuneInString(text[:position])
+	after, _ := utf8.DecodeRuneInString(text[position:])
+	return is_word_rune(before) != is_word_rune(after)
+}
+
+func is_word_rune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Function for filtering bookmarks by a search query, and sorting them with the best matches first.
+// Bookmarks with the same score keep the order they had, which is also the case for all bookmarks if the query only has operators.
+func rank_bookmarks(bookmarks []Raindrop, query string) []Raindrop {
+	return rank_bookmarks_fuzzy(bookmarks, query, nil, nil)
+}
+
+// Function for ranking bookmarks where the terms of the query can also be matched by similar words, for finding bookmarks despite typos.
+// Bookmarks where every term is found as it is written come before those where one or more terms were matched by an alternative.
+// The score of each bookmark is increased by its frecency, so that bookmarks that are opened often and recently come before others that match as well.
+func rank_bookmarks_fuzzy(bookmarks []Raindrop, query string, alternatives TermAlternatives, frecency map[int]int) []Raindrop {
+	parsed := parse_query(query)
+
+	type scored_bookmark struct {
+		bookmark      Raindrop
+		score         int
+		fuzzy_matches int
+	}
+	var scored []scored_bookmark
+	for _, bookmark := range bookmarks {
+		fields := search_fields(bookmark)
+		if !parsed.matches(bookmark, fields) {
+			continue
+		}
+		if score, fuzzy_matches := score_bookmark(fields, parsed.Terms, alternatives); score > 0 || len(parsed.Terms) == 0 {
+			scored = append(scored, scored_bookmark{bookmark, boost_by_frecency(score, frecency[bookmark.ID]), fuzzy_matches})
+		}
+	}
+	sort.SliceStable(scored, func(i, j int) bool {
+		if scored[i].fuzzy_matches != scored[j].fuzzy_matches {
+			return scored[i].fuzzy_matches < scored[j].fuzzy_matches
+		}
+		return scored[i].score > scored[j].score
+	})
+
+	ranked := []Raindrop{}
+	for _, item := range scored {
+		ranked = append(ranked, item.bookmark)
+	}
+	return ranked
+}
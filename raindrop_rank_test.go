@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMatchScore(t *testing.T) {
+	tests := []struct {
+		text  string
+		term  string
+		score int
+	}{
+		{"golang generics tutorial", "xyz", 0},
+		{"golang generics tutorial", "ene", 1},
+		{"golang generics tutorial", "gen", 2},
+		{"golang generics tutorial", "generics", 3},
+		{"golang generics tutorial", "go", 3},
+		{"golang generics tutorial", "golang", 4},
+		{"learn go, and generics", "go", 3},
+		{"pancakes", "cake", 1},
+	}
+	for _, test := range tests {
+		if score := match_score(test.text, test.term); score != test.score {
+			t.Errorf("match_score(%q, %q) = %d, expected %d", test.text, test.term, score, test.score)
+		}
+	}
+}
+
+func TestRankBookmarks(t *testing.T) {
+	bookmarks := []Raindrop{
+		{ID: 1, Title: "Notes", Excerpt: "Something about rust"},
+		{ID: 2, Title: "Rust book", Link: "https://doc.rust-lang.org/book/"},
+		{ID: 3, Title: "Cooking", Tags: []string{"rust"}},
+		{ID: 4, Title: "Unrelated"},
+		{ID: 5, Title: "Links", Link: "https://example.com/rust"},
+	}
+	if ids := bookmark_ids(rank_bookmarks(bookmarks, "rust")); ids != "2,3,1,5" {
+		t.Errorf("Unexpected ranking: %s", ids)
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	tests := map[string]string{
+		"Go Generics":    "go generics",
+		"Café Crème":     "cafe creme",
+		"ＣＡＦＥ":           "cafe",
+		"Straße":         "strasse",
+		"Ångström":       "angstrom",
+		"ﬁle":            "file",
+		"한국어":            "한국어",
+		"Señor İstanbul": "senor istanbul",
+		"Ελληνικά":       "ελληνικα",
+		"Ёлка":           "елка",
+		"がっこう":           "がっこう",
+		"हिंदी":          "हिंदी",
+		"ไทย":            "ไทย",
+	}
+	for text, expected := range tests {
+		if normalized := normalize_text(text); normalized != expected {
+			t.Errorf("normalize_text(%q) = %q, expected %q", text, normalized, expected)
+		}
+	}
+}
+
+func TestRankBookmarksNormalized(t *testing.T) {
+	bookmarks := []Raindrop{
+		{ID: 1, Title: "Café au lait", Tags: []string{"Crème"}},
+		{ID: 2, Title: "Cafeteria menu"},
+		{ID: 3, Title: "Tea"},
+	}
+	for _, query := range []string{"cafe", "CAFÉ", "ｃａｆｅ"} {
+		if ids := bookmark_ids(rank_bookmarks(bookmarks, query)); ids != "1,2" {
+			t.Errorf("Unexpected ranking for %q: %s", query, ids)
+		}
+	}
+	if ids := bookmark_ids(rank_bookmarks(bookmarks, "#creme")); ids != "1" {
+		t.Errorf("Unexpected result for a tag with an accent: %s", ids)
+	}
+}
+
+func TestRankBookmarksKeepsNonLatinMarks(t *testing.T) {
+	bookmarks := []Raindrop{
+		{ID: 1, Title: "がっこう"},
+		{ID: 2, Title: "かっこう"},
+		{ID: 3, Title: "कल"},
+		{ID: 4, Title: "कुल"},
+	}
+	// The dakuten makes "ga" a different sound than "ka", and a vowel sign a different word
+	if ids := bookmark_ids(rank_bookmarks(bookmarks, "がっこう")); ids != "1" {
+		t.Errorf("Unexpected result with a dakuten: %s", ids)
+	}
+	if ids := bookmark_ids(rank_bookmarks(bookmarks, "かっこう")); ids != "2" {
+		t.Errorf("Unexpected result without a dakuten: %s", ids)
+	}
+	if ids := bookmark_ids(rank_bookmarks(bookmarks, "कल")); ids != "3" {
+		t.Errorf("Unexpected result with a vowel sign: %s", ids)
+	}
+}
+
+func TestRankBookmarksAllTerms(t *testing.T) {
+	bookmarks := []Raindrop{
+		{ID: 1, Title: "Go tutorial"},
+		{ID: 2, Title: "Generics in Go", Tags: []string{"tutorial"}},
+		{ID: 3, Title: "Tutorial for generics", Domain: "go.dev"},
+	}
+	// Every term has to match, but not next to each other or in the same field
+	if ids := bookmark_ids(rank_bookmarks(bookmarks, "go generics tutorial")); ids != "2,3" {
+		t.Errorf("Unexpected ranking: %s", ids)
+	}
+}
+
+func TestLocalSearchRanking(t *testing.T) {
+	fake := setup_test_workflow(t)
+	local_search_command("standard", "go generics tutorial", "", "", "", false, true)
+	check_golden(t, fake, "local_search_ranking")
+}
@@ -0,0 +1,412 @@
+/*
+	Refreshing the local cache, where only one refresh runs at a time, and where a running refresh reports how far it has come and can be cancelled
+
+	By Andreas Westerlind, 2025
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Returned when another process is already refreshing the cache
+var err_refresh_running = errors.New("the local cache is already being refreshed")
+
+// Returned by a refresh that has been cancelled
+var err_refresh_cancelled = errors.New("the refresh of the local cache was cancelled")
+
+// A refresh that hasn't reported any progress for this long is treated as stuck, and another refresh is allowed to take over
+const refresh_stale_after = 10 * time.Minute
+
+// The status of the latest refresh, which is written to the cache directory while refreshing so that other processes can show it
+type RefreshStatus struct {
+	PID int `json:"pid"`
+	// "fetch" when all bookmarks are downloaded, and "sync" when only changes are
+	Mode string `json:"mode"`
+	// What the refresh is doing, which ends as "done", "failed" or "cancelled"
+	Phase string `json:"phase"`
+	// How many pages have been downloaded in this phase, and how many there are in total if that is known
+	Done    int       `json:"done"`
+	Total   int       `json:"total"`
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+	Error   string    `json:"error,omitempty"`
+
+	// What earlier refreshes ended with, which is kept from one refresh to the next
+	LastSuccess   time.Time `json:"last_success,omitempty"`
+	Bookmarks     int       `json:"bookmarks"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time,omitempty"`
+}
+
+// Function for checking if the status is of a refresh that hasn't finished
+func (status RefreshStatus) is_running() bool {
+	return status.Phase != "" && status.Phase != "done" && status.Phase != "failed" && status.Phase != "cancelled"
+}
+
+// A refresh that is running in this process
+type Refresher struct {
+	mutex       sync.Mutex
+	status      RefreshStatus
+	files       *FileStorage
+	cancelled   chan struct{}
+	cancel_once sync.Once
+}
+
+// The refresh that this process is running, if any, which the functions that fetch bookmarks report their progress to
+var current_refresh *Refresher
+
+func refresh_pidfile() string {
+	return filepath.Join(wf.CacheDir(), "refresh.pid")
+}
+
+// The status is stored next to the cache rather than in it, as it is written often, while searches read the cache
+func refresh_status_files() *FileStorage {
+	return &FileStorage{dir: wf.CacheDir()}
+}
+
+// Function for refreshing the local cache in this process, with caching set to "fetch" or "sync" like for get_all_bookmarks.
+// This fails with err_refresh_running if another process is refreshing already, and with err_refresh_cancelled if the refresh is cancelled.
+// The final status of the refresh is returned.
+func run_refresh(token RaindropToken, caching string) (RefreshStatus, error) {
+	refresher, err := start_refresh(caching)
+	if err != nil {
+		return RefreshStatus{}, err
+	}
+	current_refresh = refresher
+	defer func() {
+		current_refresh = nil
+	}()
+
+	// Cancel the refresh if the process is asked to stop, so that it can clean up after itself
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-signals:
+			refresher.cancel()
+		case <-finished:
+		}
+	}()
+
+	bookmarks, err := get_all_bookmarks(token, caching)
+	// The text of the bookmarked pages is only fetched by the background refreshes, as it can take a while
+	if err == nil && caching == "sync" && is_page_text_enabled() {
+		err = update_page_texts(token, bookmarks)
+	}
+	return refresher.finish(len(bookmarks), err), err
+}
+
+// Function for starting a refresh, which takes the pidfile so that no other refresh can start until this one is finished.
+// A pidfile of a process that has died, or that hasn't reported any progress for a long time, is taken over.
+func start_refresh(caching string) (*Refresher, error) {
+	// Only one process at a time checks and takes the pidfile, so that two processes can't both take over the same stale one
+	lock_file, err := os.OpenFile(refresh_pidfile()+".lock", os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer lock_file.Close()
+	if err := flock_with_timeout(lock_file, true); err != nil {
+		return nil, err
+	}
+	defer syscall.Flock(int(lock_file.Fd()), syscall.LOCK_UN)
+
+	if pid, err := read_refresh_pid(); err == nil {
+		if is_refresh_holder_alive(pid) {
+			return nil, err_refresh_running
+		}
+		os.Remove(refresh_pidfile())
+	}
+	pidfile, err := os.OpenFile(refresh_pidfile(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	_, err = pidfile.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	pidfile.Close()
+	if err != nil {
+		os.Remove(refresh_pidfile())
+		return nil, err
+	}
+
+	now := time.Now()
+	previous, _ := read_refresh_status()
+	refresher := &Refresher{
+		status: RefreshStatus{
+			PID:           os.Getpid(),
+			Mode:          caching,
+			Phase:         "starting",
+			Started:       now,
+			Updated:       now,
+			LastSuccess:   previous.LastSuccess,
+			Bookmarks:     previous.Bookmarks,
+			LastError:     previous.LastError,
+			LastErrorTime: previous.LastErrorTime,
+		},
+		files:     refresh_status_files(),
+		cancelled: make(chan struct{}),
+	}
+	refresher.write_status()
+	return refresher, nil
+}
+
+// Function for reading which process holds the pidfile
+func read_refresh_pid() (int, error) {
+	data, err := os.ReadFile(refresh_pidfile())
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pidfile: %q", data)
+	}
+	return pid, nil
+}
+
+// Function for checking if the process holding the pidfile is still refreshing.
+// The process might have died without removing the pidfile, or its process ID might even have been taken by another process since,
+// so the refresh also has to have reported its progress recently.
+func is_refresh_holder_alive(pid int) bool {
+	if !is_process_running(pid) {
+		return false
+	}
+	status, err := read_refresh_status()
+	if err != nil || status.PID != pid {
+		// The status is written right after the pidfile, so a refresh that has only just started might not have one yet
+		pidfile_stat, err := os.Stat(refresh_pidfile())
+		return err == nil && time.Since(pidfile_stat.ModTime()) < refresh_stale_after
+	}
+	return time.Since(status.Updated) < refresh_stale_after
+}
+
+func is_process_running(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	// EPERM means that the process exists, but belongs to someone else
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Function for reading the status of the latest refresh
+func read_refresh_status() (RefreshStatus, error) {
+	var status RefreshStatus
+	data, _, err := refresh_status_files().Read("refresh_status.json")
+	if err != nil {
+		return status, err
+	}
+	err = json.Unmarshal(data, &status)
+	return status, err
+}
+
+// Function for getting the status of a refresh that is running in another process, if there is one
+func running_refresh_status() (RefreshStatus, bool) {
+	pid, err := read_refresh_pid()
+	if err != nil || !is_refresh_holder_alive(pid) {
+		return RefreshStatus{}, false
+	}
+	status, err := read_refresh_status()
+	if err != nil || status.PID != pid {
+		return RefreshStatus{PID: pid, Phase: "starting"}, true
+	}
+	return status, true
+}
+
+// Function for reporting how far the current refresh has come, if this process is refreshing.
+// It returns err_refresh_cancelled if the refresh has been cancelled, which the caller should stop and return.
+func report_refresh_progress(phase string, done int, total int) error {
+	if current_refresh == nil {
+		return nil
+	}
+	return current_refresh.progress(phase, done, total)
+}
+
+func (refresher *Refresher) progress(phase string, done int, total int) error {
+	select {
+	case <-refresher.cancelled:
+		return err_refresh_cancelled
+	default:
+	}
+
+	// Stop if another refresh has taken over, as this one has been treated as stuck
+	if pid, err := read_refresh_pid(); err != nil || pid != os.Getpid() {
+		refresher.cancel()
+		return err_refresh_cancelled
+	}
+
+	refresher.mutex.Lock()
+	defer refresher.mutex.Unlock()
+	// Pages can finish out of order when they are fetched in parallel, so the count never goes back within a phase
+	if phase != refresher.status.Phase || done > refresher.status.Done {
+		refresher.status.Done = done
+	}
+	refresher.status.Phase = phase
+	refresher.status.Total = total
+	refresher.status.Updated = time.Now()
+	refresher.write_status()
+	return nil
+}
+
+func (refresher *Refresher) cancel() {
+	refresher.cancel_once.Do(func() {
+		close(refresher.cancelled)
+	})
+}
+
+// Function for writing the final status of the refresh, with the number of bookmarks in the cache if it succeeded, and releasing the pidfile
+func (refresher *Refresher) finish(bookmark_count int, err error) RefreshStatus {
+	refresher.mutex.Lock()
+	defer refresher.mutex.Unlock()
+	now := time.Now()
+	switch {
+	case err == nil:
+		refresher.status.Phase = "done"
+		refresher.status.LastSuccess = now
+		refresher.status.Bookmarks = bookmark_count
+		refresher.status.LastError = ""
+		refresher.status.LastErrorTime = time.Time{}
+	case errors.Is(err, err_refresh_cancelled):
+		refresher.status.Phase = "cancelled"
+	default:
+		refresher.status.Phase = "failed"
+		refresher.status.Error = err.Error()
+		refresher.status.LastError = err.Error()
+		refresher.status.LastErrorTime = now
+	}
+	refresher.status.Updated = now
+	refresher.write_status()
+
+	// Leave the pidfile alone if another refresh has taken it over
+	if pid, err := read_refresh_pid(); err == nil && pid == os.Getpid() {
+		os.Remove(refresh_pidfile())
+	}
+	return refresher.status
+}
+
+func (refresher *Refresher) write_status() {
+	status_json, _ := json.Marshal(refresher.status)
+	refresher.files.Write("refresh_status.json", status_json)
+}
+
+// Function for cancelling a refresh that is running in another process.
+// It returns false if no refresh is running.
+// The process is only stopped if its status shows that it is the one refreshing, as a pidfile that was left behind might have an ID that now belongs to another process.
+func cancel_refresh() (bool, error) {
+	pid, err := read_refresh_pid()
+	if err != nil {
+		return false, nil
+	}
+	if !is_refresh_holder_alive(pid) {
+		os.Remove(refresh_pidfile())
+		return false, nil
+	}
+	status, err := read_refresh_status()
+	if err != nil || status.PID != pid || !status.is_running() {
+		return false, nil
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Function for starting a refresh in a separate process, which keeps running after Alfred has got the search results.
+// The process gets a session of its own, so that it isn't stopped together with the script that Alfred runs.
+func start_refresh_process() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, "background_refresh")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// Function for describing the status of a refresh for showing it in Alfred
+func describe_refresh_status(status RefreshStatus) string {
+	var description string
+	switch status.Phase {
+	case "starting":
+		description = "Starting"
+	case "bookmarks":
+		description = "Downloading bookmarks"
+	case "changes":
+		description = "Downloading changed bookmarks"
+	case "trash":
+		description = "Checking the trash"
+	case "saving":
+		description = "Saving bookmarks"
+	case "tags":
+		description = "Downloading tags"
+	case "collections":
+		description = "Downloading collections"
+	case "pages":
+		description = "Fetching the text of bookmarked pages"
+	case "done":
+		description = "Finished"
+	case "cancelled":
+		description = "Cancelled"
+	case "failed":
+		description = "Failed: " + status.Error
+	default:
+		description = status.Phase
+	}
+	if status.is_running() && status.Total > 0 {
+		description += fmt.Sprintf(" (page %d of %d)", status.Done, status.Total)
+	} else if status.is_running() && status.Done > 0 {
+		description += fmt.Sprintf(" (page %d)", status.Done)
+	}
+	if !status.Started.IsZero() {
+		description += ", started " + status.Started.Format("15:04:05")
+	}
+	return description
+}
+
+// Function for describing how far a running refresh has come, such as "refreshing 40%"
+func describe_refresh_progress(status RefreshStatus) string {
+	if status.Phase == "bookmarks" && status.Total > 0 {
+		return fmt.Sprintf("refreshing %d%%", status.Done*100/status.Total)
+	}
+	return "refreshing"
+}
+
+// Function for formatting a number with thousands separators, such as 12,340
+func format_count(count int) string {
+	digits := strconv.Itoa(count)
+	var formatted strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			formatted.WriteByte(',')
+		}
+		formatted.WriteRune(digit)
+	}
+	return formatted.String()
+}
+
+// Function for formatting how long ago something happened, such as "3h ago"
+func format_age(since time.Duration) string {
+	switch {
+	case since < time.Minute:
+		return "just now"
+	case since < time.Hour:
+		return fmt.Sprintf("%dm ago", int(since.Minutes()))
+	case since < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(since.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(since.Hours()/24))
+	}
+}
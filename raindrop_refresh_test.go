@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunRefresh(t *testing.T) {
+	fake := setup_test_workflow(t)
+	if _, err := run_refresh(read_token(), "fetch"); err != nil {
+		t.Fatal(err)
+	}
+	status, err := read_refresh_status()
+	if err != nil || status.Phase != "done" || status.Mode != "fetch" || status.PID != os.Getpid() {
+		t.Errorf("Unexpected status after refreshing: %+v, %v", status, err)
+	}
+	if _, err := os.Stat(refresh_pidfile()); !errors.Is(err, os.ErrNotExist) {
+		t.Error("The pidfile was not removed")
+	}
+	if bookmarks, _ := get_all_bookmarks(read_token(), "trust"); len(bookmarks) != len(fake.raindrop_data) {
+		t.Errorf("Expected %d bookmarks in the cache, got %d", len(fake.raindrop_data), len(bookmarks))
+	}
+}
+
+func TestRefreshAlreadyRunning(t *testing.T) {
+	fake := setup_test_workflow(t)
+	write_test_refresh(t, os.Getppid(), time.Now())
+
+	if _, err := run_refresh(read_token(), "sync"); !errors.Is(err, err_refresh_running) {
+		t.Errorf("Expected err_refresh_running, got %v", err)
+	}
+	if pid, _ := read_refresh_pid(); pid != os.Getppid() {
+		t.Errorf("The pidfile of the running refresh was replaced by %d", pid)
+	}
+
+	// rr shows the running refresh instead of starting another one
+	refresh_local_cache("")
+	check_golden(t, fake, "refresh_running")
+}
+
+func TestRefreshTakesOverStalePidfile(t *testing.T) {
+	setup_test_workflow(t)
+
+	// A refresher that has died without removing its pidfile
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Skip("Can't start a process to get the ID of: ", err)
+	}
+	write_test_refresh(t, exited.Process.Pid, time.Now())
+	if _, err := run_refresh(read_token(), "fetch"); err != nil {
+		t.Errorf("The pidfile of a process that has exited was not taken over: %v", err)
+	}
+
+	// A refresher that is still running, but hasn't reported any progress for a long time
+	write_test_refresh(t, os.Getppid(), time.Now().Add(-time.Hour))
+	if _, err := run_refresh(read_token(), "fetch"); err != nil {
+		t.Errorf("The pidfile of a stuck refresh was not taken over: %v", err)
+	}
+}
+
+func TestCancelledRefreshKeepsCache(t *testing.T) {
+	fake := setup_test_workflow(t)
+	token := read_token()
+	get_all_bookmarks(token, "fetch")
+	cached_count := len(fake.raindrop_data)
+	fake.add_generated_raindrops(120)
+
+	refresher, err := start_refresh("fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current_refresh = refresher
+	defer func() {
+		current_refresh = nil
+	}()
+	refresher.cancel()
+	_, err = get_all_bookmarks(token, "fetch")
+	refresher.finish(0, err)
+	if !errors.Is(err, err_refresh_cancelled) {
+		t.Errorf("Expected err_refresh_cancelled, got %v", err)
+	}
+	if status, _ := read_refresh_status(); status.Phase != "cancelled" {
+		t.Errorf("Expected the refresh to be cancelled, got %+v", status)
+	}
+	current_refresh = nil
+	if bookmarks, _ := get_all_bookmarks(token, "trust"); len(bookmarks) != cached_count {
+		t.Errorf("Expected the cache to keep %d bookmarks, got %d", cached_count, len(bookmarks))
+	}
+}
+
+func TestCancelRefreshProcess(t *testing.T) {
+	setup_test_workflow(t)
+	if cancelled, err := cancel_refresh(); cancelled || err != nil {
+		t.Errorf("Expected nothing to cancel, got %v, %v", cancelled, err)
+	}
+
+	refresher := exec.Command("sleep", "30")
+	if err := refresher.Start(); err != nil {
+		t.Skip("Can't start a process to cancel: ", err)
+	}
+	write_test_refresh(t, refresher.Process.Pid, time.Now())
+	if cancelled, err := cancel_refresh(); !cancelled || err != nil {
+		t.Errorf("Expected the refresh to be cancelled, got %v, %v", cancelled, err)
+	}
+	exited := make(chan error)
+	go func() {
+		exited <- refresher.Wait()
+	}()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		refresher.Process.Kill()
+		t.Error("The refreshing process was not stopped")
+	}
+}
+
+func TestCancelRefreshLeavesOtherProcesses(t *testing.T) {
+	setup_test_workflow(t)
+	other := exec.Command("sleep", "30")
+	if err := other.Start(); err != nil {
+		t.Skip("Can't start a process to leave alone: ", err)
+	}
+	defer other.Process.Kill()
+
+	// A pidfile that was left behind by a refresh that crashed long ago, with an ID that now belongs to another process
+	write_test_refresh(t, other.Process.Pid, time.Now().Add(-time.Hour))
+	os.Chtimes(refresh_pidfile(), time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	if cancelled, err := cancel_refresh(); cancelled || err != nil {
+		t.Errorf("Expected nothing to cancel, got %v, %v", cancelled, err)
+	}
+	if _, err := os.Stat(refresh_pidfile()); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale pidfile to be removed, got %v", err)
+	}
+
+	// A refresh that has finished, where the status doesn't belong to the process in the pidfile
+	write_test_refresh(t, os.Getpid(), time.Now())
+	os.WriteFile(refresh_pidfile(), []byte(strconv.Itoa(other.Process.Pid)+"\n"), 0666)
+	if cancelled, err := cancel_refresh(); cancelled || err != nil {
+		t.Errorf("Expected nothing to cancel, got %v, %v", cancelled, err)
+	}
+
+	if err := other.Process.Signal(syscall.Signal(0)); err != nil {
+		t.Errorf("Expected the other process to keep running, got %v", err)
+	}
+}
+
+func TestRefreshProgressCountsPages(t *testing.T) {
+	fake := setup_test_workflow(t)
+	fake.add_generated_raindrops(120)
+	refresher, err := start_refresh("fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current_refresh = refresher
+	defer func() {
+		current_refresh = nil
+	}()
+	// The progress when all pages of bookmarks have been fetched, and the trash is fetched next
+	var status RefreshStatus
+	requests := 0
+	fake.before_page = func(int) {
+		if requests++; requests == 4 {
+			status, _ = read_refresh_status()
+		}
+	}
+	if _, err := fetch_all_bookmarks(read_token(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if status.Phase != "bookmarks" || status.Done != 3 || status.Total != 3 {
+		t.Errorf("Unexpected progress: %+v", status)
+	}
+}
+
+// Writes a pidfile and status like those of a refresh that is running in another process
+func write_test_refresh(t *testing.T, pid int, updated time.Time) {
+	t.Helper()
+	if err := os.WriteFile(refresh_pidfile(), []byte(strconv.Itoa(pid)+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	status_json, _ := json.Marshal(RefreshStatus{
+		PID:     pid,
+		Mode:    "sync",
+		Phase:   "bookmarks",
+		Done:    2,
+		Total:   5,
+		Started: time.Date(2025, 3, 1, 12, 30, 0, 0, time.Local),
+		Updated: updated,
+	})
+	refresh_status_files().Write("refresh_status.json", status_json)
+}
+
+func TestRefreshCacheOutcome(t *testing.T) {
+	fake := setup_test_workflow(t)
+	refresh_local_cache("")
+	check_golden(t, fake, "refresh_cache")
+
+	// A refresh that fails is reported by rr, and by the cache status item
+	wf.Feedback.Clear()
+	fake.server.Close()
+	refresh_local_cache("")
+	if len(wf.Feedback.Items) != 1 || !strings.Contains(item_json(wf.Feedback.Items[0]), "Failed to refresh the local caches") {
+		t.Errorf("Expected the refresh to fail, got %s", item_json(wf.Feedback.Items[0]))
+	}
+	wf.Feedback.Clear()
+	local_browse("", false)
+	if status := item_json(wf.Feedback.Items[1]); !strings.Contains(status, "Cache: 4 bookmarks, synced just now, last refresh failed") || !strings.Contains(status, "could not reach Raindrop.io") {
+		t.Errorf("Unexpected cache status item: %s", status)
+	}
+}
+
+func TestFormatCount(t *testing.T) {
+	for count, expected := range map[int]string{0: "0", 999: "999", 1000: "1,000", 12340: "12,340", 1234567: "1,234,567"} {
+		if formatted := format_count(count); formatted != expected {
+			t.Errorf("Expected %d to be formatted as %s, got %s", count, expected, formatted)
+		}
+	}
+}
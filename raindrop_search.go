@@ -8,6 +8,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -15,6 +18,9 @@ import (
 )
 
 func search(variant string, query string, collection_json string, tag string, from string, descr_in_list bool, favs_first bool) {
+	// Find out how many pages of results to show, which is increased with the "Show more results" item
+	query, pages := parse_pages(query)
+
 	var collection_search bool = false
 	var collection_search_id int = 0
 	var collection_search_name string
@@ -80,31 +86,31 @@ func search(variant string, query string, collection_json string, tag string, fr
 		return
 	}
 
-	var raindrop_results []interface{}
+	var raindrop_results []Raindrop
+	var more_results bool
 
 	var err error
 
 	if query != "" {
 		// Query Raindrop.io
-		raindrop_results, err = search_request(query, token, collection_search_id, tag)
-		if err != nil {
-			new_token := refresh_token(token)
-			if new_token.Error != "" {
-				// Refreshing the token failed, so all we can do now is let the user authenticate again
-				// We will also remove the old token, so that the Workflow knows that an authentication
-				// is needed next time it's initiated
-				wf.Keychain.Delete("raindrop_token")
-				init_auth()
-			} else {
-				// Try to query Raindrop again, and assume it will work now as we just got a fresh new token to authenticate with
-				token = new_token
-				raindrop_results, _ = search_request(query, token, collection_search_id, tag)
-			}
+		// If the token has expired, it is refreshed by the client, and we only end up here if that failed
+		raindrop_results, more_results, err = search_pages(query, token, collection_search_id, tag, pages)
+		if errors.Is(err, err_unauthorized) {
+			reauthenticate()
+			return
+		}
+		if (errors.Is(err, err_network) || errors.Is(err, err_rate_limited)) && len(raindrop_results) == 0 {
+			search_offline(query, token, collection_search_id, tag, descr_in_list, favs_first, err)
+			return
 		}
+		token = token_manager.current(token)
+
+		// Bookmarks that are opened often and recently are moved further up among the results
+		raindrop_results = sort_by_frecency(raindrop_results)
 
 		// Get collection list from cache
-		raindrop_collections := reverse_interface_array(get_collections(token, false, "trust"))
-		raindrop_collections_sublevel := reverse_interface_array(get_collections(token, true, "trust"))
+		raindrop_collections := reverse_collection_array(get_collections(token, false, "trust"))
+		raindrop_collections_sublevel := reverse_collection_array(get_collections(token, true, "trust"))
 
 		// Search for collections and tags that matches the search query, but only if we are not already doing a search in a collection or a tag
 		if !collection_search && !tag_search {
@@ -116,15 +122,14 @@ func search(variant string, query string, collection_json string, tag string, fr
 			raindrop_tags := get_tags(token, "check")
 
 			// Render tags
-			for _, item_interface := range raindrop_tags {
-				item := item_interface.(map[string]interface{})
-				alfred_item := wf.NewItem(item["_id"].(string)).
-					Var("current_tag", item["_id"].(string)).
+			for _, item := range raindrop_tags {
+				alfred_item := wf.NewItem(item.ID).
+					Var("current_tag", item.ID).
 					Var("goto", "tag").
 					Valid(true).
 					Icon(&aw.Icon{Value: "tag.png", Type: ""})
 				alfred_item.Alt().
-					Var("current_tag", item["_id"].(string)).
+					Var("current_tag", item.ID).
 					Var("goto", "tag").
 					Subtitle("")
 			}
@@ -139,7 +144,15 @@ func search(variant string, query string, collection_json string, tag string, fr
 
 		// If we are searching for bookmarks inside a collection or with a specific tag
 		if collection_search || tag_search {
-			raindrop_results, _ = search_request("", token, collection_search_id, tag)
+			raindrop_results, more_results, err = search_pages("", token, collection_search_id, tag, pages)
+			if errors.Is(err, err_unauthorized) {
+				reauthenticate()
+				return
+			}
+			if (errors.Is(err, err_network) || errors.Is(err, err_rate_limited)) && len(raindrop_results) == 0 {
+				search_offline("", token, collection_search_id, tag, descr_in_list, favs_first, err)
+				return
+			}
 		} else {
 			// If we are are in standard search mode
 
@@ -165,13 +178,14 @@ func search(variant string, query string, collection_json string, tag string, fr
 			alfred_item2.Alt().
 				Var("goto", "browse").
 				Subtitle("")
+			recently_opened_item()
 		}
 	}
 
 	if query != "" || collection_search || tag_search {
 		// Get collection list from cache (REVERSING OF THE ARRAYS MIGHT NEED TO BE DONE HERE)
-		raindrop_collections := reverse_interface_array(get_collections(token, false, "check"))
-		raindrop_collections_sublevel := reverse_interface_array(get_collections(token, true, "check"))
+		raindrop_collections := reverse_collection_array(get_collections(token, false, "check"))
+		raindrop_collections_sublevel := reverse_collection_array(get_collections(token, true, "check"))
 
 		var current_object []string
 		collection_names := collection_paths(raindrop_collections, raindrop_collections_sublevel, make(map[int]string), 0, current_object, -1)
@@ -186,6 +200,89 @@ func search(variant string, query string, collection_json string, tag string, fr
 
 		// Prepare the rest of the results (or all results if favourites_first is disabled) for being viewed in Alfred
 		render_results(raindrop_results, render_favourites, collection_names, descr_in_list)
+
+		if err != nil {
+			render_search_error(err)
+		}
+
+		if more_results {
+			more_query := strings.TrimSpace(query + " pages:" + fmt.Sprint(pages+1))
+			alfred_item := wf.NewItem("Show more results").
+				Subtitle("Load the next " + fmt.Sprint(search_page_size) + " bookmarks from Raindrop.io").
+				Autocomplete(more_query).
+				Valid(false)
+			alfred_item.Alt().
+				Subtitle("Load the next " + fmt.Sprint(search_page_size) + " bookmarks from Raindrop.io")
+		}
+	}
+}
+
+var pages_pattern = regexp.MustCompile(`(^|\s)pages:(\d+)\s*$`)
+
+// Function for separating a "pages:N" suffix from the search query.
+// Without it, the number of pages is taken from the search_result_pages setting.
+func parse_pages(query string) (string, int) {
+	pages, err := strconv.Atoi(wf.Config.Get("search_result_pages", "1"))
+	if err != nil || pages < 1 {
+		pages = 1
+	}
+	if match := pages_pattern.FindStringSubmatch(query); match != nil {
+		if requested_pages, err := strconv.Atoi(match[2]); err == nil && requested_pages > 0 {
+			pages = requested_pages
+		}
+		query = strings.TrimSpace(pages_pattern.ReplaceAllString(query, ""))
+	}
+	return query, pages
+}
+
+// Function for getting a number of pages of search results from Raindrop.io.
+// All pages are fetched before anything is rendered, so that favourites can be shown first across all of them.
+func search_pages(query string, token RaindropToken, collection int, tag string, pages int) ([]Raindrop, bool, error) {
+	var results []Raindrop
+	for page := 0; page < pages; page++ {
+		page_results, count, err := search_request(query, token, collection, tag, page)
+		if err != nil {
+			return results, false, err
+		}
+		results = append(results, page_results...)
+		if len(page_results) < search_page_size || len(results) >= count {
+			return results, false, nil
+		}
+	}
+	return results, true, nil
+}
+
+// Function for searching the local cache instead, when Raindrop.io can't be reached, or can't be searched right now because of the rate limit.
+// The token is kept as it is, as it can't be checked until Raindrop.io can be reached again.
+func search_offline(query string, token RaindropToken, collection int, tag string, descr_in_list bool, favs_first bool, err error) {
+	subtitle := "Could not connect to Raindrop.io, so these bookmarks are from the local cache and full-text search is not available"
+	if errors.Is(err, err_rate_limited) {
+		subtitle = "Raindrop.io is receiving too many requests, so these bookmarks are from the local cache and full-text search is not available"
+	}
+	wf.NewItem("Offline: showing cached results").
+		Subtitle(subtitle).
+		Valid(false)
+	local_search(query, token, collection, tag, descr_in_list, favs_first)
+}
+
+// Function for telling the user why a search didn't give any bookmarks
+func render_search_error(err error) {
+	if errors.Is(err, err_no_results) {
+		wf.NewItem("No bookmarks match your search").
+			Subtitle("Try a different search query").
+			Valid(false)
+	} else if errors.Is(err, err_rate_limited) {
+		wf.NewItem("Raindrop.io is receiving too many requests").
+			Subtitle("Wait a moment and try again").
+			Valid(false)
+	} else if errors.Is(err, err_network) {
+		wf.NewItem("Could not connect to Raindrop.io").
+			Subtitle("Check your internet connection and try again").
+			Valid(false)
+	} else {
+		wf.NewItem("Something went wrong while searching Raindrop.io").
+			Subtitle(err.Error()).
+			Valid(false)
 	}
 }
 
@@ -210,18 +307,19 @@ func browse(query string, full_collection_paths bool) {
 		Var("collection_info", "{\"icon\":\"folder.png\",\"id\":\"-1\",\"name\":\"Unsorted\"}").
 		Var("goto", "collection").
 		Subtitle("")
+	trash_browse_item("")
 
 	render_style := "tree"
 	if full_collection_paths {
 		render_style = "paths"
 	}
 
-	var raindrop_collections []interface{}
-	var raindrop_collections_sublevel []interface{}
+	var raindrop_collections []Collection
+	var raindrop_collections_sublevel []Collection
 
 	// Get collection list
-	raindrop_collections = reverse_interface_array(get_collections(token, false, "check"))
-	raindrop_collections_sublevel = reverse_interface_array(get_collections(token, true, "check"))
+	raindrop_collections = reverse_collection_array(get_collections(token, false, "check"))
+	raindrop_collections_sublevel = reverse_collection_array(get_collections(token, true, "check"))
 
 	// Render collections
 	var current_object []string
@@ -0,0 +1,588 @@
+/*
+	Storage for the local caches, which is an embedded database by default, or the JSON files that were used before
+
+	By Andreas Westerlind, 2025
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Returned when nothing has been stored for a key
+var err_not_cached = errors.New("not in the cache")
+
+// Returned when a stored value doesn't match its checksum, such as when it was only partly written.
+// It wraps err_not_cached, so that a damaged value is fetched or built again like a missing one.
+var err_corrupt_cache = fmt.Errorf("%w: the cached value is damaged", err_not_cached)
+
+// Storage for cached data, where each key holds a value and the time it was written
+type CacheStorage interface {
+	// Read returns the value stored for a key, and when it was written
+	Read(key string) ([]byte, time.Time, error)
+	// Modified returns when the value for a key was written, without reading the value
+	Modified(key string) (time.Time, error)
+	// ReadParts returns parts of the value stored for a key, given as start and end positions, without reading all of it.
+	// If a checksum is given, the value must have that checksum, which is checked against its header rather than by reading the whole value.
+	ReadParts(key string, checksum string, parts [][2]int) ([][]byte, error)
+	Write(key string, value []byte) error
+	Delete(key string) error
+}
+
+var cache_storage CacheStorage
+
+// Function for checking if anything has been stored for a key in the cache
+func is_cached(key string) bool {
+	_, err := cache_storage.Modified(key)
+	return err == nil
+}
+
+// Every stored value starts with a header line with the version of the format, the length of the value and its checksum,
+// so that a value that was only partly written, or has been damaged, is detected instead of trusted
+const cache_header_prefix = "raindrop-cache 1 "
+
+// The longest a header can be, with a length of up to 20 digits and a SHA-256 checksum
+const cache_header_max_length = len(cache_header_prefix) + 20 + 1 + 64 + 1
+
+type CacheHeader struct {
+	// The length of the header line itself
+	Size     int
+	Length   int
+	Checksum string
+}
+
+func cache_checksum(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// Function for adding the header to a value before it is stored
+func seal_cache_value(value []byte) []byte {
+	header := fmt.Sprintf("%s%d %s\n", cache_header_prefix, len(value), cache_checksum(value))
+	return append([]byte(header), value...)
+}
+
+// Function for reading the header at the start of a stored value.
+// The returned bool is false if the value has no header, which is the case for caches written by older versions of the workflow.
+func parse_cache_header(data []byte) (CacheHeader, bool, error) {
+	if !bytes.HasPrefix(data, []byte(cache_header_prefix)) {
+		return CacheHeader{}, false, nil
+	}
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		return CacheHeader{}, true, err_corrupt_cache
+	}
+	fields := strings.Fields(string(data[len(cache_header_prefix):end]))
+	if len(fields) != 2 {
+		return CacheHeader{}, true, err_corrupt_cache
+	}
+	length, err := strconv.Atoi(fields[0])
+	if err != nil || length < 0 {
+		return CacheHeader{}, true, err_corrupt_cache
+	}
+	return CacheHeader{Size: end + 1, Length: length, Checksum: fields[1]}, true, nil
+}
+
+// Function for getting a stored value without its header, after checking that it matches its checksum.
+// Values without a header are only accepted if allow_legacy is set.
+func open_cache_value(data []byte, allow_legacy bool) ([]byte, error) {
+	header, has_header, err := parse_cache_header(data)
+	if err != nil {
+		return nil, err
+	}
+	if !has_header {
+		if allow_legacy {
+			return data, nil
+		}
+		return nil, err_corrupt_cache
+	}
+	value := data[header.Size:]
+	if len(value) != header.Length || cache_checksum(value) != header.Checksum {
+		return nil, err_corrupt_cache
+	}
+	return value, nil
+}
+
+// Function for checking the header of a value that is only read in parts, where the whole value has the given size including the header.
+// The checksum of the whole value can't be checked without reading it, so its length, and the checksum in the header if one is expected, are checked instead.
+func check_cache_parts(header CacheHeader, has_header bool, size int, checksum string) error {
+	if !has_header {
+		if checksum != "" {
+			return err_corrupt_cache
+		}
+		return nil
+	}
+	if header.Size+header.Length != size || (checksum != "" && header.Checksum != checksum) {
+		return err_corrupt_cache
+	}
+	return nil
+}
+
+// How long to wait for another process that has locked the cache
+const cache_lock_timeout = 10 * time.Second
+
+// Returned when the cache is locked for writing while this process only has it locked for reading.
+// Turning a shared lock into an exclusive one lets other processes in between, and two processes that both try it wait for each other,
+// so writers lock the cache for writing before they read anything from it.
+var err_cache_lock_upgrade = errors.New("the cache can't be locked for writing while it is locked for reading")
+
+// The advisory lock on the cache directory that this process holds, if any.
+// Locks are counted, so that a function that locks the cache can call other functions that do the same.
+var cache_lock struct {
+	sync.Mutex
+	file      *os.File
+	exclusive bool
+	count     int
+}
+
+// Function for locking the cache while reading or writing several values that belong together, such as the bookmarks and their search index.
+// Readers share the lock, while a writer has to wait for them and keeps everyone else out until it is done.
+// A writer can read and write again while it holds the lock, but a reader can't start writing.
+// The returned function releases the lock.
+func lock_cache(exclusive bool) (func(), error) {
+	cache_lock.Lock()
+	defer cache_lock.Unlock()
+
+	if cache_lock.file == nil {
+		file, err := os.OpenFile(filepath.Join(wf.CacheDir(), "cache.lock"), os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			return nil, err
+		}
+		if err := flock_with_timeout(file, exclusive); err != nil {
+			file.Close()
+			return nil, err
+		}
+		cache_lock.file = file
+		cache_lock.exclusive = exclusive
+	} else if exclusive && !cache_lock.exclusive {
+		return nil, err_cache_lock_upgrade
+	}
+	cache_lock.count++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cache_lock.Lock()
+			defer cache_lock.Unlock()
+			cache_lock.count--
+			if cache_lock.count == 0 {
+				syscall.Flock(int(cache_lock.file.Fd()), syscall.LOCK_UN)
+				cache_lock.file.Close()
+				cache_lock.file = nil
+			}
+		})
+	}, nil
+}
+
+// Function for taking an advisory lock on a file, giving up if another process holds it for longer than the timeout
+func flock_with_timeout(file *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	deadline := time.Now().Add(cache_lock_timeout)
+	for {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) || time.Now().After(deadline) {
+			return fmt.Errorf("failed to lock the cache: %w", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// The file names that each key was stored in, before the cache was moved into a database
+var cache_files = map[string]string{
+	"bookmarks":                    "bookmarks.json",
+	"collections":                  "collections.json",
+	"collections_sublevel":         "collections_sublevel.json",
+	"tags":                         "tags.json",
+	"search_index":                 "bookmarks_index.gob",
+	"search_index_docs":            "bookmarks_index_docs.json",
+	"background_refresh_timestamp": "background_refresh_timestamp.txt",
+	"full_sync_timestamp":          "full_sync_timestamp.txt",
+	"bookmark_info":                "bookmark_info.tmp",
+}
+
+// Function for opening the storage for the local caches, in the cache directory of the workflow.
+// The JSON files are used if cache_storage is set to "files", and otherwise the database, which the JSON files are moved into the first time.
+func open_cache_storage() CacheStorage {
+	files := &FileStorage{dir: wf.CacheDir()}
+	if wf.Config.Get("cache_storage", "database") == "files" {
+		return files
+	}
+
+	database := &BoltStorage{path: wf.CacheDir() + "/cache.db"}
+	if err := database.migrate(files); err != nil {
+		// Keep using the files rather than not having a cache at all
+		log.Printf("Failed to set up the cache database: %v", err)
+		return files
+	}
+	return database
+}
+
+// Cache storage where each key is a file in a directory
+type FileStorage struct {
+	dir string
+}
+
+func (storage *FileStorage) filename(key string) string {
+	if filename, ok := cache_files[key]; ok {
+		return storage.dir + "/" + filename
+	}
+	return storage.dir + "/" + key
+}
+
+func (storage *FileStorage) Read(key string) ([]byte, time.Time, error) {
+	file_stat, err := os.Stat(storage.filename(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, time.Time{}, err_not_cached
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := os.ReadFile(storage.filename(key))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	// Files written by older versions of the workflow have no header, and are read as they are
+	value, err := open_cache_value(data, true)
+	return value, file_stat.ModTime(), err
+}
+
+func (storage *FileStorage) Modified(key string) (time.Time, error) {
+	file_stat, err := os.Stat(storage.filename(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, err_not_cached
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return file_stat.ModTime(), nil
+}
+
+func (storage *FileStorage) ReadParts(key string, checksum string, parts [][2]int) ([][]byte, error) {
+	file, err := os.Open(storage.filename(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, err_not_cached
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	file_stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header_data := make([]byte, cache_header_max_length)
+	n, err := file.ReadAt(header_data, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	header, has_header, err := parse_cache_header(header_data[:n])
+	if err != nil {
+		return nil, err
+	}
+	if err := check_cache_parts(header, has_header, int(file_stat.Size()), checksum); err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, len(parts))
+	for i, part := range parts {
+		values[i] = make([]byte, part[1]-part[0])
+		if _, err := file.ReadAt(values[i], int64(header.Size+part[0])); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// Function for writing a value to its file.
+// The value is written to a temporary file that then replaces the old one, so that a search never reads a file that is only partly written.
+func (storage *FileStorage) Write(key string, value []byte) error {
+	filename := storage.filename(key)
+	temp_file, err := os.CreateTemp(storage.dir, "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp_file.Name())
+
+	if _, err := temp_file.Write(seal_cache_value(value)); err != nil {
+		temp_file.Close()
+		return err
+	}
+	if err := temp_file.Sync(); err != nil {
+		temp_file.Close()
+		return err
+	}
+	if err := temp_file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp_file.Name(), filename)
+}
+
+func (storage *FileStorage) Delete(key string) error {
+	if err := os.Remove(storage.filename(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// The version of how the data is stored in the database, which is increased when that changes so that older databases can be migrated
+// Version 2 added the header with the checksum to every value.
+const cache_schema_version = 2
+
+var (
+	bucket_meta     = []byte("meta")
+	bucket_values   = []byte("values")
+	bucket_modified = []byte("modified")
+)
+
+// Cache storage in a bbolt database.
+// The database is only opened while it is used, as it can only be written to by one process at a time,
+// and the background refresh would otherwise keep searches from reading it.
+type BoltStorage struct {
+	path string
+}
+
+func (storage *BoltStorage) open(read_only bool) (*bolt.DB, error) {
+	return bolt.Open(storage.path, 0666, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: read_only})
+}
+
+func (storage *BoltStorage) view(fn func(tx *bolt.Tx) error) error {
+	if _, err := os.Stat(storage.path); errors.Is(err, os.ErrNotExist) {
+		return err_not_cached
+	}
+	db, err := storage.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+func (storage *BoltStorage) update(fn func(tx *bolt.Tx) error) error {
+	db, err := storage.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+func (storage *BoltStorage) Read(key string) ([]byte, time.Time, error) {
+	var value []byte
+	var modified time.Time
+	err := storage.view(func(tx *bolt.Tx) error {
+		values := tx.Bucket(bucket_values)
+		if values == nil || values.Get([]byte(key)) == nil {
+			return err_not_cached
+		}
+		// Values are only valid during the transaction, so they have to be copied
+		opened, err := open_cache_value(values.Get([]byte(key)), false)
+		if err != nil {
+			return err
+		}
+		value = append([]byte{}, opened...)
+		if modified_times := tx.Bucket(bucket_modified); modified_times != nil && len(modified_times.Get([]byte(key))) == 8 {
+			modified = time.Unix(0, int64(binary.BigEndian.Uint64(modified_times.Get([]byte(key)))))
+		}
+		return nil
+	})
+	return value, modified, err
+}
+
+func (storage *BoltStorage) Modified(key string) (time.Time, error) {
+	var modified time.Time
+	err := storage.view(func(tx *bolt.Tx) error {
+		modified_times := tx.Bucket(bucket_modified)
+		if modified_times == nil || len(modified_times.Get([]byte(key))) != 8 {
+			return err_not_cached
+		}
+		modified = time.Unix(0, int64(binary.BigEndian.Uint64(modified_times.Get([]byte(key)))))
+		return nil
+	})
+	return modified, err
+}
+
+func (storage *BoltStorage) ReadParts(key string, checksum string, parts [][2]int) ([][]byte, error) {
+	values := make([][]byte, len(parts))
+	err := storage.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucket_values)
+		if bucket == nil || bucket.Get([]byte(key)) == nil {
+			return err_not_cached
+		}
+		data := bucket.Get([]byte(key))
+		header, has_header, err := parse_cache_header(data)
+		if err != nil {
+			return err
+		}
+		if !has_header {
+			return err_corrupt_cache
+		}
+		if err := check_cache_parts(header, has_header, len(data), checksum); err != nil {
+			return err
+		}
+		value := data[header.Size:]
+		for i, part := range parts {
+			if part[0] < 0 || part[1] > len(value) || part[0] > part[1] {
+				return errors.New("part of " + key + " is out of range")
+			}
+			values[i] = append([]byte{}, value[part[0]:part[1]]...)
+		}
+		return nil
+	})
+	return values, err
+}
+
+func (storage *BoltStorage) Write(key string, value []byte) error {
+	return storage.update(func(tx *bolt.Tx) error {
+		return put_value(tx, key, value, time.Now())
+	})
+}
+
+// Function for storing a value with its header, and the time it was written
+func put_value(tx *bolt.Tx, key string, value []byte, modified time.Time) error {
+	values, err := tx.CreateBucketIfNotExists(bucket_values)
+	if err != nil {
+		return err
+	}
+	modified_times, err := tx.CreateBucketIfNotExists(bucket_modified)
+	if err != nil {
+		return err
+	}
+	modified_value := make([]byte, 8)
+	binary.BigEndian.PutUint64(modified_value, uint64(modified.UnixNano()))
+	if err := values.Put([]byte(key), seal_cache_value(value)); err != nil {
+		return err
+	}
+	return modified_times.Put([]byte(key), modified_value)
+}
+
+func (storage *BoltStorage) Delete(key string) error {
+	return storage.update(func(tx *bolt.Tx) error {
+		if values := tx.Bucket(bucket_values); values != nil {
+			if err := values.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		if modified_times := tx.Bucket(bucket_modified); modified_times != nil {
+			return modified_times.Delete([]byte(key))
+		}
+		return nil
+	})
+}
+
+// Function for reading the schema version of the database, which is 0 if the database doesn't exist yet
+func (storage *BoltStorage) schema_version() (int, error) {
+	version := 0
+	err := storage.view(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(bucket_meta); meta != nil {
+			version, _ = strconv.Atoi(string(meta.Get([]byte("schema_version"))))
+		}
+		return nil
+	})
+	if errors.Is(err, err_not_cached) {
+		return 0, nil
+	}
+	return version, err
+}
+
+// Function for bringing the database up to the current schema version.
+// A new database gets the contents of the JSON files that the cache was stored in before, which are then removed,
+// and the values in a database from before the values had headers get one.
+func (storage *BoltStorage) migrate(files *FileStorage) error {
+	version, err := storage.schema_version()
+	if err != nil {
+		return err
+	}
+	if version == cache_schema_version {
+		return nil
+	}
+	if version > cache_schema_version {
+		return errors.New("the cache database was created by a newer version of the workflow")
+	}
+
+	var migrated []string
+	err = storage.update(func(tx *bolt.Tx) error {
+		// Another process might have migrated the database while we waited for it
+		meta, err := tx.CreateBucketIfNotExists(bucket_meta)
+		if err != nil {
+			return err
+		}
+		if string(meta.Get([]byte("schema_version"))) == strconv.Itoa(cache_schema_version) {
+			return nil
+		}
+
+		if version == 0 {
+			for key := range cache_files {
+				value, modified, err := files.Read(key)
+				if errors.Is(err, err_not_cached) {
+					continue
+				} else if err != nil {
+					return err
+				}
+				if err := put_value(tx, key, value, modified); err != nil {
+					return err
+				}
+				migrated = append(migrated, key)
+			}
+		}
+		if version == 1 {
+			if err := add_value_headers(tx); err != nil {
+				return err
+			}
+		}
+		return meta.Put([]byte("schema_version"), []byte(strconv.Itoa(cache_schema_version)))
+	})
+	if err != nil {
+		return err
+	}
+
+	// The files are only removed when the database has been written successfully
+	for _, key := range migrated {
+		files.Delete(key)
+	}
+	return nil
+}
+
+// Function for adding the header to every value in a database with schema version 1, keeping when they were written
+func add_value_headers(tx *bolt.Tx) error {
+	values := tx.Bucket(bucket_values)
+	if values == nil {
+		return nil
+	}
+	// The bucket can't be changed while going through it, so the values are collected first
+	unsealed := make(map[string][]byte)
+	values.ForEach(func(key, value []byte) error {
+		unsealed[string(key)] = append([]byte{}, value...)
+		return nil
+	})
+	for key, value := range unsealed {
+		modified := time.Now()
+		if modified_times := tx.Bucket(bucket_modified); modified_times != nil && len(modified_times.Get([]byte(key))) == 8 {
+			modified = time.Unix(0, int64(binary.BigEndian.Uint64(modified_times.Get([]byte(key)))))
+		}
+		if err := put_value(tx, key, value, modified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
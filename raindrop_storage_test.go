@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestMigrateCacheFiles(t *testing.T) {
+	setup_test_workflow(t)
+	os.Remove(wf.CacheDir() + "/cache.db")
+
+	// Caches written by an older version of the workflow
+	modified := time.Now().Add(-5 * time.Hour).Truncate(time.Second)
+	os.WriteFile(wf.CacheDir()+"/bookmarks.json", []byte(`{"result":true,"items":[{"_id":1}]}`), 0666)
+	os.WriteFile(wf.CacheDir()+"/tags.json", []byte(`{"result":true,"items":[{"_id":"golang"}]}`), 0666)
+	os.Chtimes(wf.CacheDir()+"/bookmarks.json", modified, modified)
+
+	storage := open_cache_storage()
+	if _, ok := storage.(*BoltStorage); !ok {
+		t.Fatalf("Expected the database to be used, got %T", storage)
+	}
+	value, value_time, err := storage.Read("bookmarks")
+	if err != nil || string(value) != `{"result":true,"items":[{"_id":1}]}` {
+		t.Errorf("Bookmarks were not migrated: %q, %v", value, err)
+	}
+	if !value_time.Equal(modified) {
+		t.Errorf("Expected the modification time %v to be kept, got %v", modified, value_time)
+	}
+	if tags, _, _ := storage.Read("tags"); string(tags) != `{"result":true,"items":[{"_id":"golang"}]}` {
+		t.Errorf("Tags were not migrated: %q", tags)
+	}
+	if _, err := storage.Modified("collections"); !errors.Is(err, err_not_cached) {
+		t.Errorf("Expected err_not_cached for a cache that didn't exist, got %v", err)
+	}
+	if _, err := os.Stat(wf.CacheDir() + "/bookmarks.json"); !errors.Is(err, os.ErrNotExist) {
+		t.Error("The migrated file was not removed")
+	}
+
+	// Files that show up after the migration are not read again
+	os.WriteFile(wf.CacheDir()+"/tags.json", []byte(`{}`), 0666)
+	storage = open_cache_storage()
+	if tags, _, _ := storage.Read("tags"); string(tags) != `{"result":true,"items":[{"_id":"golang"}]}` {
+		t.Errorf("Tags were migrated again: %q", tags)
+	}
+}
+
+func TestCacheStorageNewerSchema(t *testing.T) {
+	setup_test_workflow(t)
+	db, err := bolt.Open(wf.CacheDir()+"/cache.db", 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		meta, _ := tx.CreateBucketIfNotExists(bucket_meta)
+		return meta.Put([]byte("schema_version"), []byte("99"))
+	})
+	db.Close()
+
+	// A database from a newer version of the workflow is left alone
+	if storage := open_cache_storage(); !is_file_storage(storage) {
+		t.Errorf("Expected the files to be used, got %T", storage)
+	}
+}
+
+func TestCacheStorageFilesSetting(t *testing.T) {
+	setup_test_workflow(t)
+	t.Setenv("cache_storage", "files")
+	storage := open_cache_storage()
+	if !is_file_storage(storage) {
+		t.Fatalf("Expected the files to be used, got %T", storage)
+	}
+	storage.Write("collections", []byte(`{"result":true}`))
+	if value, err := os.ReadFile(wf.CacheDir() + "/collections.json"); err != nil || !strings.HasPrefix(string(value), cache_header_prefix) || !strings.HasSuffix(string(value), "\n{\"result\":true}") {
+		t.Errorf("Unexpected file contents: %q, %v", value, err)
+	}
+	if files, _ := filepath.Glob(wf.CacheDir() + "/.*.tmp"); len(files) != 0 {
+		t.Errorf("Temporary files were left behind: %v", files)
+	}
+}
+
+func TestCacheStorageCorruptValue(t *testing.T) {
+	setup_test_workflow(t)
+	t.Setenv("cache_storage", "files")
+	storage := open_cache_storage()
+	storage.Write("bookmarks", []byte(`{"result":true,"items":[{"_id":1},{"_id":2}]}`))
+
+	// A file that was cut off while being written by an older version of the workflow
+	data, _ := os.ReadFile(wf.CacheDir() + "/bookmarks.json")
+	os.WriteFile(wf.CacheDir()+"/bookmarks.json", data[:len(data)-10], 0666)
+	if _, _, err := storage.Read("bookmarks"); !errors.Is(err, err_corrupt_cache) || !errors.Is(err, err_not_cached) {
+		t.Errorf("Expected err_corrupt_cache, got %v", err)
+	}
+
+	// A damaged value in the database
+	database := &BoltStorage{path: wf.CacheDir() + "/corrupt.db"}
+	database.Write("tags", []byte(`{"result":true}`))
+	db, err := bolt.Open(database.path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		value := append([]byte{}, tx.Bucket(bucket_values).Get([]byte("tags"))...)
+		value[len(value)-2] = 'X'
+		return tx.Bucket(bucket_values).Put([]byte("tags"), value)
+	})
+	db.Close()
+	if _, _, err := database.Read("tags"); !errors.Is(err, err_corrupt_cache) {
+		t.Errorf("Expected err_corrupt_cache from the database, got %v", err)
+	}
+}
+
+func TestCorruptBookmarksCacheIsRefetched(t *testing.T) {
+	fake := setup_test_workflow(t)
+	fake.add_generated_raindrops(3)
+	token := read_token()
+	if _, err := get_all_bookmarks(token, "fetch"); err != nil {
+		t.Fatal(err)
+	}
+	cache_storage.(*BoltStorage).update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket_values).Put([]byte("bookmarks"), []byte(`{"result":true,"items":[{"_id":1}`))
+	})
+
+	// The damaged cache is fetched again rather than used, even when the cache is trusted
+	bookmarks, err := get_all_bookmarks(token, "trust")
+	if err != nil || len(bookmarks) != len(fake.raindrop_data) {
+		t.Errorf("Expected %d bookmarks, got %d: %v", len(fake.raindrop_data), len(bookmarks), err)
+	}
+	if _, _, err := cache_storage.Read("bookmarks"); err != nil {
+		t.Errorf("The cache was not written again: %v", err)
+	}
+}
+
+func TestMigrateSchemaVersion1(t *testing.T) {
+	setup_test_workflow(t)
+	os.Remove(wf.CacheDir() + "/cache.db")
+	db, err := bolt.Open(wf.CacheDir()+"/cache.db", 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(-3 * time.Hour)
+	db.Update(func(tx *bolt.Tx) error {
+		meta, _ := tx.CreateBucketIfNotExists(bucket_meta)
+		meta.Put([]byte("schema_version"), []byte("1"))
+		values, _ := tx.CreateBucketIfNotExists(bucket_values)
+		values.Put([]byte("tags"), []byte(`{"result":true}`))
+		modified_times, _ := tx.CreateBucketIfNotExists(bucket_modified)
+		modified_value := make([]byte, 8)
+		binary.BigEndian.PutUint64(modified_value, uint64(modified.UnixNano()))
+		return modified_times.Put([]byte("tags"), modified_value)
+	})
+	db.Close()
+
+	// Values from before the headers were added get one, and keep when they were written
+	storage := open_cache_storage()
+	value, value_time, err := storage.Read("tags")
+	if err != nil || string(value) != `{"result":true}` || !value_time.Equal(time.Unix(0, modified.UnixNano())) {
+		t.Errorf("Unexpected value after migrating: %q, %v, %v", value, value_time, err)
+	}
+}
+
+func TestCacheLockWaitsForWriter(t *testing.T) {
+	setup_test_workflow(t)
+
+	// Another process is writing to the cache
+	writer, err := os.OpenFile(wf.CacheDir()+"/cache.lock", os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	syscall.Flock(int(writer.Fd()), syscall.LOCK_EX)
+
+	locked := make(chan func())
+	go func() {
+		unlock, err := lock_cache(false)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("The cache was locked while another process held the lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	syscall.Flock(int(writer.Fd()), syscall.LOCK_UN)
+	unlock := <-locked
+
+	// Nested locks are counted, and a reader in this process keeps other processes from writing
+	unlock_nested, _ := lock_cache(false)
+	unlock()
+	if err := syscall.Flock(int(writer.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+		t.Error("Another process could lock the cache while it was read")
+	}
+	unlock_nested()
+	if err := syscall.Flock(int(writer.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Errorf("The lock was not released: %v", err)
+	}
+}
+
+func TestCacheLockNeverUpgraded(t *testing.T) {
+	setup_test_workflow(t)
+
+	// A reader can't start writing, as another process could get in between, or wait for this one to stop reading while it tries the same
+	unlock_reader, _ := lock_cache(false)
+	if _, err := lock_cache(true); !errors.Is(err, err_cache_lock_upgrade) {
+		t.Errorf("Expected err_cache_lock_upgrade, got %v", err)
+	}
+	unlock_reader()
+
+	// A writer can read and write again while it holds the lock
+	unlock_writer, _ := lock_cache(true)
+	unlock_read, err := lock_cache(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock_write, err := lock_cache(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock_write()
+	unlock_read()
+	other, err := os.OpenFile(wf.CacheDir()+"/cache.lock", os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		t.Error("Another process could read the cache while it was written")
+	}
+	unlock_writer()
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		t.Errorf("The lock was not released: %v", err)
+	}
+}
+
+func TestCacheStorageReadParts(t *testing.T) {
+	setup_test_workflow(t)
+	for _, storage := range []CacheStorage{&BoltStorage{path: wf.CacheDir() + "/parts.db"}, &FileStorage{dir: wf.CacheDir()}} {
+		if _, err := storage.ReadParts("parts", "", [][2]int{{0, 1}}); !errors.Is(err, err_not_cached) {
+			t.Errorf("%T: Expected err_not_cached, got %v", storage, err)
+		}
+		storage.Write("parts", []byte("0123456789"))
+		parts, err := storage.ReadParts("parts", cache_checksum([]byte("0123456789")), [][2]int{{2, 4}, {0, 1}, {9, 10}})
+		if err != nil || len(parts) != 3 || string(parts[0]) != "23" || string(parts[1]) != "0" || string(parts[2]) != "9" {
+			t.Errorf("%T: Unexpected parts: %q, %v", storage, parts, err)
+		}
+		if _, err := storage.ReadParts("parts", cache_checksum([]byte("another value")), [][2]int{{0, 1}}); !errors.Is(err, err_corrupt_cache) {
+			t.Errorf("%T: Expected err_corrupt_cache for another checksum, got %v", storage, err)
+		}
+		storage.Delete("parts")
+		if _, err := storage.Modified("parts"); !errors.Is(err, err_not_cached) {
+			t.Errorf("%T: Expected err_not_cached after deleting, got %v", storage, err)
+		}
+	}
+}
+
+func is_file_storage(storage CacheStorage) bool {
+	_, ok := storage.(*FileStorage)
+	return ok
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSearchedCollections(t *testing.T) {
+	setup_test_workflow(t)
+	sublevel := []Collection{
+		{ID: 1003, Title: "Rust", Parent: &RaindropRef{ID: 1001}},
+		{ID: 1004, Title: "Async", Parent: &RaindropRef{ID: 1003}},
+		{ID: 1002, Title: "Go", Parent: &RaindropRef{ID: 1001}},
+		{ID: 2002, Title: "Cakes", Parent: &RaindropRef{ID: 2001}},
+	}
+	if collections := searched_collections(0, sublevel); collections != nil {
+		t.Errorf("Expected all collections to be searched, got %v", collections)
+	}
+	if collections := searched_collections(1001, sublevel); !reflect.DeepEqual(collections, map[int]bool{1001: true}) {
+		t.Errorf("Expected only the collection itself without the setting, got %v", collections)
+	}
+
+	t.Setenv("include_subcollections", "1")
+	if collections := searched_collections(1001, sublevel); !reflect.DeepEqual(collections, map[int]bool{1001: true, 1002: true, 1003: true, 1004: true}) {
+		t.Errorf("Unexpected collections: %v", collections)
+	}
+	if collections := searched_collections(-1, sublevel); !reflect.DeepEqual(collections, map[int]bool{-1: true}) {
+		t.Errorf("Unexpected collections for Unsorted: %v", collections)
+	}
+}
+
+// Returns the Alfred JSON of all items, one per line
+func feedback_json() string {
+	items := []string{}
+	for _, item := range wf.Feedback.Items {
+		items = append(items, item_json(item))
+	}
+	return strings.Join(items, "\n")
+}
+
+func TestSearchSubcollections(t *testing.T) {
+	for name, search_function := range map[string]func(string, string, string, string, string, bool, bool){"search": search, "local_search": local_search_command} {
+		t.Run(name, func(t *testing.T) {
+			setup_test_workflow(t)
+			search_function("collection", "", `{"icon":"folder.png","id":"1001","name":"Dev"}`, "", "", false, true)
+			if output := feedback_json(); strings.Contains(output, "Golang generics tutorial") || strings.Contains(output, "The Rust Programming Language") {
+				t.Errorf("Expected Dev to be empty without the setting, got %s", output)
+			}
+
+			t.Setenv("include_subcollections", "1")
+			wf.Feedback.Clear()
+			search_function("collection", "", `{"icon":"folder.png","id":"1001","name":"Dev"}`, "", "", false, true)
+			output := feedback_json()
+			// Each bookmark shows the subcollection that it is in
+			for _, expected := range []string{`"title":"Golang generics tutorial","subtitle":"♥︎ Dev/Go`, `"title":"The Rust Programming Language","subtitle":"Dev/Rust`} {
+				if !strings.Contains(output, expected) {
+					t.Errorf("Expected the bookmarks of the subcollections, with their collection, got %s", output)
+				}
+			}
+			if strings.Contains(output, "Fluffy pancakes") {
+				t.Errorf("Expected only the bookmarks of Dev and its subcollections, got %s", output)
+			}
+		})
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	aw "github.com/deanishe/awgo"
+)
+
+var update_golden = flag.Bool("update", false, "Update the golden files in testdata/golden")
+
+// Compares the Alfred JSON that has been produced so far with testdata/golden/<name>.json
+func check_golden(t *testing.T, fake *fake_raindrop, name string) {
+	t.Helper()
+	output, err := json.MarshalIndent(wf.Feedback, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replace the parts of the output that differ between test runs
+	output = bytes.ReplaceAll(output, []byte(fake.server.URL), []byte("http://raindrop.test"))
+	output = bytes.ReplaceAll(output, []byte(wf.CacheDir()), []byte("$CACHE"))
+	output = append(output, '\n')
+
+	golden_filename := "testdata/golden/" + name + ".json"
+	if *update_golden {
+		if err := os.WriteFile(golden_filename, output, 0666); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(golden_filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, expected) {
+		t.Errorf("Output differs from %s:\n%s", golden_filename, output)
+	}
+}
+
+// Returns the Alfred JSON of one item
+func item_json(item *aw.Item) string {
+	item_json, _ := json.Marshal(item)
+	return string(item_json)
+}
+
+func TestSearch(t *testing.T) {
+	fake := setup_test_workflow(t)
+	search("standard", "generics", "", "", "", false, true)
+	check_golden(t, fake, "search")
+}
+
+func TestSearchNoResults(t *testing.T) {
+	fake := setup_test_workflow(t)
+	search("standard", "nothingmatchesthis", "", "", "", false, true)
+	check_golden(t, fake, "search_no_results")
+
+	// A search without results must not be treated as an authentication failure
+	if _, err := token_store.Get("raindrop_token"); err != nil {
+		t.Error("Token was removed after a search without results")
+	}
+	if fake.refresh_count() != 0 {
+		t.Error("Token was refreshed after a search without results")
+	}
+}
+
+func TestSearchExpiredToken(t *testing.T) {
+	fake := setup_test_workflow(t)
+	fake.expire_token()
+	search("standard", "generics", "", "", "", false, true)
+	check_golden(t, fake, "search")
+
+	if token := read_token(); token.AccessToken != fake.access_token {
+		t.Errorf("Refreshed token was not stored, got %q", token.AccessToken)
+	}
+	// The collections and tags that are fetched after the search should use the new token without refreshing it again
+	if fake.refresh_count() != 1 {
+		t.Errorf("Expected the token to be refreshed once, got %d", fake.refresh_count())
+	}
+}
+
+func TestSearchRevokedToken(t *testing.T) {
+	fake := setup_test_workflow(t)
+	fake.revoke_token()
+	search("standard", "generics", "", "", "", false, true)
+
+	if _, err := token_store.Get("raindrop_token"); err == nil {
+		t.Error("Token was not removed after it was revoked")
+	}
+	if len(wf.Feedback.Items) != 1 {
+		t.Fatalf("Expected only the authentication item, got %d items", len(wf.Feedback.Items))
+	}
+}
+
+func TestSearchRequestErrors(t *testing.T) {
+	fake := setup_test_workflow(t)
+	token := read_token()
+
+	if _, _, err := search_request("nothingmatchesthis", token, 0, "", 0); !errors.Is(err, err_no_results) {
+		t.Errorf("Expected err_no_results, got %v", err)
+	}
+	fake.revoke_token()
+	if _, _, err := search_request("generics", token, 0, "", 0); !errors.Is(err, err_unauthorized) {
+		t.Errorf("Expected err_unauthorized, got %v", err)
+	}
+	fake.server.Close()
+	if _, _, err := search_request("generics", token, 0, "", 0); !errors.Is(err, err_network) {
+		t.Errorf("Expected err_network, got %v", err)
+	}
+}
+
+func TestSearchOffline(t *testing.T) {
+	fake := setup_test_workflow(t)
+	get_all_bookmarks(read_token(), "fetch")
+	fake.make_unreachable("/rest/")
+	search("standard", "pancake", "", "", "", false, true)
+	check_golden(t, fake, "search_offline")
+}
+
+func TestSearchSlowFallsBackOffline(t *testing.T) {
+	fake := setup_test_workflow(t)
+	get_all_bookmarks(read_token(), "fetch")
+
+	// Raindrop.io takes longer to answer than the user should have to wait
+	raindrop_client.interactive_timeout = 50 * time.Millisecond
+	fake.before_page = func(int) {
+		time.Sleep(300 * time.Millisecond)
+	}
+	requests := len(fake.request_log())
+	search("standard", "pancake", "", "", "", false, true)
+	if title := item_json(wf.Feedback.Items[0]); !strings.Contains(title, "Offline: showing cached results") {
+		t.Errorf("Expected the offline item first, got %s", title)
+	}
+	if output := feedback_json(); !strings.Contains(output, `"title":"Fluffy pancakes"`) {
+		t.Errorf("Expected the cached results, got %s", output)
+	}
+	if searches := len(fake.request_log()) - requests; searches != 1 {
+		t.Errorf("Expected the search not to be retried, got %d requests", searches)
+	}
+}
+
+func TestSearchOfflineExpiredToken(t *testing.T) {
+	fake := setup_test_workflow(t)
+	get_all_bookmarks(read_token(), "fetch")
+
+	// Raindrop.io answers that the token has expired, but the token can't be refreshed
+	fake.expire_token()
+	fake.make_unreachable("/oauth/")
+	search("standard", "pancake", "", "", "", false, true)
+	if title := item_json(wf.Feedback.Items[0]); !strings.Contains(title, "Offline: showing cached results") {
+		t.Errorf("Expected the offline item first, got %s", title)
+	}
+	if token := read_token(); token.Error != "" || token.RefreshToken != fake.refresh_token {
+		t.Errorf("The token was removed: %+v", token)
+	}
+}
+
+func TestSearchPages(t *testing.T) {
+	fake := setup_test_workflow(t)
+	fake.add_generated_raindrops(120)
+
+	search("standard", "generated", "", "", "", false, true)
+	items := wf.Feedback.Items
+	if len(items) != search_page_size+1 {
+		t.Fatalf("Expected one page of results and a \"Show more results\" item, got %d items", len(items))
+	}
+	last, _ := json.Marshal(items[len(items)-1])
+	if !strings.Contains(string(last), `"autocomplete":"generated pages:2"`) {
+		t.Errorf("Unexpected last item: %s", last)
+	}
+
+	// Load all three pages, and check that favourites from every page are shown first
+	wf.Feedback.Clear()
+	search("standard", "generated pages:3", "", "", "", false, true)
+	items = wf.Feedback.Items
+	if len(items) != 120 {
+		t.Fatalf("Expected 120 results, got %d", len(items))
+	}
+	for i, item := range items {
+		item_json, _ := json.Marshal(item)
+		is_fav := strings.Contains(string(item_json), "♥︎")
+		if is_fav != (i < 12) {
+			t.Errorf("Favourites are not listed first, item %d: %s", i, item_json)
+			break
+		}
+	}
+}
+
+func TestSearchTag(t *testing.T) {
+	fake := setup_test_workflow(t)
+	search("tag", "", "", "golang", "", false, true)
+	check_golden(t, fake, "search_tag")
+}
+
+func TestSearchCollection(t *testing.T) {
+	fake := setup_test_workflow(t)
+	search("collection", "", `{"icon":"folder.png","id":"1003","name":"Dev/Rust"}`, "", "collections", true, true)
+	check_golden(t, fake, "search_collection")
+}
+
+func TestLocalSearch(t *testing.T) {
+	fake := setup_test_workflow(t)
+	local_search_command("standard", "pancake", "", "", "", false, true)
+	check_golden(t, fake, "local_search")
+}
+
+func TestLocalSearchCollectionsAndTags(t *testing.T) {
+	setup_test_workflow(t)
+	local_search_command("standard", "rust", "", "", "", false, true)
+
+	// The collections and tags after the bookmarks are filtered by the query too, as Alfred doesn't filter the results of the local search
+	var titles []string
+	for _, item := range wf.Feedback.Items {
+		var fields struct{ Title string }
+		json.Unmarshal([]byte(item_json(item)), &fields)
+		titles = append(titles, fields.Title)
+	}
+	if strings.Join(titles, ",") != "The Rust Programming Language,Dev/Rust,rust" {
+		t.Errorf("Unexpected items: %v", titles)
+	}
+}
+
+func TestLocalSearchAccents(t *testing.T) {
+	fake := setup_test_workflow(t)
+	fake.update_raindrop(3, "2025-01-01T00:00:00.000Z", func(raindrop *Raindrop) {
+		raindrop.Title = "Crêpes et pancakes"
+	})
+	local_search_command("standard", "CREPES", "", "", "", false, true)
+	if !strings.Contains(item_json(wf.Feedback.Items[0]), "Crêpes et pancakes") {
+		t.Errorf("Expected the search to find a title with accents, got %s", item_json(wf.Feedback.Items[0]))
+	}
+}
+
+func TestSetTagsSuggestions(t *testing.T) {
+	setup_test_workflow(t)
+	t.Setenv("bookmark_info", `{"collection":"1002","title":"A page","url":"https://example.com/"}`)
+	set_tags("tutorial, Go")
+
+	// The tag that is being typed is matched regardless of its case
+	if len(wf.Feedback.Items) != 2 || !strings.Contains(item_json(wf.Feedback.Items[1]), `"title":"golang"`) {
+		t.Errorf("Expected golang to be suggested, got %d items", len(wf.Feedback.Items))
+	}
+}
+
+func TestLocalSearchExpiredToken(t *testing.T) {
+	fake := setup_test_workflow(t)
+	// A token that is past its lifetime should be refreshed, rather than making the user authenticate again
+	store_test_token(fake, time.Now().Add(-30*24*time.Hour))
+	fake.expire_token()
+	local_search_command("standard", "pancake", "", "", "", false, true)
+	check_golden(t, fake, "local_search")
+
+	if fake.refresh_count() != 1 {
+		t.Errorf("Expected the token to be refreshed once, got %d", fake.refresh_count())
+	}
+}
+
+func TestRefreshCacheExpiredToken(t *testing.T) {
+	fake := setup_test_workflow(t)
+	fake.expire_token()
+	bookmarks, err := get_all_bookmarks(read_token(), "fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookmarks) != 4 {
+		t.Errorf("Expected 4 bookmarks, got %d", len(bookmarks))
+	}
+}
+
+func TestSyncBookmarks(t *testing.T) {
+	fake := setup_test_workflow(t)
+	token := read_token()
+	if _, err := get_all_bookmarks(token, "fetch"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change one bookmark, add a new one, move one to the trash without updating it, and delete one permanently
+	fake.update_raindrop(3, "2025-01-01T00:00:00.000Z", func(raindrop *Raindrop) {
+		raindrop.Title = "Fluffy pancakes with syrup"
+	})
+	fake.add_generated_raindrops(1)
+	fake.update_raindrop(10000, "2025-01-02T00:00:00.000Z", func(raindrop *Raindrop) {})
+	fake.update_raindrop(2, "2023-11-20T08:30:00.000Z", func(raindrop *Raindrop) {
+		raindrop.Collection.ID = -99
+	})
+	fake.delete_raindrop(4)
+
+	// A permanently deleted bookmark can't be found by syncing, so it stays in the cache until all bookmarks are fetched again
+	bookmarks, err := get_all_bookmarks(token, "sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := bookmark_ids(bookmarks); ids != "10000,1,3,4" {
+		t.Errorf("Unexpected bookmarks after sync: %s", ids)
+	}
+	if bookmarks[2].Title != "Fluffy pancakes with syrup" {
+		t.Errorf("Changed bookmark was not updated, got %q", bookmarks[2].Title)
+	}
+	cached, _ := get_all_bookmarks(token, "trust")
+	if ids := bookmark_ids(cached); ids != "10000,1,3,4" {
+		t.Errorf("Unexpected bookmarks in cache after sync: %s", ids)
+	}
+
+	t.Setenv("local_cache_full_sync_interval", "0")
+	bookmarks, err = get_all_bookmarks(token, "sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := bookmark_ids(bookmarks); ids != "1,3,10000" {
+		t.Errorf("Unexpected bookmarks after full sync: %s", ids)
+	}
+}
+
+func TestFetchAllBookmarks(t *testing.T) {
+	fake := setup_test_workflow(t)
+	fake.add_generated_raindrops(230)
+
+	bookmarks, err := fetch_all_bookmarks(read_token(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookmarks) != 234 {
+		t.Fatalf("Expected 234 bookmarks, got %d", len(bookmarks))
+	}
+	// The pages are fetched in parallel, but must still be put together in order
+	for i, bookmark := range bookmarks {
+		if bookmark.ID != fake.raindrop_data[i].ID {
+			t.Fatalf("Bookmark %d is out of order, expected %d, got %d", i, fake.raindrop_data[i].ID, bookmark.ID)
+		}
+	}
+	if requests := page_requests(fake, 0); len(requests) != 5 {
+		t.Errorf("Expected 5 page requests, got %v", requests)
+	}
+}
+
+func TestFetchAllBookmarksFullLastPage(t *testing.T) {
+	fake := setup_test_workflow(t)
+	// 150 bookmarks fill exactly 3 pages, so there is no page after them to ask for
+	fake.add_generated_raindrops(146)
+
+	bookmarks, err := fetch_all_bookmarks(read_token(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookmarks) != 150 {
+		t.Errorf("Expected 150 bookmarks, got %d", len(bookmarks))
+	}
+	if requests := page_requests(fake, 0); len(requests) != 3 {
+		t.Errorf("Expected 3 page requests, got %v", requests)
+	}
+}
+
+func TestFetchAllBookmarksAddedWhileFetching(t *testing.T) {
+	fake := setup_test_workflow(t)
+	fake.add_generated_raindrops(146)
+	var once sync.Once
+	fake.before_page = func(page int) {
+		if page == 1 {
+			once.Do(func() {
+				fake.add_generated_raindrops(10)
+			})
+		}
+	}
+
+	// The first page tells about 3 pages, but the pages after it tell that there are 4 now
+	bookmarks, err := fetch_all_bookmarks(read_token(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookmarks) != 160 || bookmarks[159].ID != 10155 {
+		t.Errorf("Expected the bookmarks on the page that was added while fetching, got %d bookmarks", len(bookmarks))
+	}
+	if requests := page_requests(fake, 0); len(requests) != 4 {
+		t.Errorf("Expected 4 page requests, got %v", requests)
+	}
+}
+
+func TestFetchAllBookmarksUpdatesTrash(t *testing.T) {
+	fake := setup_test_workflow(t)
+	if _, err := run_refresh(read_token(), "fetch"); err != nil {
+		t.Fatal(err)
+	}
+	if trash := page_requests(fake, trash_collection); len(trash) != 1 {
+		t.Errorf("Expected the trash to be fetched, got %v", trash)
+	}
+
+	// A full fetch after a bookmark has been moved to the trash keeps the collection that it was in, for restoring it there
+	fake.trash_raindrop(1)
+	if _, err := run_refresh(read_token(), "fetch"); err != nil {
+		t.Fatal(err)
+	}
+	if origins := read_trash_origins(); len(origins) != 1 || origins[1] != 1002 {
+		t.Errorf("Unexpected origins: %v", origins)
+	}
+	if ids := bookmark_ids(read_cached_trash()); ids != "1" {
+		t.Errorf("Expected the bookmark in the cached trash, got %s", ids)
+	}
+}
+
+// Gets the requests that were made for pages of bookmarks in a collection
+func page_requests(fake *fake_raindrop, collection int) []string {
+	var requests []string
+	for _, request := range fake.request_log() {
+		if request == fmt.Sprintf("GET /rest/v1/raindrops/%d", collection) {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+func bookmark_ids(bookmarks []Raindrop) string {
+	ids := []string{}
+	for _, bookmark := range bookmarks {
+		ids = append(ids, fmt.Sprint(bookmark.ID))
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestLocalSearchCollection(t *testing.T) {
+	fake := setup_test_workflow(t)
+	local_search_command("collection", "", `{"icon":"folder.png","id":"1002","name":"Dev/Go"}`, "", "", false, true)
+	check_golden(t, fake, "local_search_collection")
+}
+
+func TestBrowse(t *testing.T) {
+	fake := setup_test_workflow(t)
+	browse("", false)
+	check_golden(t, fake, "browse")
+}
+
+func TestSelectCollection(t *testing.T) {
+	fake := setup_test_workflow(t)
+	select_collection("", fake.server.URL+"/page.html", "", "", true)
+	check_golden(t, fake, "select_collection")
+}
+
+func TestSaveBookmarkFailed(t *testing.T) {
+	fake := setup_test_workflow(t)
+	t.Setenv("bookmark_info", `{"collection":"1002","title":"A page without a link","url":""}`)
+	output := capture_output(t, func() { save_bookmark("") })
+	if !strings.HasPrefix(output, "Could not add the bookmark: ") {
+		t.Errorf("Expected the error to be shown, got %q", output)
+	}
+	if len(fake.saved) != 0 {
+		t.Errorf("Expected nothing to be saved, got %v", fake.saved)
+	}
+}
+
+func TestSaveBookmark(t *testing.T) {
+	fake := setup_test_workflow(t)
+	fake.expire_token()
+	t.Setenv("bookmark_info", `{"collection":"1002","title":"A page to bookmark","url":"`+fake.server.URL+`/page.html"}`)
+	save_bookmark("golang, #tutorial")
+
+	if len(fake.saved) != 1 {
+		t.Fatalf("Expected 1 saved bookmark, got %d", len(fake.saved))
+	}
+	saved := fake.saved[0]
+	if saved.Title != "A page to bookmark" || saved.Collection.ID != 1002 || !strings.HasSuffix(saved.Link, "/page.html") {
+		t.Errorf("Unexpected bookmark saved: %+v", saved)
+	}
+	if strings.Join(saved.Tags, ",") != "golang,tutorial" {
+		t.Errorf("Unexpected tags saved: %v", saved.Tags)
+	}
+	if saved.Excerpt != "Description of the page" {
+		t.Errorf("Unexpected excerpt saved: %q", saved.Excerpt)
+	}
+}
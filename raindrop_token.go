@@ -0,0 +1,61 @@
+/*
+	Keeping track of the authentication token during a run of the workflow, and refreshing it when Raindrop.io stops accepting it
+
+	By Andreas Westerlind, 2021-2025
+*/
+
+package main
+
+import (
+	"sync"
+)
+
+type TokenManager struct {
+	mutex sync.Mutex
+	// Tokens that have been refreshed during this run, by the access token they replaced
+	refreshed map[string]RaindropToken
+}
+
+var token_manager = new_token_manager()
+
+func new_token_manager() *TokenManager {
+	return &TokenManager{refreshed: map[string]RaindropToken{}}
+}
+
+// Returns the newest version of a token, as functions further up might still hold on to one that has been refreshed since
+func (manager *TokenManager) current(token RaindropToken) RaindropToken {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	for {
+		new_token, ok := manager.refreshed[token.AccessToken]
+		if !ok || new_token.AccessToken == token.AccessToken {
+			return token
+		}
+		token = new_token
+	}
+}
+
+// Refreshes a token and saves the new one to the Keychain.
+// Concurrent calls for the same token only refresh it once.
+func (manager *TokenManager) refresh(token RaindropToken) (RaindropToken, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if new_token, ok := manager.refreshed[token.AccessToken]; ok {
+		return new_token, nil
+	}
+	new_token, err := refresh_token(token)
+	if err != nil {
+		return token, err
+	}
+	manager.refreshed[token.AccessToken] = new_token
+	return new_token, nil
+}
+
+// Returns a token that can be used right away, refreshing it first if it has expired
+func (manager *TokenManager) valid(token RaindropToken) (RaindropToken, error) {
+	token = manager.current(token)
+	if token_expired(token) {
+		return manager.refresh(token)
+	}
+	return token, nil
+}
@@ -0,0 +1,314 @@
+/*
+	The trash at Raindrop.io, where bookmarks can be browsed and restored to the collection they were in (or another one), and which can be emptied
+
+	By Andreas Westerlind, 2025
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	aw "github.com/deanishe/awgo"
+)
+
+// ID of the trash at Raindrop.io
+const trash_collection = -99
+
+// Function for showing the item that goes to the trash in the collection browser, where from is "local" in the local collection browser
+func trash_browse_item(from string) {
+	alfred_item := wf.NewItem("Trash").
+		Var("trash_from", from).
+		Var("goto", "trash").
+		Subtitle("").
+		Valid(true).
+		Icon(&aw.Icon{Value: "folder.png", Type: ""})
+	alfred_item.Alt().
+		Var("trash_from", from).
+		Var("goto", "trash").
+		Subtitle("")
+}
+
+// Function for listing the bookmarks in the trash, which are always taken from Raindrop.io as the local cache doesn't keep them,
+// except when Raindrop.io can't be reached, where the trash as it was at the last refresh of the local cache is shown instead
+func browse_trash(query string, descr_in_list bool) {
+	back_goto := "browse"
+	if wf.Config.Get("trash_from", "") == "local" {
+		back_goto = "local_browse"
+	}
+	alfred_item := wf.NewItem("Trash").
+		Var("goto", back_goto).
+		Subtitle("⬅︎ Go back to collection browser").
+		Valid(true).
+		Icon(&aw.Icon{Value: "folder.png", Type: ""})
+	alfred_item.Alt().
+		Var("goto", back_goto).
+		Subtitle("⬅︎ Go back to collection browser")
+
+	token := read_token()
+	if token.Error != "" {
+		init_auth()
+		return
+	}
+
+	bookmarks, more_results, err := search_pages(query, token, trash_collection, "", 1)
+	if errors.Is(err, err_unauthorized) {
+		reauthenticate()
+		return
+	}
+	if errors.Is(err, err_network) {
+		wf.NewItem("Offline: showing the cached trash").
+			Subtitle("Could not connect to Raindrop.io, so these bookmarks are from the last refresh of the local cache").
+			Valid(false)
+		bookmarks = read_cached_trash()
+		if query != "" {
+			bookmarks = rank_bookmarks(bookmarks, query)
+		}
+	} else if err != nil && !errors.Is(err, err_no_results) {
+		render_search_error(err)
+		return
+	}
+	token = token_manager.current(token)
+
+	if len(bookmarks) == 0 {
+		if query == "" {
+			wf.NewItem("The trash is empty").
+				Subtitle("Bookmarks that you delete at Raindrop.io end up here").
+				Valid(false)
+		} else {
+			render_search_error(err_no_results)
+		}
+		return
+	}
+
+	if query == "" && err == nil {
+		count := fmt.Sprint(len(bookmarks))
+		if more_results {
+			count = "all"
+		}
+		alfred_item := wf.NewItem("Empty the trash").
+			Var("goto", "confirm_empty_trash").
+			Subtitle("Permanently delete " + count + " bookmarks in the trash").
+			Valid(true)
+		alfred_item.Alt().
+			Var("goto", "confirm_empty_trash").
+			Subtitle("Permanently delete " + count + " bookmarks in the trash")
+	}
+
+	raindrop_collections := reverse_collection_array(get_collections(token, false, "trust"))
+	raindrop_collections_sublevel := reverse_collection_array(get_collections(token, true, "trust"))
+	var current_object []string
+	collection_names := collection_paths(raindrop_collections, raindrop_collections_sublevel, make(map[int]string), 0, current_object, -1)
+	render_trash(bookmarks, read_trash_origins(), collection_names, descr_in_list)
+
+	if more_results {
+		wf.NewItem("There are more bookmarks in the trash").
+			Subtitle("Type to search for the ones you are looking for").
+			Valid(false)
+	}
+}
+
+// Function for rendering the bookmarks in the trash, where enter restores a bookmark to the collection it was in, or to Unsorted if it isn't known where it was
+func render_trash(bookmarks []Raindrop, origins map[int]int, collection_names map[int]string, descr_in_list bool) {
+	for _, item := range bookmarks {
+		origin := origins[item.ID]
+		origin_name := collection_names[origin]
+		if origin_name == "" {
+			// The collection isn't known, or has been removed
+			origin = -1
+			origin_name = "Unsorted"
+		}
+
+		excerpt := item.Excerpt
+		if excerpt == "" {
+			excerpt = item.Link
+		}
+		subtitle := "Restore to " + origin_name + " •  " + get_hostname(item.Link)
+		if descr_in_list {
+			subtitle = "Restore to " + origin_name + " •  " + excerpt
+		}
+
+		bookmark_id := fmt.Sprint(item.ID)
+		alfred_item := wf.NewItem(item.Title).
+			Arg(item.Title).
+			Var("goto", "restore").
+			Var("restore_id", bookmark_id).
+			Var("restore_collection", fmt.Sprint(origin)).
+			Copytext(item.Link).
+			Subtitle(subtitle).
+			Valid(true)
+		alfred_item.Cmd().
+			Arg(item.Title).
+			Var("goto", "restore_to").
+			Var("restore_id", bookmark_id).
+			Subtitle("Restore to another collection")
+		alfred_item.Ctrl().
+			Arg(item.Link).
+			Var("goto", "open").
+			Subtitle(item.Link)
+		alfred_item.Alt().
+			Arg(item.Link).
+			Var("goto", "copy").
+			Subtitle("Press enter to copy this link to clipboard")
+	}
+}
+
+// Function for listing the collections that a bookmark in the trash can be restored to
+func select_restore_collection(query string, full_collection_paths bool) {
+	token := read_token()
+
+	alfred_item := wf.NewItem("Restore to Unsorted").
+		Var("goto", "restore").
+		Var("restore_collection", "-1").
+		Subtitle("Or select a collection below").
+		Valid(true).
+		Icon(&aw.Icon{Value: "folder.png", Type: ""})
+	alfred_item.Alt().
+		Var("goto", "restore").
+		Var("restore_collection", "-1").
+		Subtitle("Or select a collection below")
+
+	render_style := "tree"
+	if full_collection_paths {
+		render_style = "paths"
+	}
+	raindrop_collections := reverse_collection_array(get_collections(token, false, "check"))
+	raindrop_collections_sublevel := reverse_collection_array(get_collections(token, true, "check"))
+	var current_object []string
+	render_collections(raindrop_collections, raindrop_collections_sublevel, render_style, "restoring", 0, current_object, -1, "", "", "")
+
+	if query != "" {
+		wf.Filter(query)
+	}
+}
+
+// Function for handling the restore command, which moves the bookmark in the restore_id variable from the trash to the collection in the restore_collection variable.
+// What is printed is shown to the user as a notification.
+func restore_bookmark() {
+	id, err := strconv.Atoi(wf.Config.Get("restore_id", ""))
+	if err != nil || id <= 0 {
+		log.Printf("Invalid bookmark to restore: %q", wf.Config.Get("restore_id", ""))
+		fmt.Print("Could not restore the bookmark, as it wasn't known which bookmark to restore")
+		return
+	}
+	collection, err := strconv.Atoi(wf.Config.Get("restore_collection", "-1"))
+	if err != nil || collection == 0 {
+		collection = -1
+	}
+
+	bookmark, err := move_raindrop(id, collection, read_token())
+	if err != nil {
+		log.Printf("Failed to restore bookmark %d: %v", id, err)
+		fmt.Print("Could not restore the bookmark from the trash")
+		return
+	}
+
+	// The bookmark is added back to the local cache right away, so that the local search finds it without waiting for the next refresh
+	if err := update_cached_bookmark(bookmark); err != nil {
+		log.Printf("Failed to add the restored bookmark to the local cache: %v", err)
+	}
+	trash := []Raindrop{}
+	for _, item := range read_cached_trash() {
+		if item.ID != id {
+			trash = append(trash, item)
+		}
+	}
+	origins := read_trash_origins()
+	delete(origins, id)
+	write_trash_cache(trash, origins)
+	fmt.Print(bookmark.Title)
+}
+
+// Function for asking the user if the trash should really be emptied, as the bookmarks in it are deleted permanently
+func confirm_empty_trash() {
+	alfred_item := wf.NewItem("Yes, empty the trash").
+		Var("goto", "empty_trash").
+		Subtitle("The bookmarks in the trash are deleted permanently, which can't be undone").
+		Valid(true)
+	alfred_item.Alt().
+		Var("goto", "empty_trash").
+		Subtitle("The bookmarks in the trash are deleted permanently, which can't be undone")
+	alfred_item2 := wf.NewItem("No, keep the bookmarks in the trash").
+		Var("goto", "trash").
+		Subtitle("⬅︎ Go back to the trash").
+		Valid(true)
+	alfred_item2.Alt().
+		Var("goto", "trash").
+		Subtitle("⬅︎ Go back to the trash")
+}
+
+// Function for handling the empty_trash command, which permanently deletes all bookmarks in the trash.
+// What is printed is shown to the user as a notification.
+func empty_trash() {
+	token := read_token()
+	response_body, err := api_send("DELETE", "/collection/"+fmt.Sprint(trash_collection), token, nil)
+	var result struct {
+		Result bool `json:"result"`
+	}
+	if err == nil {
+		err = decode_response(response_body, &result)
+	}
+	if err != nil || !result.Result {
+		log.Printf("Failed to empty the trash: %v %s", err, response_body)
+		fmt.Print("Could not empty the trash")
+		return
+	}
+	write_trash_cache(nil, nil)
+	fmt.Print("The trash has been emptied")
+}
+
+// Function for reading the trash as it was at the last refresh of the local cache
+func read_cached_trash() []Raindrop {
+	var cache_base RaindropsResponse
+	if cache_data, _, err := cache_storage.Read("trash"); err == nil {
+		decode_response(cache_data, &cache_base)
+	}
+	return cache_base.Items
+}
+
+// Function for reading which collection each bookmark in the trash was in before it was moved there, as far as the local cache knows
+func read_trash_origins() map[int]int {
+	origins := make(map[int]int)
+	if cache_data, _, err := cache_storage.Read("trash_origins"); err == nil {
+		json.Unmarshal(cache_data, &origins)
+	}
+	return origins
+}
+
+// Function for saving the bookmarks that are in the trash when the local cache is refreshed.
+// The bookmarks that were in the cache until now were in their collection just before they were moved to the trash, which is remembered so that they can be restored there.
+func update_trash_cache(trash []Raindrop, cached []Raindrop) error {
+	cached_collections := make(map[int]int)
+	for _, bookmark := range cached {
+		cached_collections[bookmark.ID] = bookmark.Collection.ID
+	}
+	previous_origins := read_trash_origins()
+	origins := make(map[int]int)
+	for _, bookmark := range trash {
+		if origin, found := previous_origins[bookmark.ID]; found {
+			origins[bookmark.ID] = origin
+		} else if collection, found := cached_collections[bookmark.ID]; found && collection != trash_collection {
+			origins[bookmark.ID] = collection
+		}
+	}
+	return write_trash_cache(trash, origins)
+}
+
+func write_trash_cache(trash []Raindrop, origins map[int]int) error {
+	if trash == nil {
+		trash = []Raindrop{}
+	}
+	if origins == nil {
+		origins = make(map[int]int)
+	}
+	trash_json, _ := json.Marshal(RaindropsResponse{Result: true, Items: trash, Count: len(trash)})
+	if err := cache_storage.Write("trash", trash_json); err != nil {
+		return err
+	}
+	origins_json, _ := json.Marshal(origins)
+	return cache_storage.Write("trash_origins", origins_json)
+}
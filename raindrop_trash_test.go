@@ -0,0 +1,172 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Moves a bookmark to the trash on the fake server, without updating it, like at Raindrop.io
+func (fake *fake_raindrop) trash_raindrop(id int) {
+	fake.mutex.Lock()
+	last_update := ""
+	for _, raindrop := range fake.raindrop_data {
+		if raindrop.ID == id {
+			last_update = raindrop.LastUpdate
+		}
+	}
+	fake.mutex.Unlock()
+	fake.update_raindrop(id, last_update, func(raindrop *Raindrop) {
+		raindrop.Collection.ID = trash_collection
+	})
+}
+
+func TestBrowseTrash(t *testing.T) {
+	fake := setup_test_workflow(t)
+	browse_trash("", false)
+	if output := feedback_json(); !strings.Contains(output, "The trash is empty") {
+		t.Errorf("Expected an empty trash, got %s", output)
+	}
+
+	// The local cache knows which collection the bookmark was in before it was moved to the trash
+	if _, err := run_refresh(read_token(), "fetch"); err != nil {
+		t.Fatal(err)
+	}
+	fake.trash_raindrop(1)
+	// A bookmark that was never in the local cache is restored to Unsorted
+	fake.add_generated_raindrops(1)
+	fake.trash_raindrop(10000)
+	if _, err := run_refresh(read_token(), "sync"); err != nil {
+		t.Fatal(err)
+	}
+	if origins := read_trash_origins(); len(origins) != 1 || origins[1] != 1002 {
+		t.Errorf("Unexpected origins: %v", origins)
+	}
+
+	wf.Feedback.Clear()
+	t.Setenv("trash_from", "local")
+	browse_trash("", false)
+	check_golden(t, fake, "browse_trash")
+}
+
+func TestBrowseTrashOffline(t *testing.T) {
+	fake := setup_test_workflow(t)
+	if _, err := run_refresh(read_token(), "fetch"); err != nil {
+		t.Fatal(err)
+	}
+	fake.trash_raindrop(2)
+	if _, err := run_refresh(read_token(), "sync"); err != nil {
+		t.Fatal(err)
+	}
+	fake.make_unreachable("/rest/v1/raindrops/")
+
+	wf.Feedback.Clear()
+	browse_trash("rust", false)
+	output := feedback_json()
+	if !strings.Contains(output, "Offline: showing the cached trash") || !strings.Contains(output, `"title":"The Rust Programming Language","subtitle":"Restore to Dev/Rust`) {
+		t.Errorf("Expected the cached trash, got %s", output)
+	}
+	if strings.Contains(output, "Empty the trash") {
+		t.Errorf("Expected no option to empty the trash while offline, got %s", output)
+	}
+}
+
+func TestRestoreBookmark(t *testing.T) {
+	fake := setup_test_workflow(t)
+	fake.trash_raindrop(1)
+	write_trash_cache(nil, map[int]int{1: 1002})
+
+	t.Setenv("restore_id", "1")
+	t.Setenv("restore_collection", "1003")
+	restore_bookmark()
+	if bookmarks := fake.bookmarks_in(1003); len(bookmarks) != 2 || bookmarks[0].ID != 1 {
+		t.Errorf("Expected the bookmark to be restored to the chosen collection, got %v", bookmarks)
+	}
+	if origins := read_trash_origins(); len(origins) != 0 {
+		t.Errorf("Expected the restored bookmark to be forgotten, got %v", origins)
+	}
+
+	t.Setenv("restore_id", "12345")
+	restore_bookmark()
+	if requests := strings.Join(fake.request_log(), "\n"); !strings.Contains(requests, `PUT /rest/v1/raindrop/1 {"collection":{"$ref":"collections","$id":1003}}`) {
+		t.Errorf("Unexpected requests: %s", requests)
+	}
+}
+
+func TestRestoreBookmarkToLocalCache(t *testing.T) {
+	fake := setup_test_workflow(t)
+	if _, err := run_refresh(read_token(), "fetch"); err != nil {
+		t.Fatal(err)
+	}
+	fake.trash_raindrop(3)
+	if _, err := run_refresh(read_token(), "sync"); err != nil {
+		t.Fatal(err)
+	}
+	synced, _ := last_sync_time()
+
+	t.Setenv("restore_id", "3")
+	t.Setenv("restore_collection", "2001")
+	if output := capture_output(t, restore_bookmark); output != "Fluffy pancakes" {
+		t.Errorf("Unexpected output: %s", output)
+	}
+	if trash := read_cached_trash(); len(trash) != 0 {
+		t.Errorf("Expected the restored bookmark to be gone from the cached trash, got %v", trash)
+	}
+	if sync_time, _ := last_sync_time(); !sync_time.Equal(synced) {
+		t.Errorf("Expected the restore not to count as a sync, got %v instead of %v", sync_time, synced)
+	}
+
+	// The local search finds the restored bookmark right away, without a refresh
+	fake.make_unreachable("/rest/v1/raindrops/")
+	wf.Feedback.Clear()
+	local_search("pancakes", read_token(), 0, "", false, true)
+	if output := feedback_json(); !strings.Contains(output, `"title":"Fluffy pancakes"`) {
+		t.Errorf("Expected the restored bookmark in the local search, got %s", output)
+	}
+}
+
+func TestRestoreBookmarkInvalid(t *testing.T) {
+	fake := setup_test_workflow(t)
+	for _, restore_id := range []string{"", "0", "pancakes"} {
+		t.Setenv("restore_id", restore_id)
+		if output := capture_output(t, restore_bookmark); output != "Could not restore the bookmark, as it wasn't known which bookmark to restore" {
+			t.Errorf("Unexpected output for %q: %s", restore_id, output)
+		}
+	}
+	if requests := fake.request_log(); len(requests) != 0 {
+		t.Errorf("Expected nothing to be sent to Raindrop.io, got %v", requests)
+	}
+}
+
+func TestSelectRestoreCollection(t *testing.T) {
+	setup_test_workflow(t)
+	select_restore_collection("rust", true)
+	output := feedback_json()
+	if !strings.Contains(output, `"title":"Dev/Rust"`) || !strings.Contains(output, `"restore_collection":"1003"`) || strings.Contains(output, "Recipes") {
+		t.Errorf("Unexpected collections: %s", output)
+	}
+}
+
+func TestEmptyTrash(t *testing.T) {
+	fake := setup_test_workflow(t)
+	fake.trash_raindrop(3)
+	fake.trash_raindrop(4)
+	write_trash_cache([]Raindrop{{ID: 3}, {ID: 4}}, map[int]int{3: 2001})
+
+	browse_trash("", false)
+	if output := feedback_json(); !strings.Contains(output, "Permanently delete 2 bookmarks in the trash") {
+		t.Errorf("Expected an option to empty the trash, got %s", output)
+	}
+	wf.Feedback.Clear()
+	confirm_empty_trash()
+	if output := feedback_json(); !strings.Contains(output, `"goto":"empty_trash"`) || !strings.Contains(output, `"goto":"trash"`) {
+		t.Errorf("Expected to be asked before the trash is emptied, got %s", output)
+	}
+
+	empty_trash()
+	if bookmarks := fake.bookmarks_in(trash_collection); len(bookmarks) != 0 {
+		t.Errorf("Expected the trash to be emptied, got %v", bookmarks)
+	}
+	if trash := read_cached_trash(); len(trash) != 0 || len(read_trash_origins()) != 0 {
+		t.Errorf("Expected the cached trash to be emptied, got %v", trash)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+	Data types for the objects that are returned by the Raindrop.io API
+
+	By Andreas Westerlind, 2021-2025
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Reference to another Raindrop.io object, like the collection a bookmark belongs to, or the parent of a collection
+type RaindropRef struct {
+	Ref string `json:"$ref,omitempty"`
+	ID  int    `json:"$id"`
+}
+
+// A highlight made in a bookmarked page
+type Highlight struct {
+	ID    string `json:"_id"`
+	Text  string `json:"text"`
+	Note  string `json:"note,omitempty"`
+	Color string `json:"color,omitempty"`
+}
+
+// The permanent copy that Raindrop.io keeps of a bookmarked page, which is only made for Pro users
+type PageCache struct {
+	Status string `json:"status,omitempty"`
+	Size   int    `json:"size,omitempty"`
+}
+
+// A bookmark, which is called a raindrop in the Raindrop.io API
+type Raindrop struct {
+	ID         int         `json:"_id,omitempty"`
+	Title      string      `json:"title"`
+	Excerpt    string      `json:"excerpt"`
+	Note       string      `json:"note,omitempty"`
+	Link       string      `json:"link"`
+	Domain     string      `json:"domain,omitempty"`
+	Type       string      `json:"type,omitempty"`
+	Cover      string      `json:"cover,omitempty"`
+	Tags       []string    `json:"tags"`
+	Important  bool        `json:"important,omitempty"`
+	Created    string      `json:"created,omitempty"`
+	LastUpdate string      `json:"lastUpdate,omitempty"`
+	Collection RaindropRef `json:"collection"`
+	Highlights []Highlight `json:"highlights,omitempty"`
+	Cache      *PageCache  `json:"cache,omitempty"`
+
+	// The readable text of the bookmarked page, which Raindrop.io doesn't return, but which is kept with the bookmarks in the local search index
+	PageText string `json:"pageText,omitempty"`
+
+	// Set for bookmarks that a full-text search at Raindrop.io found, but the local search didn't
+	FullText bool `json:"-"`
+}
+
+// A Raindrop.io collection
+type Collection struct {
+	ID     int          `json:"_id"`
+	Title  string       `json:"title"`
+	Cover  []string     `json:"cover,omitempty"`
+	Count  int          `json:"count,omitempty"`
+	Parent *RaindropRef `json:"parent,omitempty"`
+}
+
+// A Raindrop.io tag, where the ID is the name of the tag itself
+type Tag struct {
+	ID    string `json:"_id"`
+	Count int    `json:"count,omitempty"`
+}
+
+// The Raindrop.io user that the workflow is authenticated as
+type User struct {
+	ID       int    `json:"_id"`
+	FullName string `json:"fullName"`
+	Email    string `json:"email,omitempty"`
+	Pro      bool   `json:"pro,omitempty"`
+}
+
+// Response from the endpoints that return a list of raindrops
+type RaindropsResponse struct {
+	Result       bool       `json:"result"`
+	Items        []Raindrop `json:"items"`
+	Count        int        `json:"count,omitempty"`
+	ErrorMessage string     `json:"errorMessage,omitempty"`
+}
+
+// Response from the endpoints that return a single raindrop, like when it is updated
+type RaindropResponse struct {
+	Result       bool     `json:"result"`
+	Item         Raindrop `json:"item"`
+	ErrorMessage string   `json:"errorMessage,omitempty"`
+}
+
+// Response from the endpoints that return a list of collections
+type CollectionsResponse struct {
+	Result bool         `json:"result"`
+	Items  []Collection `json:"items"`
+}
+
+// Response from the endpoint that returns a list of tags
+type TagsResponse struct {
+	Result bool  `json:"result"`
+	Items  []Tag `json:"items"`
+}
+
+// Response from the endpoint that returns the current user
+type UserResponse struct {
+	Result bool `json:"result"`
+	User   User `json:"user"`
+}
+
+// Returns the ID of the parent collection, or 0 if this is a root level collection
+func (collection Collection) ParentID() int {
+	if collection.Parent == nil {
+		return 0
+	}
+	return collection.Parent.ID
+}
+
+// Decodes a JSON response from Raindrop.io into one of the types above.
+// Fields with unexpected types are left empty instead of making the whole response unusable,
+// so that a single odd value from the API doesn't break the workflow.
+func decode_response(data []byte, v interface{}) error {
+	err := json.Unmarshal(data, v)
+	var type_error *json.UnmarshalTypeError
+	if errors.As(err, &type_error) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,238 @@
+/*
+	Log of the bookmarks that have been opened, which the searches use for ranking the bookmarks that are opened often and recently higher (frecency),
+	and which is listed as the recently opened bookmarks
+
+	By Andreas Westerlind, 2025
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	aw "github.com/deanishe/awgo"
+)
+
+// How many times a bookmark has been opened that are kept in the log
+const usage_log_max_entries = 2000
+
+// How much the frecency of a bookmark can add to its score at most, in percent, so that a bookmark that is opened all the time doesn't push away better matches
+const max_frecency_boost = 200
+
+// How many bookmarks are listed as recently opened
+const recently_opened_max = 50
+
+// A bookmark that has been opened, and when
+type UsageEntry struct {
+	ID     int       `json:"id"`
+	Link   string    `json:"link"`
+	Opened time.Time `json:"opened"`
+}
+
+func usage_log_file() string {
+	return filepath.Join(wf.CacheDir(), "usage.log")
+}
+
+// Function for handling the open command, which logs the bookmark that is opened and passes its link on to be opened in the browser.
+// The ID of the bookmark is in the bookmark_id variable, which is only set for bookmarks, so that other links aren't logged.
+func open_bookmark(link string) {
+	if id, err := strconv.Atoi(wf.Config.Get("bookmark_id", "")); err == nil {
+		if err := log_opened_bookmark(id, link); err != nil {
+			log.Printf("Failed to log the opened bookmark: %v", err)
+		}
+	}
+	fmt.Print(link)
+}
+
+// Function for adding a bookmark to the usage log, which is a file with one JSON entry per line, so that an entry can be added without reading the whole log.
+// When the log has grown too long, it is replaced by the newest entries.
+func log_opened_bookmark(id int, link string) error {
+	entry_json, _ := json.Marshal(UsageEntry{ID: id, Link: link, Opened: time.Now()})
+	file, err := os.OpenFile(usage_log_file(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(entry_json, '\n'))
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return err
+	}
+
+	entries := read_usage_log()
+	if len(entries) <= usage_log_max_entries*2 {
+		return nil
+	}
+	return write_usage_log(entries[len(entries)-usage_log_max_entries:])
+}
+
+// Function for reading the usage log, with the oldest entry first.
+// Lines that can't be read, like one that was cut off halfway through, are left out.
+func read_usage_log() []UsageEntry {
+	file, err := os.Open(usage_log_file())
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var entries []UsageEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry UsageEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.ID != 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Function for replacing the usage log in one step, so that it is never read while half written
+func write_usage_log(entries []UsageEntry) error {
+	var lines strings.Builder
+	for _, entry := range entries {
+		entry_json, _ := json.Marshal(entry)
+		lines.Write(entry_json)
+		lines.WriteByte('\n')
+	}
+	temp_file, err := os.CreateTemp(wf.CacheDir(), ".usage.*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp_file.Name())
+	if _, err := temp_file.WriteString(lines.String()); err != nil {
+		temp_file.Close()
+		return err
+	}
+	if err := temp_file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp_file.Name(), usage_log_file())
+}
+
+// Function for getting the frecency of each bookmark that has been opened, where every time it has been opened counts, but recent times count more
+func frecency_scores() map[int]int {
+	scores := make(map[int]int)
+	for _, entry := range read_usage_log() {
+		scores[entry.ID] += visit_weight(time.Since(entry.Opened))
+	}
+	return scores
+}
+
+// Function for getting how much one time that a bookmark has been opened counts, depending on how long ago it was
+func visit_weight(age time.Duration) int {
+	switch {
+	case age < 4*24*time.Hour:
+		return 100
+	case age < 14*24*time.Hour:
+		return 70
+	case age < 31*24*time.Hour:
+		return 50
+	case age < 90*24*time.Hour:
+		return 30
+	default:
+		return 10
+	}
+}
+
+// Function for increasing the score of a bookmark by its frecency, by up to max_frecency_boost percent
+func boost_by_frecency(score int, frecency int) int {
+	if frecency > max_frecency_boost {
+		frecency = max_frecency_boost
+	}
+	return score * (100 + frecency) / 100
+}
+
+// Function for moving the bookmarks that are opened often further up in a list of search results from Raindrop.io,
+// where the position in the list is used as the score, as Raindrop.io has already sorted the results by how well they match
+func sort_by_frecency(bookmarks []Raindrop) []Raindrop {
+	frecency := frecency_scores()
+	if len(frecency) == 0 {
+		return bookmarks
+	}
+	scores := make(map[int]int)
+	for position, bookmark := range bookmarks {
+		scores[bookmark.ID] = boost_by_frecency(len(bookmarks)-position, frecency[bookmark.ID])
+	}
+	sorted := append([]Raindrop{}, bookmarks...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return scores[sorted[i].ID] > scores[sorted[j].ID]
+	})
+	return sorted
+}
+
+// Function for showing an item that goes to the list of recently opened bookmarks, when any bookmarks have been opened
+func recently_opened_item() {
+	if _, err := os.Stat(usage_log_file()); err != nil {
+		return
+	}
+	alfred_item := wf.NewItem("Recently opened bookmarks").
+		Var("goto", "recent").
+		Subtitle("").
+		Valid(true).
+		Icon(&aw.Icon{Value: "icon.png", Type: ""})
+	alfred_item.Alt().
+		Var("goto", "recent").
+		Subtitle("")
+}
+
+// Function for listing the bookmarks that have been opened, with the most recently opened first, so that they can be opened again.
+// The bookmarks are taken from the local cache, and if a bookmark isn't in the cache, its link is shown instead.
+func recently_opened(query string, descr_in_list bool) {
+	entries := read_usage_log()
+	cached := make(map[int]Raindrop)
+	if cache_data, _, err := cache_storage.Read("bookmarks"); err == nil {
+		var cache_base RaindropsResponse
+		decode_response(cache_data, &cache_base)
+		for _, bookmark := range cache_base.Items {
+			cached[bookmark.ID] = bookmark
+		}
+	}
+
+	var bookmarks []Raindrop
+	listed := make(map[int]bool)
+	for i := len(entries) - 1; i >= 0 && len(bookmarks) < recently_opened_max; i-- {
+		entry := entries[i]
+		if listed[entry.ID] {
+			continue
+		}
+		listed[entry.ID] = true
+		bookmark, found := cached[entry.ID]
+		if !found {
+			bookmark = Raindrop{ID: entry.ID, Title: entry.Link, Link: entry.Link}
+		}
+		bookmarks = append(bookmarks, bookmark)
+	}
+	if query != "" {
+		bookmarks = rank_bookmarks(bookmarks, query)
+	}
+
+	if len(bookmarks) == 0 {
+		if len(entries) == 0 {
+			wf.NewItem("No bookmarks have been opened yet").
+				Subtitle("The bookmarks you open from the searches are listed here").
+				Valid(false)
+		} else {
+			wf.NewItem("No recently opened bookmarks match your search").
+				Subtitle("Try a different search query").
+				Valid(false)
+		}
+		return
+	}
+
+	token := read_token()
+	raindrop_collections := reverse_collection_array(get_collections(token, false, "trust"))
+	raindrop_collections_sublevel := reverse_collection_array(get_collections(token, true, "trust"))
+	var current_object []string
+	collection_names := collection_paths(raindrop_collections, raindrop_collections_sublevel, make(map[int]string), 0, current_object, -1)
+	render_results(bookmarks, "all", collection_names, descr_in_list)
+}
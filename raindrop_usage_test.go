@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageLog(t *testing.T) {
+	setup_test_workflow(t)
+	if entries := read_usage_log(); len(entries) != 0 {
+		t.Fatalf("Expected an empty log, got %v", entries)
+	}
+	log_opened_bookmark(1, "https://go.dev/")
+	log_opened_bookmark(2, "https://www.rust-lang.org/")
+
+	// A line that was cut off is skipped
+	file, _ := os.OpenFile(usage_log_file(), os.O_APPEND|os.O_WRONLY, 0666)
+	file.WriteString("{\"id\":3,\"li\n")
+	file.Close()
+
+	entries := read_usage_log()
+	if len(entries) != 2 || entries[0].ID != 1 || entries[1].ID != 2 || entries[1].Link != "https://www.rust-lang.org/" {
+		t.Errorf("Unexpected entries: %v", entries)
+	}
+}
+
+func TestUsageLogTrimmed(t *testing.T) {
+	setup_test_workflow(t)
+	entries := make([]UsageEntry, usage_log_max_entries*2)
+	for i := range entries {
+		entries[i] = UsageEntry{ID: i + 1, Link: "https://example.com/", Opened: time.Now()}
+	}
+	if err := write_usage_log(entries); err != nil {
+		t.Fatal(err)
+	}
+	log_opened_bookmark(99999, "https://example.com/last")
+
+	entries = read_usage_log()
+	if len(entries) != usage_log_max_entries || entries[len(entries)-1].ID != 99999 {
+		t.Errorf("Expected the newest %d entries to be kept, got %d ending with %v", usage_log_max_entries, len(entries), entries[len(entries)-1])
+	}
+}
+
+func TestFrecencyScores(t *testing.T) {
+	setup_test_workflow(t)
+	write_usage_log([]UsageEntry{
+		{ID: 1, Opened: time.Now().Add(-100 * 24 * time.Hour)},
+		{ID: 1, Opened: time.Now().Add(-20 * 24 * time.Hour)},
+		{ID: 2, Opened: time.Now()},
+	})
+	scores := frecency_scores()
+	if scores[1] != 60 || scores[2] != 100 || scores[3] != 0 {
+		t.Errorf("Unexpected frecency scores: %v", scores)
+	}
+
+	if score := boost_by_frecency(100, 50); score != 150 {
+		t.Errorf("Expected a 50%% boost, got %d", score)
+	}
+	if score := boost_by_frecency(100, 1000); score != 100+max_frecency_boost {
+		t.Errorf("Expected the boost to be capped, got %d", score)
+	}
+}
+
+func TestRankBookmarksFrecency(t *testing.T) {
+	bookmarks := []Raindrop{
+		{ID: 1, Title: "Go notes"},
+		{ID: 2, Title: "Go notes"},
+		{ID: 3, Title: "Go", Tags: []string{"notes"}},
+	}
+	if ids := bookmark_ids(rank_bookmarks_fuzzy(bookmarks, "go notes", nil, map[int]int{2: 100})); ids != "2,1,3" {
+		t.Errorf("Unexpected ranking: %s", ids)
+	}
+}
+
+func TestSortByFrecency(t *testing.T) {
+	setup_test_workflow(t)
+	bookmarks := []Raindrop{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}}
+	if ids := bookmark_ids(sort_by_frecency(bookmarks)); ids != "1,2,3,4" {
+		t.Errorf("Expected the order to be kept without a usage log, got %s", ids)
+	}
+	// An opened bookmark moves up, but not past every better match
+	write_usage_log([]UsageEntry{{ID: 2, Opened: time.Now()}, {ID: 4, Opened: time.Now()}})
+	if ids := bookmark_ids(sort_by_frecency(bookmarks)); ids != "2,1,3,4" {
+		t.Errorf("Unexpected order: %s", ids)
+	}
+}
+
+func TestOpenBookmark(t *testing.T) {
+	setup_test_workflow(t)
+	open_bookmark("https://app.raindrop.io/")
+	if entries := read_usage_log(); len(entries) != 0 {
+		t.Errorf("Expected a link without a bookmark ID not to be logged, got %v", entries)
+	}
+	t.Setenv("bookmark_id", "3")
+	open_bookmark("https://example.com/pancakes")
+	if entries := read_usage_log(); len(entries) != 1 || entries[0].ID != 3 || entries[0].Link != "https://example.com/pancakes" {
+		t.Errorf("Unexpected entries: %v", entries)
+	}
+}
+
+func TestRecentlyOpened(t *testing.T) {
+	setup_test_workflow(t)
+	recently_opened("", false)
+	if first := item_json(wf.Feedback.Items[0]); !strings.Contains(first, "No bookmarks have been opened yet") {
+		t.Errorf("Unexpected item: %s", first)
+	}
+
+	// Fill the local cache
+	local_search_command("standard", "", "", "", "", false, true)
+	log_opened_bookmark(1, "https://go.dev/doc/tutorial/generics")
+	log_opened_bookmark(2, "https://doc.rust-lang.org/book/")
+	log_opened_bookmark(1, "https://go.dev/doc/tutorial/generics")
+	log_opened_bookmark(12345, "https://example.com/removed")
+
+	wf.Feedback.Clear()
+	recently_opened("", false)
+	expected := []string{"https://example.com/removed", "Golang generics tutorial", "The Rust Programming Language"}
+	if len(wf.Feedback.Items) != len(expected) {
+		t.Fatalf("Expected %d bookmarks, got %d", len(expected), len(wf.Feedback.Items))
+	}
+	for i, title := range expected {
+		if item := item_json(wf.Feedback.Items[i]); !strings.Contains(item, `"title":"`+title+`"`) {
+			t.Errorf("Expected %q at position %d, got %s", title, i, item)
+		}
+	}
+	if first := item_json(wf.Feedback.Items[1]); !strings.Contains(first, `"bookmark_id":"1"`) {
+		t.Errorf("Expected the bookmark ID to be passed on, got %s", first)
+	}
+
+	wf.Feedback.Clear()
+	recently_opened("rust", false)
+	if len(wf.Feedback.Items) != 1 || !strings.Contains(item_json(wf.Feedback.Items[0]), "The Rust Programming Language") {
+		t.Errorf("Expected only the matching bookmark, got %d items", len(wf.Feedback.Items))
+	}
+}